@@ -0,0 +1,121 @@
+package accesscontrol
+
+import (
+	"net"
+	"net/netip"
+	"path"
+	"strings"
+
+	"github.com/mark-rushakoff/go_tftpd/clientaddr"
+)
+
+type Operation int
+
+const (
+	AnyOperation Operation = iota
+	Read
+	Write
+)
+
+func (o Operation) String() string {
+	switch o {
+	case AnyOperation:
+		return "any"
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+)
+
+func (a Action) String() string {
+	switch a {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	default:
+		return "unknown"
+	}
+}
+
+// Rule applies Action to requests matching all of its conditions.
+type Rule struct {
+	Action Action
+
+	// AnyOperation matches both reads and writes
+	Operation Operation
+
+	// The clients the rule applies to; the zero Prefix matches every client
+	Network netip.Prefix
+
+	// A path.Match pattern for the filename relative to the served root, or for any directory containing it,
+	// so "lab" and "lab/*" both match "lab/pxelinux.cfg/default"; empty matches every file.
+	// Filenames are resolved as by pathresolver.Resolve, without a leading slash or backslashes, and so must patterns be.
+	Pattern string
+}
+
+// AccessList decides which requests are served (RFC 1123 section 4.2.3.4).
+// Rules are evaluated in order and the first matching rule decides; DefaultAction applies when none match.
+type AccessList struct {
+	Rules         []Rule
+	DefaultAction Action
+}
+
+// Allows reports whether a client at addr may perform op on filename, which must already be resolved relative to the root.
+func (l *AccessList) Allows(op Operation, addr net.Addr, filename string) bool {
+	clientIP, hasIP := ipFromAddr(addr)
+
+	for _, rule := range l.Rules {
+		if rule.Operation != AnyOperation && rule.Operation != op {
+			continue
+		}
+		if rule.Network.IsValid() && !(hasIP && rule.Network.Contains(clientIP)) {
+			continue
+		}
+		if !matchesFileOrDirectory(rule.Pattern, filename) {
+			continue
+		}
+
+		return rule.Action == Allow
+	}
+
+	return l.DefaultAction == Allow
+}
+
+func ipFromAddr(addr net.Addr) (netip.Addr, bool) {
+	addrPort, ok := clientaddr.AddrPort(addr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	// prefixes never have zones, so link-local clients must match without theirs
+	return addrPort.Addr().WithZone(""), true
+}
+
+func matchesFileOrDirectory(pattern string, filename string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	for name := filename; ; {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+
+		slash := strings.LastIndexByte(name, '/')
+		if slash == -1 {
+			return false
+		}
+		name = name[:slash]
+	}
+}
@@ -0,0 +1,102 @@
+package accesscontrol
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/mark-rushakoff/go_tftpd/testhelpers"
+)
+
+func udpAddr(ip string) net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: 1234}
+}
+
+func TestEmptyListAppliesDefaultAction(t *testing.T) {
+	addr := udpAddr("10.0.0.1")
+
+	if !(&AccessList{}).Allows(Read, addr, "foo") {
+		t.Errorf("Expected an empty list to allow by default")
+	}
+	if (&AccessList{DefaultAction: Deny}).Allows(Read, addr, "foo") {
+		t.Errorf("Expected an empty list with a default of deny to deny")
+	}
+}
+
+func TestFirstMatchingRuleDecides(t *testing.T) {
+	list := &AccessList{
+		Rules: []Rule{
+			{Action: Allow, Operation: Read, Network: netip.MustParsePrefix("10.1.0.0/16"), Pattern: "lab/*"},
+			{Action: Deny, Network: netip.MustParsePrefix("10.1.0.0/16")},
+			{Action: Allow, Operation: Read, Pattern: "prod"},
+			{Action: Allow, Operation: Write, Network: netip.MustParsePrefix("10.2.0.5/32"), Pattern: "uploads/*"},
+		},
+		DefaultAction: Deny,
+	}
+
+	cases := []struct {
+		op       Operation
+		ip       string
+		filename string
+		allowed  bool
+	}{
+		// the lab network sees only lab files, and only for reading
+		{Read, "10.1.2.3", "lab/pxelinux.0", true},
+		{Read, "10.1.2.3", "lab/pxelinux.cfg/default", true},
+		{Write, "10.1.2.3", "lab/pxelinux.0", false},
+		{Read, "10.1.2.3", "prod/pxelinux.0", false},
+		{Read, "10.1.2.3", "labrador", false},
+
+		// everyone else sees only production files
+		{Read, "10.3.0.1", "prod/pxelinux.0", true},
+		{Read, "10.3.0.1", "prod", true},
+		{Read, "10.3.0.1", "lab/pxelinux.0", false},
+		{Write, "10.3.0.1", "prod/pxelinux.0", false},
+
+		// a single host may upload
+		{Write, "10.2.0.5", "uploads/log", true},
+		{Write, "10.2.0.6", "uploads/log", false},
+
+		// IPv4-mapped IPv6 clients match IPv4 networks
+		{Read, "::ffff:10.1.2.3", "lab/pxelinux.0", true},
+		{Read, "::ffff:10.1.2.3", "prod/pxelinux.0", false},
+	}
+
+	for _, c := range cases {
+		if allowed := list.Allows(c.op, udpAddr(c.ip), c.filename); allowed != c.allowed {
+			t.Errorf("%v of %q from %v: expected allowed to be %v", c.op, c.filename, c.ip, c.allowed)
+		}
+	}
+}
+
+func TestNetworkRulesDoNotMatchAddressesWithoutIPs(t *testing.T) {
+	list := &AccessList{
+		Rules: []Rule{
+			{Action: Allow, Network: netip.MustParsePrefix("0.0.0.0/0")},
+		},
+		DefaultAction: Deny,
+	}
+
+	if list.Allows(Read, testhelpers.MakeMockAddr("fake_network", "a"), "foo") {
+		t.Errorf("Expected a network rule not to match an address without an IP")
+	}
+	if !list.Allows(Read, testhelpers.MakeMockAddr("udp", "10.0.0.1:69"), "foo") {
+		t.Errorf("Expected an address string with an IP to match")
+	}
+}
+
+func TestLinkLocalClientsMatchNetworksRegardlessOfZone(t *testing.T) {
+	list := &AccessList{
+		Rules: []Rule{
+			{Action: Allow, Network: netip.MustParsePrefix("fe80::/10")},
+		},
+		DefaultAction: Deny,
+	}
+
+	if !list.Allows(Read, &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 1234, Zone: "eth0"}, "foo") {
+		t.Errorf("Expected a link-local client with a zone to match a link-local network")
+	}
+	if list.Allows(Read, udpAddr("2001:db8::1"), "foo") {
+		t.Errorf("Expected a global client not to match a link-local network")
+	}
+}
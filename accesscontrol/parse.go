@@ -0,0 +1,112 @@
+package accesscontrol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"path"
+	"strings"
+)
+
+// ParseRules reads one rule per line in the form
+//
+//	<allow|deny> <read|write|any> <CIDR, IP, or any> <pattern>
+//
+// such as "allow read 10.1.0.0/16 lab/*". Blank lines and lines starting with # are ignored.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRule(strings.Fields(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseRule(fields []string) (rule Rule, err error) {
+	if len(fields) != 4 {
+		return rule, fmt.Errorf("expected 4 fields, got %v", len(fields))
+	}
+
+	switch fields[0] {
+	case "allow":
+		rule.Action = Allow
+	case "deny":
+		rule.Action = Deny
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	switch fields[1] {
+	case "any":
+		rule.Operation = AnyOperation
+	case "read":
+		rule.Operation = Read
+	case "write":
+		rule.Operation = Write
+	default:
+		return rule, fmt.Errorf("unknown operation %q", fields[1])
+	}
+
+	if fields[2] != "any" {
+		rule.Network, err = parseNetwork(fields[2])
+		if err != nil {
+			return rule, err
+		}
+	}
+
+	if _, err := path.Match(fields[3], ""); err != nil {
+		return rule, fmt.Errorf("bad pattern %q", fields[3])
+	}
+	rule.Pattern, err = normalizePattern(fields[3])
+	if err != nil {
+		return rule, err
+	}
+
+	return rule, nil
+}
+
+// normalizePattern writes a pattern the way pathresolver.Resolve writes the filenames it is matched against,
+// so that e.g. "/secret/*" matches what a client asked for as "/secret/x". A pattern naming the root matches every file.
+func normalizePattern(pattern string) (string, error) {
+	normalized := strings.ReplaceAll(pattern, `\`, "/")
+	for _, element := range strings.Split(normalized, "/") {
+		if element == ".." {
+			return "", fmt.Errorf("pattern %q leaves the served directory", pattern)
+		}
+	}
+
+	return strings.TrimPrefix(path.Clean("/"+normalized), "/"), nil
+}
+
+// A single address is taken as a network of just that address.
+func parseNetwork(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return prefix, fmt.Errorf("bad network %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("bad network %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
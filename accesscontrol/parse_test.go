@@ -0,0 +1,109 @@
+package accesscontrol
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# lab clients only see lab files
+allow read  10.1.0.0/16 lab/*
+deny  any   10.1.0.0/16 *
+
+allow write 10.2.0.5    uploads/*
+allow read  any         prod
+deny  any   fd00::/8    *
+`))
+	if err != nil {
+		t.Fatalf("Expected rules to parse, got %v", err)
+	}
+
+	expected := []Rule{
+		{Action: Allow, Operation: Read, Network: netip.MustParsePrefix("10.1.0.0/16"), Pattern: "lab/*"},
+		{Action: Deny, Operation: AnyOperation, Network: netip.MustParsePrefix("10.1.0.0/16"), Pattern: "*"},
+		{Action: Allow, Operation: Write, Network: netip.MustParsePrefix("10.2.0.5/32"), Pattern: "uploads/*"},
+		{Action: Allow, Operation: Read, Pattern: "prod"},
+		{Action: Deny, Operation: AnyOperation, Network: netip.MustParsePrefix("fd00::/8"), Pattern: "*"},
+	}
+
+	if len(rules) != len(expected) {
+		t.Fatalf("Expected %v rules, got %v", len(expected), rules)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("Rule %v: expected %+v, got %+v", i, expected[i], rules[i])
+		}
+	}
+}
+
+func TestParseRulesMasksNetworks(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("allow read 10.1.2.3/16 *"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules[0].Network != netip.MustParsePrefix("10.1.0.0/16") {
+		t.Errorf("Expected network to be masked, got %v", rules[0].Network)
+	}
+}
+
+func TestParseRulesReportsBadLines(t *testing.T) {
+	cases := map[string]string{
+		"allow read any":                "line 1: expected 4 fields, got 3",
+		"permit read any *":             `line 1: unknown action "permit"`,
+		"allow delete any *":            `line 1: unknown operation "delete"`,
+		"allow read 10.0.0.0/33 *":      `line 1: bad network "10.0.0.0/33"`,
+		"allow read lab *":              `line 1: bad network "lab"`,
+		"\n# comment\nallow read any [": `line 3: bad pattern "["`,
+		"deny read any ../*":            `line 1: pattern "../*" leaves the served directory`,
+		"deny read any lab/../secret":   `line 1: pattern "lab/../secret" leaves the served directory`,
+		`deny read any lab\..\secret`:   `line 1: pattern "lab\\..\\secret" leaves the served directory`,
+	}
+
+	for input, expected := range cases {
+		_, err := ParseRules(strings.NewReader(input))
+		if err == nil || err.Error() != expected {
+			t.Errorf("Parsing %q: expected error %q, got %v", input, expected, err)
+		}
+	}
+}
+
+func TestParseRulesNormalizesPatternsLikeFilenames(t *testing.T) {
+	cases := map[string]string{
+		"secret/*":    "secret/*",
+		"/secret/*":   "secret/*",
+		"//secret/*":  "secret/*",
+		`\secret\*`:   "secret/*",
+		"./secret/":   "secret",
+		"secret//x":   "secret/x",
+		"/":           "",
+		"*":           "*",
+		"..secret":    "..secret",
+		"/pxelinux.0": "pxelinux.0",
+	}
+
+	for pattern, expected := range cases {
+		rules, err := ParseRules(strings.NewReader("deny read any " + pattern))
+		if err != nil {
+			t.Errorf("Parsing pattern %q: %v", pattern, err)
+			continue
+		}
+		if rules[0].Pattern != expected {
+			t.Errorf("Expected pattern %q to become %q, got %q", pattern, expected, rules[0].Pattern)
+		}
+	}
+}
+
+func TestRulesWithLeadingSlashMatchResolvedFilenames(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("deny read any /secret/*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := &AccessList{Rules: rules, DefaultAction: Allow}
+	if list.Allows(Read, udpAddr("10.0.0.1"), "secret/x") {
+		t.Errorf("Expected /secret/* to deny secret/x")
+	}
+}
@@ -0,0 +1,72 @@
+package clientaddr
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// Key identifies a client's address, so that the same client is recognized however its address is spelled.
+// Keys are comparable and suitable for use in maps.
+type Key struct {
+	addrPort netip.AddrPort
+
+	// Addresses that are not IP addresses are only as equal as their strings
+	network string
+	str     string
+}
+
+func KeyOf(addr net.Addr) Key {
+	if addrPort, ok := AddrPort(addr); ok {
+		return Key{addrPort: addrPort}
+	}
+
+	return Key{network: addr.Network(), str: addr.String()}
+}
+
+// HostKeyOf is KeyOf without the port, identifying every address of the host addr belongs to.
+func HostKeyOf(addr net.Addr) Key {
+	if addrPort, ok := AddrPort(addr); ok {
+		return Key{addrPort: netip.AddrPortFrom(addrPort.Addr(), 0)}
+	}
+
+	return Key{network: addr.Network(), str: addr.String()}
+}
+
+// AddrPort is the normalized IP address and port of addr, and false if addr is not an IP address.
+// IPv4 clients of dual-stack sockets appear as IPv4-mapped IPv6 addresses, so those are unmapped,
+// and numeric zones are replaced by the name of their interface.
+func AddrPort(addr net.Addr) (netip.AddrPort, bool) {
+	var addrPort netip.AddrPort
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ip, ok := netip.AddrFromSlice(udpAddr.IP)
+		if !ok {
+			return netip.AddrPort{}, false
+		}
+		addrPort = netip.AddrPortFrom(ip.WithZone(udpAddr.Zone), uint16(udpAddr.Port))
+	} else {
+		var err error
+		addrPort, err = netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.AddrPort{}, false
+		}
+	}
+
+	return netip.AddrPortFrom(normalize(addrPort.Addr()), addrPort.Port()), true
+}
+
+func normalize(ip netip.Addr) netip.Addr {
+	ip = ip.Unmap()
+	if !ip.Is6() || ip.Zone() == "" {
+		// Unmap drops the zone along with the IPv6 form
+		return ip
+	}
+
+	if index, err := strconv.Atoi(ip.Zone()); err == nil {
+		if iface, err := net.InterfaceByIndex(index); err == nil {
+			return ip.WithZone(iface.Name)
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,110 @@
+package clientaddr
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/mark-rushakoff/go_tftpd/testhelpers"
+)
+
+func TestKeysOfTheSameClientAreEqual(t *testing.T) {
+	cases := []struct {
+		a, b net.Addr
+	}{
+		{
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69},
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 69},
+		},
+		{
+			// as reported by a dual-stack socket
+			&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 69},
+			testhelpers.MakeMockAddr("udp", "10.0.0.1:69"),
+		},
+		{
+			&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 69},
+			testhelpers.MakeMockAddr("udp", "[2001:db8:0:0::1]:69"),
+		},
+		{
+			&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 69, Zone: "eth0"},
+			testhelpers.MakeMockAddr("udp", "[fe80::1%eth0]:69"),
+		},
+		{
+			testhelpers.MakeMockAddr("fake_network", "a"),
+			testhelpers.MakeMockAddr("fake_network", "a"),
+		},
+	}
+
+	for _, c := range cases {
+		if KeyOf(c.a) != KeyOf(c.b) {
+			t.Errorf("Expected %v and %v to have the same key", c.a, c.b)
+		}
+	}
+}
+
+func TestKeysOfDifferentClientsDiffer(t *testing.T) {
+	cases := []struct {
+		a, b net.Addr
+	}{
+		{
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69},
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 70},
+		},
+		{
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69},
+			&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 69},
+		},
+		{
+			&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 69, Zone: "eth0"},
+			&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 69, Zone: "eth1"},
+		},
+		{
+			testhelpers.MakeMockAddr("fake_network", "a"),
+			testhelpers.MakeMockAddr("fake_network", "b"),
+		},
+		{
+			testhelpers.MakeMockAddr("fake_network", "a"),
+			testhelpers.MakeMockAddr("other_network", "a"),
+		},
+	}
+
+	for _, c := range cases {
+		if KeyOf(c.a) == KeyOf(c.b) {
+			t.Errorf("Expected %v and %v to have different keys", c.a, c.b)
+		}
+	}
+}
+
+func TestHostKeysIgnorePorts(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69}
+	if HostKeyOf(a) != HostKeyOf(testhelpers.MakeMockAddr("udp", "[::ffff:10.0.0.1]:70")) {
+		t.Errorf("Expected every port of %v to have the same host key", a.IP)
+	}
+	if HostKeyOf(a) == HostKeyOf(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 69}) {
+		t.Errorf("Expected different hosts to have different host keys")
+	}
+}
+
+func TestNumericZonesAreNamed(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("No interface named lo")
+	}
+
+	addrPort, ok := AddrPort(&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 69, Zone: strconv.Itoa(loopback.Index)})
+	if !ok {
+		t.Fatalf("Expected an address")
+	}
+
+	expected := netip.MustParseAddrPort("[fe80::1%lo]:69")
+	if addrPort != expected {
+		t.Errorf("Expected %v, got %v", expected, addrPort)
+	}
+}
+
+func TestAddrPortOfNonIPAddress(t *testing.T) {
+	if _, ok := AddrPort(testhelpers.MakeMockAddr("fake_network", "a")); ok {
+		t.Errorf("Expected no address for a non-IP address")
+	}
+}
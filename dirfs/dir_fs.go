@@ -0,0 +1,200 @@
+package dirfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type SymlinkPolicy int
+
+const (
+	// Symlinks are followed as long as they resolve to somewhere under the root
+	FollowWithinRoot SymlinkPolicy = iota
+
+	// Any symlink along a requested path causes the request to fail
+	NeverFollow
+)
+
+var ErrSymlink = errors.New("Symlinks are not followed")
+
+// Uploads in progress are written to ".<name>.upload-<random>" next to where they will appear.
+const uploadMarker = ".upload-"
+
+// DirFS is the file system rooted at a directory, like os.DirFS, that can also create files.
+// Unlike os.DirFS, no name can reach outside the directory, even through a symlink.
+type DirFS struct {
+	root     *os.Root
+	symlinks SymlinkPolicy
+}
+
+func NewDirFS(dir string, symlinks SymlinkPolicy) (*DirFS, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirFS{
+		root:     root,
+		symlinks: symlinks,
+	}, nil
+}
+
+// Open opens name for reading. Uploads in progress cannot be opened, as if they did not exist, so that nobody reads a partial file.
+func (d *DirFS) Open(name string) (fs.File, error) {
+	if err := d.check("open", name); err != nil {
+		return nil, err
+	}
+	if isUpload(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	file, err := d.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Create opens a new file for writing; existing files are never overwritten.
+// The file only appears under name once the returned Upload is closed, so that an interrupted upload leaves nothing behind.
+func (d *DirFS) Create(name string) (io.WriteCloser, error) {
+	if name == "." {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	if err := d.check("create", name); err != nil {
+		return nil, err
+	}
+	if isUpload(name) {
+		// it could never be read
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+	}
+
+	// fail early rather than once the whole file has been received
+	if _, err := d.root.Lstat(name); err == nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: errors.Unwrap(err)}
+	}
+
+	for {
+		// next to the file, so that moving it into place never crosses file systems
+		tempName := path.Join(path.Dir(name), "."+path.Base(name)+uploadMarker+strconv.FormatUint(rand.Uint64(), 36))
+		file, err := d.root.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, &fs.PathError{Op: "create", Path: name, Err: errors.Unwrap(err)}
+		}
+
+		return &Upload{
+			root:     d.root,
+			file:     file,
+			name:     name,
+			tempName: tempName,
+		}, nil
+	}
+}
+
+// Upload is a file being created by DirFS.Create.
+type Upload struct {
+	root     *os.Root
+	file     *os.File
+	name     string
+	tempName string
+	done     bool
+}
+
+func (u *Upload) Write(p []byte) (int, error) {
+	return u.file.Write(p)
+}
+
+// Close gives the upload its name. It fails if a file of that name was created in the meantime,
+// which is left alone, and the upload is discarded.
+func (u *Upload) Close() error {
+	if u.done {
+		return nil
+	}
+	u.done = true
+	defer u.root.Remove(u.tempName)
+
+	if err := u.file.Close(); err != nil {
+		return err
+	}
+
+	// unlike renaming, linking never replaces an existing file
+	if err := u.root.Link(u.tempName, u.name); err != nil {
+		return &fs.PathError{Op: "create", Path: u.name, Err: errors.Unwrap(err)}
+	}
+	return nil
+}
+
+// Discard removes what was written; closing the upload afterwards does nothing.
+func (u *Upload) Discard() error {
+	if u.done {
+		return nil
+	}
+	u.done = true
+
+	u.file.Close()
+	return u.root.Remove(u.tempName)
+}
+
+// Close releases the directory; the file system cannot be used afterwards.
+func (d *DirFS) Close() error {
+	return d.root.Close()
+}
+
+func (d *DirFS) check(op string, name string) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+
+	if d.symlinks == NeverFollow && d.hasSymlink(name) {
+		return &fs.PathError{Op: op, Path: name, Err: ErrSymlink}
+	}
+
+	return nil
+}
+
+// isUpload reports whether name has the form of an upload in progress.
+func isUpload(name string) bool {
+	base := path.Base(name)
+	marker := strings.LastIndex(base, uploadMarker)
+	if !strings.HasPrefix(base, ".") || marker < 1 {
+		return false
+	}
+
+	suffix := base[marker+len(uploadMarker):]
+	_, err := strconv.ParseUint(suffix, 36, 64)
+	return err == nil && suffix == strings.ToLower(suffix)
+}
+
+// hasSymlink reports whether any existing element of name is a symlink.
+// Even if the tree changes after the check, the root still keeps the request within the directory.
+func (d *DirFS) hasSymlink(name string) bool {
+	if name == "." {
+		return false
+	}
+
+	elements := strings.Split(name, "/")
+	for i := range elements {
+		info, err := d.root.Lstat(strings.Join(elements[:i+1], "/"))
+		if err != nil {
+			// whatever is missing is reported when the file is opened
+			return false
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return true
+		}
+	}
+
+	return false
+}
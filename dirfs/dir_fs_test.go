@@ -0,0 +1,317 @@
+package dirfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newDirFS(t *testing.T, dir string, symlinks SymlinkPolicy) *DirFS {
+	d, err := NewDirFS(dir, symlinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+// Lays out a served directory next to a secret file, with symlinks both within the directory and out of it:
+//
+//	secret
+//	served/file
+//	served/dir/nested
+//	served/link-to-file -> file
+//	served/link-to-dir -> dir
+//	served/link-to-secret -> ../secret
+//	served/link-to-parent -> ..
+//	served/link-to-absolute-secret -> <absolute path to secret>
+func makeTree(t *testing.T) string {
+	parent := t.TempDir()
+	served := filepath.Join(parent, "served")
+
+	files := map[string]string{
+		filepath.Join(parent, "secret"):        "secret",
+		filepath.Join(served, "file"):          "file",
+		filepath.Join(served, "dir", "nested"): "nested",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"link-to-file":            "file",
+		"link-to-dir":             "dir",
+		"link-to-secret":          "../secret",
+		"link-to-parent":          "..",
+		"link-to-absolute-secret": filepath.Join(parent, "secret"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(served, name)); err != nil {
+			t.Skipf("Cannot create symlinks: %v", err)
+		}
+	}
+
+	return served
+}
+
+func TestSymlinkPolicies(t *testing.T) {
+	served := makeTree(t)
+
+	cases := []struct {
+		name     string
+		policy   SymlinkPolicy
+		expected string // empty when opening should fail
+	}{
+		{"file", FollowWithinRoot, "file"},
+		{"dir/nested", FollowWithinRoot, "nested"},
+		{"link-to-file", FollowWithinRoot, "file"},
+		{"link-to-dir/nested", FollowWithinRoot, "nested"},
+		{"link-to-secret", FollowWithinRoot, ""},
+		{"link-to-parent/secret", FollowWithinRoot, ""},
+		{"link-to-parent/served/file", FollowWithinRoot, ""},
+		{"link-to-absolute-secret", FollowWithinRoot, ""},
+
+		{"file", NeverFollow, "file"},
+		{"dir/nested", NeverFollow, "nested"},
+		{"link-to-file", NeverFollow, ""},
+		{"link-to-dir/nested", NeverFollow, ""},
+		{"link-to-secret", NeverFollow, ""},
+		{"link-to-parent/secret", NeverFollow, ""},
+		{"link-to-absolute-secret", NeverFollow, ""},
+	}
+
+	for _, c := range cases {
+		content, err := fs.ReadFile(newDirFS(t, served, c.policy), c.name)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("Policy %v: expected %q to fail to open, read %q", c.policy, c.name, content)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Policy %v: expected to open %q, got %v", c.policy, c.name, err)
+		} else if string(content) != c.expected {
+			t.Errorf("Policy %v: read wrong content for %q: %q", c.policy, c.name, content)
+		}
+	}
+}
+
+func TestNeverFollowReportsSymlinks(t *testing.T) {
+	served := makeTree(t)
+
+	_, err := newDirFS(t, served, NeverFollow).Open("link-to-file")
+	if !errors.Is(err, ErrSymlink) {
+		t.Errorf("Expected opening a symlink to fail with ErrSymlink, got %v", err)
+	}
+}
+
+func TestCreateThroughSymlinks(t *testing.T) {
+	served := makeTree(t)
+
+	cases := []struct {
+		name    string
+		policy  SymlinkPolicy
+		created string // path under the parent of the served directory, or empty when creating should fail
+	}{
+		{"link-to-dir/new", FollowWithinRoot, "served/dir/new"},
+		{"link-to-parent/new", FollowWithinRoot, ""},
+		{"link-to-dir/new", NeverFollow, ""},
+	}
+
+	for _, c := range cases {
+		w, err := newDirFS(t, served, c.policy).Create(c.name)
+		if c.created == "" {
+			if err == nil {
+				w.Close()
+				t.Errorf("Policy %v: expected creating %q to fail", c.policy, c.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Policy %v: expected to create %q, got %v", c.policy, c.name, err)
+			continue
+		}
+		w.Close()
+
+		if _, err := os.Stat(filepath.Join(filepath.Dir(served), filepath.FromSlash(c.created))); err != nil {
+			t.Errorf("Policy %v: expected %q to be created at %v", c.policy, c.name, c.created)
+		}
+		os.Remove(filepath.Join(filepath.Dir(served), filepath.FromSlash(c.created)))
+	}
+
+	for _, unexpected := range []string{"new", "served/new"} {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(served), unexpected)); err == nil {
+			t.Errorf("Expected nothing to be created at %v", unexpected)
+		}
+	}
+}
+
+func TestOpenReadsFilesUnderDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "foo"), []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := fs.ReadFile(newDirFS(t, dir, FollowWithinRoot), "foo")
+	if err != nil {
+		t.Fatalf("Expected to read file, got %v", err)
+	}
+	if string(content) != "bar" {
+		t.Errorf("Read wrong content: %q", content)
+	}
+}
+
+func TestCreateWritesNewFileUnderDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newDirFS(t, dir, FollowWithinRoot).Create("sub/foo")
+	if err != nil {
+		t.Fatalf("Expected to create file, got %v", err)
+	}
+	io.WriteString(w, "bar")
+	w.Close()
+
+	content, err := os.ReadFile(filepath.Join(dir, "sub", "foo"))
+	if err != nil {
+		t.Fatalf("Expected created file to exist, got %v", err)
+	}
+	if string(content) != "bar" {
+		t.Errorf("Wrote wrong content: %q", content)
+	}
+}
+
+func TestUploadAppearsOnlyOnceClosed(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newDirFS(t, dir, FollowWithinRoot).Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "bar")
+
+	if _, err := os.Stat(filepath.Join(dir, "foo")); err == nil {
+		t.Errorf("Expected the file not to appear before the upload is closed")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Expected the upload to be closed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 || entries[0].Name() != "foo" {
+		t.Errorf("Expected only the uploaded file to be left, got %v", entries)
+	}
+}
+
+func TestDiscardedUploadLeavesNothingBehind(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newDirFS(t, dir, FollowWithinRoot).Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "partial")
+
+	w.(*Upload).Discard()
+	w.Close()
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing to be left of a discarded upload, got %v", entries)
+	}
+}
+
+func TestUploadInProgressCannotBeOpened(t *testing.T) {
+	dir := t.TempDir()
+	d := newDirFS(t, dir, FollowWithinRoot)
+	w, err := d.Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	io.WriteString(w, "partial")
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatalf("Expected the upload in progress to be written somewhere, got %v", entries)
+	}
+	tempName := entries[0].Name()
+
+	if _, err := d.Open(tempName); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected opening upload %v in progress to fail with ErrNotExist, got %v", tempName, err)
+	}
+	if _, err := d.Create(tempName); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("Expected creating a file named like an upload to fail with ErrPermission, got %v", err)
+	}
+
+	// names that merely resemble uploads are ordinary files
+	for _, name := range []string{".foo", "foo.upload-1", ".upload-1", ".foo.upload-", ".foo.upload-x.y"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f, err := d.Open(name); err != nil {
+			t.Errorf("Expected %v to open, got %v", name, err)
+		} else {
+			f.Close()
+		}
+	}
+}
+
+func TestUploadNeverOverwritesFileCreatedMeanwhile(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newDirFS(t, dir, FollowWithinRoot).Create("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "upload")
+
+	if err := os.WriteFile(filepath.Join(dir, "foo"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected closing the upload to fail with ErrExist, got %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "foo")); string(content) != "original" {
+		t.Errorf("Expected the existing file to be kept, got %q", content)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected the upload to be removed, got %v", entries)
+	}
+}
+
+func TestCreateNeverOverwrites(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "foo"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := newDirFS(t, dir, FollowWithinRoot).Create("foo")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Expected creating an existing file to fail with ErrExist, got %v", err)
+	}
+
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) || pathErr.Path != "foo" {
+		t.Errorf("Expected error to name the file relative to the root, got %v", err)
+	}
+}
+
+func TestCreateRejectsInvalidNames(t *testing.T) {
+	d := newDirFS(t, t.TempDir(), FollowWithinRoot)
+	for _, name := range []string{"", ".", "../foo", "/foo", "a/../foo"} {
+		if _, err := d.Create(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Expected creating %q to fail with ErrInvalid, got %v", name, err)
+		}
+	}
+}
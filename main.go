@@ -1,55 +1,254 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/mark-rushakoff/go_tftpd/accesscontrol"
+	"github.com/mark-rushakoff/go_tftpd/dirfs"
+	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/safepacketprovider"
+	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
 	"github.com/mark-rushakoff/go_tftpd/serverconfig"
+	"github.com/mark-rushakoff/go_tftpd/sessioncreator"
+	"github.com/mark-rushakoff/go_tftpd/sessionlimiter"
 )
 
+var root string
+var allowWrites bool
+var followSymlinks bool
+var accessRulesPath string
 var host string
 var port int
+var rollover uint
+var replyToInvalid bool
+var shutdownTimeout time.Duration
+var timeout time.Duration
+var minTimeout time.Duration
+var maxTimeout time.Duration
+var tryLimit uint
+var maxBlockSize uint
+var listens listenFlags
+var sessionLimits sessionlimiter.Limits
+
+// listenFlags collects every -listen flag.
+type listenFlags []string
+
+func (l *listenFlags) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listenFlags) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
 func init() {
-	flag.StringVar(&host, "host", "127.0.0.1", "Host to use for server")
+	flag.StringVar(&root, "root", ".", "Directory to serve files from, and to accept new files into with -allow-writes")
+	flag.BoolVar(&allowWrites, "allow-writes", false, "Accept write requests from any client the access rules allow, creating new files under -root")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", true, "Follow symlinks that stay within -root; when false, requests through any symlink are refused")
+	flag.StringVar(&accessRulesPath, "access-rules", "", "File of access rules, one \"<allow|deny> <read|write|any> <CIDR|any> <pattern>\" per line; the first matching rule decides")
+	flag.StringVar(&host, "host", "127.0.0.1", "Host to use for server; \"::\" listens on every IPv4 and IPv6 address, and link-local addresses need a zone, e.g. \"fe80::1%eth0\"")
 	flag.IntVar(&port, "port", 69, "Port to use for server")
+	flag.BoolVar(&replyToInvalid, "reply-invalid", true, "Answer malformed packets and rejected requests with an error (rate limited per source IP address) instead of dropping them")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 5*time.Second, "How long to let active transfers finish after an interrupt")
+	flag.DurationVar(&timeout, "timeout", time.Second, "How long to wait for the client before retransmitting, unless it asks for another timeout")
+	flag.DurationVar(&minTimeout, "min-timeout", 0, "Shortest timeout to agree to with the timeout option; 0 means no limit")
+	flag.DurationVar(&maxTimeout, "max-timeout", 0, "Longest timeout to agree to with the timeout option; 0 means no limit")
+	flag.UintVar(&tryLimit, "tries", 2, "How many times to send a packet before giving up on the client")
+	flag.UintVar(&rollover, "rollover", 0, "Block number (0 or 1) that follows block 65535 in large transfers")
+	flag.UintVar(&maxBlockSize, "max-blksize", 0, "Largest block size to agree to with the blksize option, e.g. to fit the MTU; 0 means no limit")
+	flag.UintVar(&sessionLimits.Total, "max-sessions", 0, "Most transfers at once across every listener; 0 means no limit")
+	flag.UintVar(&sessionLimits.PerClient, "max-sessions-per-client", 0, "Most transfers at once from one client IP address; 0 means no limit")
+	flag.UintVar(&sessionLimits.PerFile, "max-sessions-per-file", 0, "Most transfers at once of one file; 0 means no limit")
+	flag.DurationVar(&sessionLimits.QueueTimeout, "queue-timeout", 0, "How long a request over any -max-sessions cap waits for a transfer to end before being refused")
+	flag.UintVar(&sessionLimits.QueueLength, "queue-length", 100, "Most requests waiting at once with -queue-timeout; any more are refused")
+	flag.Var(&listens, "listen", "Listen on \"<host:port>[,root=<dir>][,allow-writes=<true|false>][,access-rules=<file>][,max-blksize=<n>][,rollover=<0|1>]"+
+		"[,timeout=<duration>][,min-timeout=<duration>][,max-timeout=<duration>][,tries=<n>]\" instead of -host and -port; "+
+		"repeat for several listeners, each defaulting to the other flags")
 }
 
 func main() {
 	flag.Parse()
 
-	bindAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
-	if err != nil {
-		panic(err.Error())
+	specs := listens
+	if len(specs) == 0 {
+		specs = listenFlags{net.JoinHostPort(host, strconv.Itoa(port))}
+	}
+
+	listeners := make([]serverconfig.ListenerConfig, 0, len(specs))
+	for _, spec := range specs {
+		listener, err := listenerConfig(spec)
+		if err != nil {
+			log.Fatalf("Invalid listener %q: %v", spec, err)
+		}
+		listeners = append(listeners, listener)
 	}
 
-	udpConn, err := net.ListenUDP("udp", bindAddr)
+	serverConfig := serverconfig.ServerConfig{
+		Listeners:     listeners,
+		SessionLimits: sessionLimits,
+		OnSessionLimited: func(l *sessioncreator.SessionLimited) {
+			log.Printf("Refused %v of %q to %v: %v", l.Operation, l.Filename, l.Addr, l.Reason)
+		},
+		OnAccessDenied: func(d *sessioncreator.AccessDenied) {
+			log.Printf("Denied %v of %q to %v", d.Operation, d.Filename, d.Addr)
+		},
+		OnClientError: func(e *sessioncreator.ClientError) {
+			log.Printf("%v aborted %v of %q with error %v (%v): %q", e.Addr, e.Operation, e.Filename, uint16(e.Error.Code), e.Error.Code, e.Error.Message)
+		},
+		OnInvalidMessage: func(i *safetyfilter.IncomingInvalidMessage) {
+			log.Printf("Rejected request from %v: %v", i.Addr, i.ErrorMessage)
+		},
+		InvalidTransmissionPolicy: safepacketprovider.InvalidTransmissionPolicy{
+			Reply:         replyToInvalid,
+			ReplyLimit:    5,
+			ReplyInterval: time.Second,
+		},
+	}
+
+	server, err := serverconfig.NewServer(&serverConfig)
 	if err != nil {
-		panic(err.Error())
+		log.Fatal(err)
 	}
 
-	log.Printf("Listening on %v\n", udpConn.LocalAddr())
+	for _, addr := range server.Addrs() {
+		log.Printf("Listening on %v\n", addr)
+	}
 
-	// handle ctrl-c
+	// handle ctrl-c by letting active transfers finish, up to a deadline
+	shutdownDone := make(chan bool)
 	go func() {
+		defer close(shutdownDone)
+
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
-		for sig := range c {
-			log.Printf("Received %v, exiting", sig)
-			os.Exit(0)
+		sig := <-c
+		log.Printf("Received %v, waiting up to %v for active transfers", sig, shutdownTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Aborted remaining transfers: %v", err)
 		}
 	}()
 
-	serverConfig := serverconfig.ServerConfig{
-		PacketConn:     udpConn,
-		DefaultTimeout: time.Second,
-		TryLimit:       2,
+	if err := server.Serve(context.Background()); err != serverconfig.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+}
+
+// listenerConfig parses a -listen flag, taking anything it leaves out from the other flags.
+func listenerConfig(spec string) (serverconfig.ListenerConfig, error) {
+	fields := strings.Split(spec, ",")
+	settings := map[string]string{
+		"root":         root,
+		"allow-writes": strconv.FormatBool(allowWrites),
+		"access-rules": accessRulesPath,
+		"max-blksize":  strconv.FormatUint(uint64(maxBlockSize), 10),
+		"rollover":     strconv.FormatUint(uint64(rollover), 10),
+		"timeout":      timeout.String(),
+		"min-timeout":  minTimeout.String(),
+		"max-timeout":  maxTimeout.String(),
+		"tries":        strconv.FormatUint(uint64(tryLimit), 10),
+	}
+	for _, field := range fields[1:] {
+		key, value, found := strings.Cut(field, "=")
+		if _, known := settings[key]; !found || !known {
+			return serverconfig.ListenerConfig{}, fmt.Errorf("unknown setting %q", field)
+		}
+		settings[key] = value
+	}
+
+	listenerAllowWrites, err := strconv.ParseBool(settings["allow-writes"])
+	if err != nil {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("allow-writes must be true or false, got %v", settings["allow-writes"])
+	}
+
+	listenerRollover, err := strconv.ParseUint(settings["rollover"], 10, 16)
+	if err != nil || listenerRollover > 1 {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("rollover must be 0 or 1, got %v", settings["rollover"])
+	}
+
+	listenerMaxBlockSize, err := strconv.ParseUint(settings["max-blksize"], 10, 16)
+	if err != nil || (listenerMaxBlockSize != 0 && listenerMaxBlockSize < uint64(packets.MinBlockSize)) {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("max-blksize must be 0 or between %v and 65535, got %v", packets.MinBlockSize, settings["max-blksize"])
+	}
+
+	listenerTimeout, err := time.ParseDuration(settings["timeout"])
+	if err != nil || listenerTimeout <= 0 {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("timeout must be a positive duration, got %v", settings["timeout"])
+	}
+
+	listenerMinTimeout, err := time.ParseDuration(settings["min-timeout"])
+	if err != nil || listenerMinTimeout < 0 {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("min-timeout must be 0 or a positive duration, got %v", settings["min-timeout"])
+	}
+
+	listenerMaxTimeout, err := time.ParseDuration(settings["max-timeout"])
+	if err != nil || listenerMaxTimeout < 0 || (listenerMaxTimeout != 0 && listenerMaxTimeout < listenerMinTimeout) {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("max-timeout must be 0 or a duration no shorter than min-timeout, got %v", settings["max-timeout"])
+	}
+
+	listenerTryLimit, err := strconv.ParseUint(settings["tries"], 10, 0)
+	if err != nil || listenerTryLimit == 0 {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("tries must be at least 1, got %v", settings["tries"])
+	}
+
+	symlinks := dirfs.FollowWithinRoot
+	if !followSymlinks {
+		symlinks = dirfs.NeverFollow
+	}
+
+	rootFS, err := dirfs.NewDirFS(settings["root"], symlinks)
+	if err != nil {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("root must be a directory: %v", err)
+	}
+
+	accessList, err := loadAccessList(settings["access-rules"])
+	if err != nil {
+		return serverconfig.ListenerConfig{}, fmt.Errorf("could not load access rules: %v", err)
+	}
+
+	return serverconfig.ListenerConfig{
+		Address:        fields[0],
+		Root:           rootFS,
+		AllowWrites:    listenerAllowWrites,
+		AccessList:     accessList,
+		DefaultTimeout: listenerTimeout,
+		MinTimeout:     listenerMinTimeout,
+		MaxTimeout:     listenerMaxTimeout,
+		TryLimit:       uint(listenerTryLimit),
+		MaxBlockSize:   uint16(listenerMaxBlockSize),
+		RolloverTarget: uint16(listenerRollover),
+	}, nil
+}
+
+// Without a rules file every request is allowed.
+func loadAccessList(path string) (*accesscontrol.AccessList, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	rules, err := accesscontrol.ParseRules(file)
+	if err != nil {
+		return nil, err
 	}
 
-	serverConfig.Serve()
+	return &accesscontrol.AccessList{Rules: rules}, nil
 }
@@ -1,5 +1,7 @@
 package packets
 
+import "fmt"
+
 const ErrorOpcode uint16 = 5
 
 type ErrorCode uint16
@@ -9,11 +11,40 @@ const (
 	FileNotFound                 ErrorCode = 1
 	AccessViolation              ErrorCode = 2
 	DiskFullOrAllocationExceeded ErrorCode = 3
-	IllegalTftpOperation         ErrorCode = 5
+	IllegalTftpOperation         ErrorCode = 4
+	UnknownTransferId            ErrorCode = 5
 	FileAlreadyExists            ErrorCode = 6
 	NoSuchUser                   ErrorCode = 7
+
+	// RFC 2347: sent by a client that does not accept the options in an option ack
+	OptionNegotiationRefused ErrorCode = 8
 )
 
+func (c ErrorCode) String() string {
+	switch c {
+	case Undefined:
+		return "Not defined"
+	case FileNotFound:
+		return "File not found"
+	case AccessViolation:
+		return "Access violation"
+	case DiskFullOrAllocationExceeded:
+		return "Disk full or allocation exceeded"
+	case IllegalTftpOperation:
+		return "Illegal TFTP operation"
+	case UnknownTransferId:
+		return "Unknown transfer ID"
+	case FileAlreadyExists:
+		return "File already exists"
+	case NoSuchUser:
+		return "No such user"
+	case OptionNegotiationRefused:
+		return "Option negotiation refused"
+	default:
+		return fmt.Sprintf("Unknown error code %d", uint16(c))
+	}
+}
+
 type Error struct {
 	Code    ErrorCode
 	Message string
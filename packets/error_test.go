@@ -0,0 +1,34 @@
+package packets
+
+import (
+	"testing"
+)
+
+// RFC 1350 codes 0 through 7, and RFC 2347 code 8
+func TestErrorCodeValues(t *testing.T) {
+	cases := []struct {
+		code     ErrorCode
+		value    uint16
+		expected string
+	}{
+		{Undefined, 0, "Not defined"},
+		{FileNotFound, 1, "File not found"},
+		{AccessViolation, 2, "Access violation"},
+		{DiskFullOrAllocationExceeded, 3, "Disk full or allocation exceeded"},
+		{IllegalTftpOperation, 4, "Illegal TFTP operation"},
+		{UnknownTransferId, 5, "Unknown transfer ID"},
+		{FileAlreadyExists, 6, "File already exists"},
+		{NoSuchUser, 7, "No such user"},
+		{OptionNegotiationRefused, 8, "Option negotiation refused"},
+		{ErrorCode(9), 9, "Unknown error code 9"},
+	}
+
+	for _, c := range cases {
+		if uint16(c.code) != c.value {
+			t.Errorf("Expected %v to be %v, got %v", c.expected, c.value, uint16(c.code))
+		}
+		if c.code.String() != c.expected {
+			t.Errorf("Expected code %v to be described as %q, got %q", c.value, c.expected, c.code.String())
+		}
+	}
+}
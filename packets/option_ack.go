@@ -0,0 +1,28 @@
+package packets
+
+const OptionAckOpcode uint16 = 6
+
+// Option names from RFC 2348, RFC 2349, and RFC 7440.
+const (
+	BlockSizeOption    = "blksize"
+	TransferSizeOption = "tsize"
+	TimeoutOption      = "timeout"
+	WindowSizeOption   = "windowsize"
+)
+
+const (
+	DefaultBlockSize uint16 = 512
+	MinBlockSize     uint16 = 8
+	MaxBlockSize     uint16 = 65464
+
+	// in seconds
+	MinTimeout uint8 = 1
+	MaxTimeout uint8 = 255
+
+	MinWindowSize uint16 = 1
+	MaxWindowSize uint16 = 65535
+)
+
+type OptionAck struct {
+	Options map[string]string
+}
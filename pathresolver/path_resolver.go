@@ -0,0 +1,51 @@
+package pathresolver
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+var ErrInvalidFilename = errors.New("Invalid filename")
+var ErrOutsideRoot = errors.New("Filename leaves the served directory")
+
+// Resolve turns a filename from a request into a name relative to the served root, as used by fs.FS.
+//
+// A leading slash is taken to mean the root, as TFTP clients commonly ask for "/dir/file",
+// and backslashes are taken as separators for the benefit of Windows clients.
+// Filenames that name the root itself, contain NUL bytes, begin with a drive letter,
+// or have any ".." element are rejected rather than re-rooted, so that a request is never answered with a different file.
+func Resolve(filename string) (string, error) {
+	if strings.IndexByte(filename, 0) != -1 {
+		return "", ErrInvalidFilename
+	}
+
+	filename = strings.ReplaceAll(filename, `\`, "/")
+
+	if hasDriveLetter(filename) {
+		return "", ErrOutsideRoot
+	}
+
+	for _, element := range strings.Split(filename, "/") {
+		if element == ".." {
+			return "", ErrOutsideRoot
+		}
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+filename), "/")
+	if name == "" || !fs.ValidPath(name) {
+		return "", ErrInvalidFilename
+	}
+
+	return name, nil
+}
+
+func hasDriveLetter(filename string) bool {
+	if len(filename) < 2 || filename[1] != ':' {
+		return false
+	}
+
+	letter := filename[0] | 0x20 // lower case
+	return letter >= 'a' && letter <= 'z'
+}
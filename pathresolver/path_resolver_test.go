@@ -0,0 +1,88 @@
+package pathresolver
+
+import (
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	cases := []struct {
+		filename string
+		expected string
+		err      error
+	}{
+		// ordinary names
+		{"foo", "foo", nil},
+		{"boot/pxelinux.0", "boot/pxelinux.0", nil},
+		{"...", "...", nil},
+		{"..foo", "..foo", nil},
+		{"foo..", "foo..", nil},
+		{"foo/..bar", "foo/..bar", nil},
+		{"%2e%2e/foo", "%2e%2e/foo", nil},
+
+		// absolute names are taken relative to the root
+		{"/foo", "foo", nil},
+		{"//foo", "foo", nil},
+		{"/boot/pxelinux.0", "boot/pxelinux.0", nil},
+		{`\foo`, "foo", nil},
+
+		// redundant elements are cleaned up
+		{"./foo", "foo", nil},
+		{"foo/.", "foo", nil},
+		{"foo/", "foo", nil},
+		{"boot//pxelinux.0", "boot/pxelinux.0", nil},
+		{"boot/./pxelinux.0", "boot/pxelinux.0", nil},
+
+		// backslashes are separators
+		{`pxelinux.cfg\default`, "pxelinux.cfg/default", nil},
+		{`boot\\pxelinux.0`, "boot/pxelinux.0", nil},
+
+		// parent directories are never followed, even when the result would stay within the root
+		{"..", "", ErrOutsideRoot},
+		{"../", "", ErrOutsideRoot},
+		{"../foo", "", ErrOutsideRoot},
+		{"../../etc/shadow", "", ErrOutsideRoot},
+		{"/../etc/shadow", "", ErrOutsideRoot},
+		{"/..", "", ErrOutsideRoot},
+		{"foo/..", "", ErrOutsideRoot},
+		{"foo/../bar", "", ErrOutsideRoot},
+		{"foo/../../bar", "", ErrOutsideRoot},
+		{"./../foo", "", ErrOutsideRoot},
+		{"foo/./../../bar", "", ErrOutsideRoot},
+		{`..\foo`, "", ErrOutsideRoot},
+		{`..\..\windows\win.ini`, "", ErrOutsideRoot},
+		{`foo\..\..\bar`, "", ErrOutsideRoot},
+		{`/..\foo`, "", ErrOutsideRoot},
+		{"..//foo", "", ErrOutsideRoot},
+
+		// drive letters
+		{`C:\boot.ini`, "", ErrOutsideRoot},
+		{"c:/boot.ini", "", ErrOutsideRoot},
+		{"C:boot.ini", "", ErrOutsideRoot},
+		{"z:", "", ErrOutsideRoot},
+
+		// names that are not files
+		{"", "", ErrInvalidFilename},
+		{".", "", ErrInvalidFilename},
+		{"/", "", ErrInvalidFilename},
+		{"//", "", ErrInvalidFilename},
+		{`\`, "", ErrInvalidFilename},
+		{"./", "", ErrInvalidFilename},
+
+		// NUL bytes would truncate the name when it reaches the operating system
+		{"foo\x00", "", ErrInvalidFilename},
+		{"foo\x00.txt", "", ErrInvalidFilename},
+		{"\x00../etc/shadow", "", ErrInvalidFilename},
+		{"../etc/shadow\x00", "", ErrInvalidFilename},
+	}
+
+	for _, c := range cases {
+		name, err := Resolve(c.filename)
+		if err != c.err {
+			t.Errorf("Resolve(%q): expected error %v, got %v", c.filename, c.err, err)
+			continue
+		}
+		if name != c.expected {
+			t.Errorf("Resolve(%q): expected %q, got %q", c.filename, c.expected, name)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package pktinfo
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Destination is where a packet was sent.
+type Destination struct {
+	// The address the packet was sent to; invalid if unknown
+	Addr netip.Addr
+
+	// The interface the packet arrived on; 0 if unknown
+	Ifindex int
+}
+
+// IsBroadcast reports whether the packet was sent to a broadcast or multicast address rather than to this host alone.
+func (d Destination) IsBroadcast() bool {
+	if !d.Addr.IsValid() {
+		return false
+	}
+	if d.Addr.IsMulticast() {
+		return true
+	}
+	if !d.Addr.Is4() {
+		// IPv6 has no broadcast addresses
+		return false
+	}
+	if d.Addr == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return true
+	}
+	return directedBroadcasts.contains(d.Addr)
+}
+
+// Conn is a UDP connection that reports the destination of every packet it reads.
+type Conn struct {
+	*net.UDPConn
+	oob []byte
+}
+
+// NewConn asks the operating system to report packet destinations on conn (IP_PKTINFO and IPV6_RECVPKTINFO).
+// An error is returned if it cannot, e.g. on platforms without support; conn is still usable on its own.
+func NewConn(conn *net.UDPConn) (*Conn, error) {
+	if err := enable(conn); err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		UDPConn: conn,
+		oob:     make([]byte, oobSize),
+	}, nil
+}
+
+// ReadFromWithDestination is ReadFrom that also reports where the packet was sent.
+// Like ReadFrom, it must not be called concurrently.
+func (c *Conn) ReadFromWithDestination(b []byte) (int, net.Addr, Destination, error) {
+	n, oobn, _, addr, err := c.ReadMsgUDP(b, c.oob)
+	if err != nil {
+		return n, nil, Destination{}, err
+	}
+
+	return n, addr, parseDestination(c.oob[:oobn]), nil
+}
+
+// How long the broadcast addresses of local interfaces are remembered before being looked up again
+const broadcastRefreshInterval = time.Second
+
+var directedBroadcasts = &broadcastCache{
+	interfaceAddrs: net.InterfaceAddrs,
+}
+
+// broadcastCache knows the directed broadcast address of every IPv4 subnet a local interface is on.
+type broadcastCache struct {
+	interfaceAddrs func() ([]net.Addr, error)
+
+	mutex     sync.Mutex
+	addrs     map[netip.Addr]bool
+	refreshed time.Time
+}
+
+func (c *broadcastCache) contains(addr netip.Addr) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.addrs == nil || time.Since(c.refreshed) > broadcastRefreshInterval {
+		c.refresh()
+	}
+
+	return c.addrs[addr]
+}
+
+func (c *broadcastCache) refresh() {
+	c.addrs = make(map[netip.Addr]bool)
+	c.refreshed = time.Now()
+
+	interfaceAddrs, err := c.interfaceAddrs()
+	if err != nil {
+		return
+	}
+
+	for _, interfaceAddr := range interfaceAddrs {
+		ipNet, ok := interfaceAddr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipNet.IP.To4()
+		ones, bits := ipNet.Mask.Size()
+		if ip == nil || bits != 32 || ones >= 31 {
+			// point-to-point subnets (RFC 3021) have no broadcast address
+			continue
+		}
+
+		var broadcast [4]byte
+		mask := net.CIDRMask(ones, 32)
+		for i := range broadcast {
+			broadcast[i] = ip[i] | ^mask[i]
+		}
+		c.addrs[netip.AddrFrom4(broadcast)] = true
+	}
+}
@@ -0,0 +1,82 @@
+package pktinfo
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func fakeInterfaceAddrs(cidrs ...string) func() ([]net.Addr, error) {
+	return func() ([]net.Addr, error) {
+		var addrs []net.Addr
+		for _, cidr := range cidrs {
+			ip, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				panic(err)
+			}
+			ipNet.IP = ip
+			addrs = append(addrs, ipNet)
+		}
+		return addrs, nil
+	}
+}
+
+func withInterfaceAddrs(t *testing.T, interfaceAddrs func() ([]net.Addr, error)) {
+	original := directedBroadcasts
+	directedBroadcasts = &broadcastCache{interfaceAddrs: interfaceAddrs}
+	t.Cleanup(func() {
+		directedBroadcasts = original
+	})
+}
+
+func TestIsBroadcast(t *testing.T) {
+	withInterfaceAddrs(t, fakeInterfaceAddrs("10.1.2.3/16", "192.168.0.5/24", "172.16.0.1/31", "127.0.0.1/8", "fd00::1/64"))
+
+	cases := []struct {
+		addr      string
+		broadcast bool
+	}{
+		{"10.1.2.3", false},
+		{"10.1.255.255", true},
+		{"10.1.255.254", false},
+		{"192.168.0.255", true},
+		{"192.168.1.255", false},
+		{"127.255.255.255", true},
+		{"255.255.255.255", true},
+		{"172.16.0.1", false},
+		{"172.16.0.0", false},
+		{"224.0.0.1", true},
+		{"239.255.255.250", true},
+		{"fd00::1", false},
+		{"fd00::ffff:ffff:ffff:ffff", false},
+		{"ff02::1", true},
+		{"::1", false},
+	}
+
+	for _, c := range cases {
+		destination := Destination{Addr: netip.MustParseAddr(c.addr)}
+		if destination.IsBroadcast() != c.broadcast {
+			t.Errorf("Expected IsBroadcast() of %v to be %v", c.addr, c.broadcast)
+		}
+	}
+}
+
+func TestUnknownDestinationIsNotBroadcast(t *testing.T) {
+	if (Destination{}).IsBroadcast() {
+		t.Errorf("Expected an unknown destination not to be treated as broadcast")
+	}
+}
+
+func TestBroadcastLookupFailureOnlyRecognizesLimitedBroadcast(t *testing.T) {
+	withInterfaceAddrs(t, func() ([]net.Addr, error) {
+		return nil, errors.New("no interfaces for you")
+	})
+
+	if (Destination{Addr: netip.MustParseAddr("10.1.255.255")}).IsBroadcast() {
+		t.Errorf("Expected directed broadcasts to be unknown")
+	}
+	if !(Destination{Addr: netip.MustParseAddr("255.255.255.255")}).IsBroadcast() {
+		t.Errorf("Expected the limited broadcast address to be recognized")
+	}
+}
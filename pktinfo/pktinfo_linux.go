@@ -0,0 +1,65 @@
+package pktinfo
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// Room for both kinds of control message, as dual-stack sockets may report either
+var oobSize = syscall.CmsgSpace(syscall.SizeofInet4Pktinfo) + syscall.CmsgSpace(syscall.SizeofInet6Pktinfo)
+
+func enable(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var v4Err, v6Err error
+	err = raw.Control(func(fd uintptr) {
+		v4Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		v6Err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	})
+	if err != nil {
+		return err
+	}
+
+	// IPv4 sockets reject the IPv6 option; either one is enough for the socket's own family
+	if v4Err != nil && v6Err != nil {
+		return v4Err
+	}
+	return nil
+}
+
+func parseDestination(oob []byte) Destination {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return Destination{}
+	}
+
+	var destination Destination
+	for _, m := range messages {
+		switch {
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			// struct in_pktinfo { int ipi_ifindex; struct in_addr ipi_spec_dst; struct in_addr ipi_addr; }
+			return Destination{
+				Addr:    netip.AddrFrom4([4]byte(m.Data[8:12])),
+				Ifindex: int(int32(binary.NativeEndian.Uint32(m.Data[0:4]))),
+			}
+		case m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO && len(m.Data) >= syscall.SizeofInet6Pktinfo:
+			// struct in6_pktinfo { struct in6_addr ipi6_addr; unsigned int ipi6_ifindex; }
+			destination = Destination{
+				Addr:    netip.AddrFrom16([16]byte(m.Data[0:16])).Unmap(),
+				Ifindex: int(binary.NativeEndian.Uint32(m.Data[16:20])),
+			}
+			if destination.Addr.Is6() && destination.Addr.IsLinkLocalUnicast() {
+				if iface, err := net.InterfaceByIndex(destination.Ifindex); err == nil {
+					destination.Addr = destination.Addr.WithZone(iface.Name)
+				}
+			}
+		}
+	}
+
+	return destination
+}
@@ -0,0 +1,98 @@
+package pktinfo
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, address string) *Conn {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Skipf("Cannot listen on %v: %v", address, err)
+	}
+	t.Cleanup(func() {
+		udpConn.Close()
+	})
+
+	conn, err := NewConn(udpConn)
+	if err != nil {
+		t.Fatalf("Expected packet info to be enabled, got %v", err)
+	}
+	return conn
+}
+
+// Sends from a socket allowed to broadcast, and returns the destination the listener saw.
+func sendAndReceive(t *testing.T, conn *Conn, to string) Destination {
+	client, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	raw, err := client.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if _, err := client.WriteTo([]byte("x"), &net.UDPAddr{IP: net.ParseIP(to), Port: port}); err != nil {
+		t.Skipf("Cannot send to %v: %v", to, err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 16)
+	n, addr, destination, err := conn.ReadFromWithDestination(buf)
+	if err != nil {
+		t.Fatalf("Did not receive packet sent to %v: %v", to, err)
+	}
+	if n != 1 || addr == nil {
+		t.Errorf("Received wrong packet: %q from %v", buf[:n], addr)
+	}
+
+	return destination
+}
+
+func TestReportsDestinationOnWildcardSocket(t *testing.T) {
+	conn := listen(t, "0.0.0.0:0")
+
+	for _, to := range []string{"127.0.0.1", "127.0.0.2", "::1"} {
+		destination := sendAndReceive(t, conn, to)
+		if destination.Addr != netip.MustParseAddr(to) {
+			t.Errorf("Expected destination %v, got %v", to, destination.Addr)
+		}
+		if destination.Ifindex == 0 {
+			t.Errorf("Expected the interface of a packet sent to %v", to)
+		}
+		if destination.IsBroadcast() {
+			t.Errorf("Expected %v not to be broadcast", to)
+		}
+	}
+}
+
+func TestReportsDestinationOnIPv4Socket(t *testing.T) {
+	conn := listen(t, "127.0.0.1:0")
+
+	destination := sendAndReceive(t, conn, "127.0.0.1")
+	if destination.Addr != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("Expected destination 127.0.0.1, got %v", destination.Addr)
+	}
+}
+
+func TestRecognizesLoopbackBroadcast(t *testing.T) {
+	conn := listen(t, "0.0.0.0:0")
+
+	destination := sendAndReceive(t, conn, "127.255.255.255")
+	if !destination.IsBroadcast() {
+		t.Errorf("Expected %v to be broadcast", destination.Addr)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package pktinfo
+
+import (
+	"errors"
+	"net"
+)
+
+var oobSize = 0
+
+func enable(conn *net.UDPConn) error {
+	return errors.ErrUnsupported
+}
+
+func parseDestination(oob []byte) Destination {
+	return Destination{}
+}
@@ -0,0 +1,82 @@
+package ratelimiter
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/clientaddr"
+)
+
+// RateLimiter allows at most limit events per interval from each source IP address.
+// Ports are ignored, as whoever forges a source address can pick any port.
+// It is safe for concurrent use.
+type RateLimiter struct {
+	limit    uint
+	interval time.Duration
+	now      func() time.Time
+
+	mutex     sync.Mutex
+	windows   map[clientaddr.Key]*window
+	lastPrune time.Time
+}
+
+type window struct {
+	start time.Time
+	count uint
+}
+
+// A limit of zero allows every event.
+func NewRateLimiter(limit uint, interval time.Duration) *RateLimiter {
+	return manualRateLimiter(limit, interval, time.Now)
+}
+
+func manualRateLimiter(limit uint, interval time.Duration, now func() time.Time) *RateLimiter {
+	return &RateLimiter{
+		limit:    limit,
+		interval: interval,
+		now:      now,
+		windows:  make(map[clientaddr.Key]*window),
+	}
+}
+
+// Allow records an event from addr and reports whether it is within the limit.
+func (l *RateLimiter) Allow(addr net.Addr) bool {
+	if l.limit == 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	key := clientaddr.HostKeyOf(addr)
+	w, found := l.windows[key]
+	if !found || now.Sub(w.start) >= l.interval {
+		w = &window{start: now}
+		l.windows[key] = w
+	}
+
+	if w.count >= l.limit {
+		return false
+	}
+
+	w.count++
+	return true
+}
+
+// Sources are often forged, so windows are forgotten once they are over rather than kept forever.
+func (l *RateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < l.interval {
+		return
+	}
+
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.interval {
+			delete(l.windows, key)
+		}
+	}
+	l.lastPrune = now
+}
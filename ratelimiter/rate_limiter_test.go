@@ -0,0 +1,99 @@
+package ratelimiter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/testhelpers"
+)
+
+var fakeAddr = testhelpers.MakeMockAddr("fake_network", "a")
+
+var otherFakeAddr = testhelpers.MakeMockAddr("fake_network", "b")
+
+type fakeClock struct {
+	current time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.current
+}
+
+func TestAllowsUpToLimitPerInterval(t *testing.T) {
+	clock := &fakeClock{current: time.Unix(1000, 0)}
+	limiter := manualRateLimiter(2, time.Second, clock.now)
+
+	if !limiter.Allow(fakeAddr) || !limiter.Allow(fakeAddr) {
+		t.Fatalf("Expected the first two events to be allowed")
+	}
+
+	if limiter.Allow(fakeAddr) {
+		t.Errorf("Expected the third event in the same interval to be denied")
+	}
+
+	clock.current = clock.current.Add(time.Second)
+	if !limiter.Allow(fakeAddr) {
+		t.Errorf("Expected an event in the next interval to be allowed")
+	}
+}
+
+func TestSourcesAreLimitedIndependently(t *testing.T) {
+	clock := &fakeClock{current: time.Unix(1000, 0)}
+	limiter := manualRateLimiter(1, time.Second, clock.now)
+
+	if !limiter.Allow(fakeAddr) {
+		t.Fatalf("Expected the first event from a to be allowed")
+	}
+
+	if !limiter.Allow(otherFakeAddr) {
+		t.Errorf("Expected the first event from b to be allowed")
+	}
+
+	if limiter.Allow(fakeAddr) {
+		t.Errorf("Expected the second event from a to be denied")
+	}
+}
+
+func TestPortsOfOneSourceShareALimit(t *testing.T) {
+	clock := &fakeClock{current: time.Unix(1000, 0)}
+	limiter := manualRateLimiter(2, time.Second, clock.now)
+
+	for port := 1000; port < 1002; port++ {
+		if !limiter.Allow(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}) {
+			t.Fatalf("Expected the event from port %v to be allowed", port)
+		}
+	}
+
+	if limiter.Allow(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1002}) {
+		t.Errorf("Expected an event from another port of the same source to be denied")
+	}
+	if !limiter.Allow(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1002}) {
+		t.Errorf("Expected an event from another source to be allowed")
+	}
+}
+
+func TestZeroLimitAllowsEverything(t *testing.T) {
+	limiter := NewRateLimiter(0, time.Second)
+
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow(fakeAddr) {
+			t.Fatalf("Expected event %v to be allowed", i)
+		}
+	}
+}
+
+func TestExpiredSourcesAreForgotten(t *testing.T) {
+	clock := &fakeClock{current: time.Unix(1000, 0)}
+	limiter := manualRateLimiter(1, time.Second, clock.now)
+
+	limiter.Allow(fakeAddr)
+	limiter.Allow(otherFakeAddr)
+
+	clock.current = clock.current.Add(2 * time.Second)
+	limiter.Allow(fakeAddr)
+
+	if len(limiter.windows) != 1 {
+		t.Errorf("Expected only the latest source to be remembered, found %v", len(limiter.windows))
+	}
+}
@@ -5,9 +5,13 @@ import (
 )
 
 type MockReadSession struct {
-	BeginHandler     func()
-	HandleAckHandler func(ack *safepackets.SafeAck)
-	ResendHandler    func()
+	BeginHandler       func()
+	HandleAckHandler   func(ack *safepackets.SafeAck)
+	HandleErrorHandler func(e *safepackets.SafeError)
+	AbortHandler       func(e *safepackets.SafeError)
+	ResendHandler      func()
+
+	HandleDuplicateRequestHandler func()
 }
 
 func (s *MockReadSession) Begin() {
@@ -18,6 +22,18 @@ func (s *MockReadSession) HandleAck(ack *safepackets.SafeAck) {
 	s.HandleAckHandler(ack)
 }
 
+func (s *MockReadSession) HandleError(e *safepackets.SafeError) {
+	s.HandleErrorHandler(e)
+}
+
+func (s *MockReadSession) Abort(e *safepackets.SafeError) {
+	s.AbortHandler(e)
+}
+
 func (s *MockReadSession) Resend() {
 	s.ResendHandler()
 }
+
+func (s *MockReadSession) HandleDuplicateRequest() {
+	s.HandleDuplicateRequestHandler()
+}
@@ -7,11 +7,13 @@ import (
 type OutgoingHandler interface {
 	SendData(*safepackets.SafeData)
 	SendError(*safepackets.SafeError)
+	SendOptionAck(*safepackets.SafeOptionAck)
 }
 
 type PluggableHandler struct {
-	SendDataHandler  func(*safepackets.SafeData)
-	SendErrorHandler func(*safepackets.SafeError)
+	SendDataHandler      func(*safepackets.SafeData)
+	SendErrorHandler     func(*safepackets.SafeError)
+	SendOptionAckHandler func(*safepackets.SafeOptionAck)
 }
 
 func (h *PluggableHandler) SendData(data *safepackets.SafeData) {
@@ -21,3 +23,7 @@ func (h *PluggableHandler) SendData(data *safepackets.SafeData) {
 func (h *PluggableHandler) SendError(e *safepackets.SafeError) {
 	h.SendErrorHandler(e)
 }
+
+func (h *PluggableHandler) SendOptionAck(oack *safepackets.SafeOptionAck) {
+	h.SendOptionAckHandler(oack)
+}
@@ -9,23 +9,52 @@ import (
 type Config struct {
 	Reader    io.Reader
 	BlockSize uint16
+
+	// How block numbers wrap after block 65535
+	BlockSequence safepackets.BlockSequence
+
+	// How many blocks may be in flight before an ack is required (RFC 7440).
+	// Zero is treated the same as one, i.e. lock-step.
+	WindowSize uint16
+
+	// When set, the session begins by sending OptionAck and waits for ack 0 before sending any data.
+	OptionAck *safepackets.SafeOptionAck
 }
 
+// Acks from up to this many windows behind the latest one are taken to be delayed or reordered duplicates.
+const duplicateAckWindows = 8
+
 type ReadSession interface {
 	Begin()
 	HandleAck(ack *safepackets.SafeAck)
+	HandleError(e *safepackets.SafeError)
+	Abort(e *safepackets.SafeError)
 	Resend()
+	HandleDuplicateRequest()
 }
 
 type readSession struct {
 	config  *Config
 	handler OutgoingHandler
 
-	currentBlockNumber uint16
-	currentDataPacket  *safepackets.SafeData
+	currentBlockNumber   uint16
+	lastAckedBlockNumber uint16
+
+	// data packets that have been sent but not yet acknowledged, oldest first
+	window []*safepackets.SafeData
+
+	awaitingOptionAckAck bool
+	dataExhausted        bool
+	onFinish             func()
+
+	// Whether the client has acknowledged anything, i.e. whether it received the first packet
+	receivedAck bool
+
+	// Once done, whether finished, aborted by the client or failed, the session ignores the client.
+	done bool
 
-	dataExhausted bool
-	onFinish      func()
+	// the error the client aborted the transfer with, if any
+	clientError *safepackets.SafeError
 }
 
 func NewReadSession(config *Config, handler OutgoingHandler, onFinish func()) *readSession {
@@ -37,57 +66,164 @@ func NewReadSession(config *Config, handler OutgoingHandler, onFinish func()) *r
 }
 
 func (s *readSession) Begin() {
-	s.nextBlock()
-	s.sendData()
+	if s.config.OptionAck != nil {
+		s.awaitingOptionAckAck = true
+		s.handler.SendOptionAck(s.config.OptionAck)
+		return
+	}
+
+	s.fillAndSendWindow()
 }
 
 func (s *readSession) HandleAck(ack *safepackets.SafeAck) {
-	if s.dataExhausted {
-		s.onFinish()
+	if s.done {
+		return
+	}
+
+	if s.awaitingOptionAckAck && ack.BlockNumber == 0 {
+		s.awaitingOptionAckAck = false
+		s.receivedAck = true
+		s.fillAndSendWindow()
 		return
 	}
 
-	if ack.BlockNumber == s.currentBlockNumber {
-		s.nextBlock()
-		s.sendData()
-	} else if ack.BlockNumber == s.currentBlockNumber-1 {
-		s.sendData()
+	// how many blocks at the front of the window this ack covers
+	ackedBlocks := s.config.BlockSequence.Distance(s.lastAckedBlockNumber, ack.BlockNumber)
+	// how far behind the latest ack this one is, should it be a duplicate that arrived out of order
+	behind := s.config.BlockSequence.Distance(ack.BlockNumber, s.lastAckedBlockNumber)
+
+	if ackedBlocks == 0 || behind <= duplicateAckWindows*s.windowSize() {
+		// A duplicate ack means our data or its ack was delayed, not lost; resending here would make every
+		// following block go out twice (RFC 1123 section 4.2.3.1, Sorcerer's Apprentice Syndrome).
+		// Lost packets are left for the timeout controller to resend.
+		return
+	} else if ackedBlocks <= len(s.window) {
+		s.receivedAck = true
+		s.window = s.window[ackedBlocks:]
+		s.lastAckedBlockNumber = ack.BlockNumber
+
+		// the final block is always short, so the window only empties once the client has all the data
+		if len(s.window) == 0 && s.dataExhausted {
+			s.done = true
+			s.onFinish()
+			return
+		}
+
+		// anything left in the window was lost, so it is sent again ahead of the new blocks
+		s.fillAndSendWindow()
 	} else {
+		s.done = true
 		s.handler.SendError(safepackets.NewAncientAckError())
 		s.onFinish()
 	}
 }
 
+// HandleError records why the client aborted the transfer and stops sending data.
+// Tearing down the session is left to the caller.
+func (s *readSession) HandleError(e *safepackets.SafeError) {
+	s.clientError = e
+	s.abort()
+}
+
+// Abort ends the transfer on the server's initiative, e.g. when shutting down, and tells the client why.
+// Tearing down the session is left to the caller.
+func (s *readSession) Abort(e *safepackets.SafeError) {
+	if s.done {
+		return
+	}
+
+	s.abort()
+	s.handler.SendError(e)
+}
+
+func (s *readSession) ClientError() *safepackets.SafeError {
+	return s.clientError
+}
+
 func (s *readSession) Resend() {
-	s.sendData()
+	if s.awaitingOptionAckAck {
+		s.handler.SendOptionAck(s.config.OptionAck)
+		return
+	}
+
+	s.sendWindow()
 }
 
-func (s *readSession) sendData() {
-	s.handler.SendData(s.currentDataPacket)
+// HandleDuplicateRequest answers a retransmission of the request that started the session.
+// Until the client acknowledges anything, its first packet may have been lost, so it is resent;
+// afterwards the request can only be a delayed duplicate and is ignored.
+func (s *readSession) HandleDuplicateRequest() {
+	if s.done || s.receivedAck {
+		return
+	}
+
+	s.Resend()
 }
 
-func (s *readSession) nextBlock() {
-	dataBytes := make([]byte, s.config.BlockSize)
-	if s.config.Reader == nil {
-		panic("Config.Reader is nil")
+func (s *readSession) sendWindow() {
+	for _, data := range s.window {
+		s.handler.SendData(data)
 	}
+}
 
-	bytesRead, err := s.config.Reader.Read(dataBytes)
-	if bytesRead == 0 {
-		s.dataExhausted = true
-		if err == io.EOF {
-			return
-		} else {
-			panic("Not sure what to do with a non-eof io error and 0 bytes read")
+func (s *readSession) windowSize() int {
+	if s.config.WindowSize == 0 {
+		return 1
+	}
+
+	return int(s.config.WindowSize)
+}
+
+// fillAndSendWindow sends the window after topping it up. If the file cannot be read,
+// the client is sent an error instead and the session finishes.
+func (s *readSession) fillAndSendWindow() {
+	if err := s.fillWindow(); err != nil {
+		s.abort()
+		s.handler.SendError(safepackets.NewErrorFromFileError(err, safepackets.NewReadFailedError()))
+		s.onFinish()
+		return
+	}
+
+	s.sendWindow()
+}
+
+func (s *readSession) abort() {
+	s.done = true
+	s.awaitingOptionAckAck = false
+	s.dataExhausted = true
+	s.window = nil
+}
+
+func (s *readSession) fillWindow() error {
+	for len(s.window) < s.windowSize() && !s.dataExhausted {
+		if err := s.nextBlock(); err != nil {
+			return err
 		}
 	}
 
-	if bytesRead < len(dataBytes) {
+	return nil
+}
+
+func (s *readSession) nextBlock() error {
+	dataBytes := make([]byte, s.config.BlockSize)
+	if s.config.Reader == nil {
+		panic("Config.Reader is nil")
+	}
+
+	// Readers may return less than a block without being at the end, so keep reading until the block is full.
+	bytesRead, err := io.ReadFull(s.config.Reader, dataBytes)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// A short block, which is empty when the size is a multiple of the block size, tells the client
+		// that the transfer is over.
 		s.dataExhausted = true
+	} else if err != nil {
+		// whatever was read alongside the error is not worth sending, as the transfer cannot complete
+		return err
 	}
 
 	dataBytes = dataBytes[:bytesRead]
 
-	s.currentBlockNumber++
-	s.currentDataPacket = safepackets.NewSafeData(s.currentBlockNumber, dataBytes)
+	s.currentBlockNumber = s.config.BlockSequence.Next(s.currentBlockNumber)
+	s.window = append(s.window, safepackets.NewSafeData(s.currentBlockNumber, dataBytes))
+	return nil
 }
@@ -2,8 +2,11 @@ package readsession
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/mark-rushakoff/go_tftpd/safepackets"
@@ -76,7 +79,7 @@ func TestCurrentAckAdvancesData(t *testing.T) {
 	}
 }
 
-func TestPreviousAckRepeatsData(t *testing.T) {
+func TestPreviousAckDoesNotRepeatData(t *testing.T) {
 	dataChan := make(chan *safepackets.SafeData, 1)
 	handler := &PluggableHandler{
 		SendDataHandler: func(d *safepackets.SafeData) {
@@ -114,15 +117,61 @@ func TestPreviousAckRepeatsData(t *testing.T) {
 	session.HandleAck(safepackets.NewSafeAck(1))
 	select {
 	case d := <-dataChan:
-		// same case asserted in another test
-		if d.BlockNumber != 2 {
-			t.Errorf("Expected block number 2, got %v", d.BlockNumber)
+		t.Fatalf("Duplicate ack should not have caused data to be sent, saw block %v", d.BlockNumber)
+	default:
+		// ok
+	}
+}
+
+// A client re-acknowledges every duplicate data packet it receives. If the server also answered every duplicate ack,
+// a single delayed ack would cause every following block to be sent twice (RFC 1123 section 4.2.3.1).
+func TestDelayedAckDoesNotDuplicateRemainingBlocks(t *testing.T) {
+	var inFlight []*safepackets.SafeData
+	sent := 0
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			inFlight = append(inFlight, d)
+			sent++
+		},
+	}
+	// 100 full blocks and a short final block
+	config := &Config{
+		Reader:    strings.NewReader(strings.Repeat("x", 201)),
+		BlockSize: 2,
+	}
+	finished := false
+	session := NewReadSession(config, handler, func() {
+		finished = true
+	})
+
+	session.Begin()
+	delayed := false
+	for len(inFlight) > 0 {
+		d := inFlight[0]
+		inFlight = inFlight[1:]
+
+		if d.BlockNumber == 3 && !delayed {
+			// the ack for block 3 takes longer than the server's timeout, so the timer fires first
+			delayed = true
+			session.Resend()
 		}
-		if !bytes.Equal(d.Data.Data, []byte("ob")) {
-			t.Errorf("Expected data packet of 'ob', saw %v", d.Data)
+
+		session.HandleAck(safepackets.NewSafeAck(d.BlockNumber))
+
+		if d.BlockNumber == 5 {
+			// duplicates of earlier acks arrive out of order
+			session.HandleAck(safepackets.NewSafeAck(4))
+			session.HandleAck(safepackets.NewSafeAck(3))
 		}
-	case <-time.After(time.Millisecond):
-		t.Fatalf("Did not see data packet in time")
+	}
+
+	if !finished {
+		t.Fatalf("Expected transfer to finish")
+	}
+
+	// each block once, plus the single resend caused by the timer
+	if sent != 102 {
+		t.Errorf("Expected 102 data packets to be sent, saw %v", sent)
 	}
 }
 
@@ -188,6 +237,85 @@ func TestResendRepeatsData(t *testing.T) {
 	}
 }
 
+func TestDuplicateRequestResendsOnlyUntilFirstAck(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+	}
+	config := &Config{
+		Reader:    strings.NewReader("foobar"),
+		BlockSize: 2,
+	}
+	session := NewReadSession(config, handler, func() {})
+	session.Begin()
+	<-dataChan
+
+	session.HandleDuplicateRequest()
+	select {
+	case d := <-dataChan:
+		if d.BlockNumber != 1 {
+			t.Errorf("Expected block number 1, got %v", d.BlockNumber)
+		}
+	default:
+		t.Fatalf("Duplicate request did not resend the first block")
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(1))
+	<-dataChan
+
+	session.HandleDuplicateRequest()
+	select {
+	case d := <-dataChan:
+		t.Fatalf("Delayed duplicate request caused data %v to be sent", d.BlockNumber)
+	default:
+		// ok
+	}
+}
+
+func TestDuplicateRequestResendsOptionAck(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 1)
+	oackChan := make(chan *safepackets.SafeOptionAck, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+		SendOptionAckHandler: func(oack *safepackets.SafeOptionAck) {
+			oackChan <- oack
+		},
+	}
+	config := &Config{
+		Reader:    strings.NewReader("foobar"),
+		BlockSize: 3,
+		OptionAck: safepackets.NewSafeOptionAck(map[string]string{"blksize": "3"}),
+	}
+	session := NewReadSession(config, handler, func() {})
+	session.Begin()
+	<-oackChan
+
+	session.HandleDuplicateRequest()
+	select {
+	case <-oackChan:
+		// ok
+	default:
+		t.Fatalf("Duplicate request did not resend the option ack")
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(0))
+	<-dataChan
+
+	session.HandleDuplicateRequest()
+	select {
+	case <-oackChan:
+		t.Fatalf("Duplicate request after the option ack was acknowledged resent it")
+	case <-dataChan:
+		t.Fatalf("Duplicate request after the option ack was acknowledged resent data")
+	default:
+		// ok
+	}
+}
+
 func TestFinishesInSinglePacket(t *testing.T) {
 	dataChan := make(chan *safepackets.SafeData, 1)
 	finished := make(chan bool, 1)
@@ -293,6 +421,113 @@ func TestFinishesInMultiplePackets(t *testing.T) {
 	}
 }
 
+func TestSizeMultipleOfBlockSizeEndsWithEmptyBlock(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 1)
+	finished := make(chan bool, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+	}
+	config := &Config{
+		Reader:    strings.NewReader("foobar"),
+		BlockSize: 3,
+	}
+	session := NewReadSession(config, handler, func() {
+		finished <- true
+	})
+
+	session.Begin()
+	expectBlocks(t, dataChan, 1)
+	session.HandleAck(safepackets.NewSafeAck(1))
+	expectBlocks(t, dataChan, 2)
+	session.HandleAck(safepackets.NewSafeAck(2))
+	blocks := expectBlocks(t, dataChan, 3)
+	if len(blocks[0].Data.Data) != 0 {
+		t.Errorf("Expected empty final block, saw %v", blocks[0].Data.Data)
+	}
+
+	select {
+	case <-finished:
+		t.Fatalf("Expected session not to be finished before the empty block was acked")
+	default:
+		// ok
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(2))
+	select {
+	case <-finished:
+		t.Fatalf("Expected a duplicate ack not to finish the session")
+	default:
+		// ok
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(3))
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Fatalf("Expected session to be finished after the empty block was acked")
+	}
+}
+
+func TestEmptyFileSendsSingleEmptyBlock(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 1)
+	finished := make(chan bool, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+	}
+	config := &Config{
+		Reader:    strings.NewReader(""),
+		BlockSize: 512,
+	}
+	session := NewReadSession(config, handler, func() {
+		finished <- true
+	})
+
+	session.Begin()
+	blocks := expectBlocks(t, dataChan, 1)
+	if len(blocks[0].Data.Data) != 0 {
+		t.Errorf("Expected empty block, saw %v", blocks[0].Data.Data)
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(1))
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Fatalf("Expected session to be finished after the empty block was acked")
+	}
+}
+
+func TestShortReadsDoNotEndTransfer(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+	}
+	config := &Config{
+		Reader:    iotest.OneByteReader(strings.NewReader("foobar")),
+		BlockSize: 4,
+	}
+	session := NewReadSession(config, handler, func() {})
+
+	session.Begin()
+	blocks := expectBlocks(t, dataChan, 1)
+	if !bytes.Equal(blocks[0].Data.Data, []byte("foob")) {
+		t.Errorf("Expected a full block of foob, saw %v", blocks[0].Data.Data)
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(1))
+	blocks = expectBlocks(t, dataChan, 2)
+	if !bytes.Equal(blocks[0].Data.Data, []byte("ar")) {
+		t.Errorf("Expected final block of ar, saw %v", blocks[0].Data.Data)
+	}
+}
+
 func TestVeryOldAckCausesError(t *testing.T) {
 	errorChan := make(chan *safepackets.SafeError, 1)
 	finished := make(chan bool, 1)
@@ -304,7 +539,7 @@ func TestVeryOldAckCausesError(t *testing.T) {
 		},
 	}
 	config := &Config{
-		Reader:    strings.NewReader("0102030405"),
+		Reader:    strings.NewReader(strings.Repeat("x", 40)),
 		BlockSize: 2,
 	}
 	session := NewReadSession(config, handler, func() {
@@ -312,9 +547,10 @@ func TestVeryOldAckCausesError(t *testing.T) {
 	})
 	session.Begin()
 
-	session.HandleAck(safepackets.NewSafeAck(1))
-	session.HandleAck(safepackets.NewSafeAck(2))
-	session.HandleAck(safepackets.NewSafeAck(3))
+	// far enough along that ack 1 is no longer a plausible duplicate
+	for blockNumber := uint16(1); blockNumber <= 1+duplicateAckWindows+1; blockNumber++ {
+		session.HandleAck(safepackets.NewSafeAck(blockNumber))
+	}
 
 	select {
 	case <-errorChan:
@@ -340,3 +576,476 @@ func TestVeryOldAckCausesError(t *testing.T) {
 		t.Fatalf("Session should have been marked as finished")
 	}
 }
+
+func TestClientErrorStopsSending(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 10)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+	}
+	config := &Config{
+		Reader:     strings.NewReader("abcdefghijkl"),
+		BlockSize:  2,
+		WindowSize: 2,
+	}
+	session := NewReadSession(config, handler, func() {
+		t.Errorf("Session should leave finishing to its caller after a client error")
+	})
+
+	session.Begin()
+	expectBlocks(t, dataChan, 1, 2)
+
+	clientError := &safepackets.SafeError{Code: 0, Message: "cancelled"}
+	session.HandleError(clientError)
+	if session.ClientError() != clientError {
+		t.Errorf("Expected session to record the client's error, got %v", session.ClientError())
+	}
+
+	session.Resend()
+	session.HandleAck(safepackets.NewSafeAck(1))
+	expectBlocks(t, dataChan)
+}
+
+func TestAbortSendsErrorAndStopsSending(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 10)
+	errorChan := make(chan *safepackets.SafeError, 2)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	config := &Config{
+		Reader:     strings.NewReader("abcdefghijkl"),
+		BlockSize:  2,
+		WindowSize: 2,
+	}
+	session := NewReadSession(config, handler, func() {
+		t.Errorf("Session should leave finishing to its caller after aborting")
+	})
+
+	session.Begin()
+	expectBlocks(t, dataChan, 1, 2)
+
+	shuttingDown := safepackets.NewServerShuttingDownError()
+	session.Abort(shuttingDown)
+	session.Abort(shuttingDown)
+
+	select {
+	case e := <-errorChan:
+		if e != shuttingDown {
+			t.Errorf("Expected abort error to be sent, got %v", e)
+		}
+	default:
+		t.Fatalf("Expected an error to be sent on abort")
+	}
+
+	select {
+	case e := <-errorChan:
+		t.Errorf("Expected only one error to be sent, saw %v", e)
+	default:
+		// ok
+	}
+
+	session.Resend()
+	session.HandleAck(safepackets.NewSafeAck(1))
+	expectBlocks(t, dataChan)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("input/output error")
+}
+
+func TestReadFailureOnFirstBlockCausesError(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 1)
+	errorChan := make(chan *safepackets.SafeError, 1)
+	finished := make(chan bool, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	config := &Config{
+		Reader:    failingReader{},
+		BlockSize: 2,
+	}
+	session := NewReadSession(config, handler, func() {
+		finished <- true
+	})
+	session.Begin()
+
+	select {
+	case e := <-errorChan:
+		if !e.Equals(safepackets.NewReadFailedError()) {
+			t.Errorf("Received incorrect error: %v", e.Message)
+		}
+	default:
+		t.Fatalf("Error not sent when expected")
+	}
+
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Fatalf("Session should have been marked as finished")
+	}
+
+	expectBlocks(t, dataChan)
+}
+
+func TestReadFailurePartwayCausesError(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 10)
+	errorChan := make(chan *safepackets.SafeError, 2)
+	finished := make(chan bool, 2)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	config := &Config{
+		Reader:    io.MultiReader(strings.NewReader("abcd"), failingReader{}),
+		BlockSize: 2,
+	}
+	session := NewReadSession(config, handler, func() {
+		finished <- true
+	})
+
+	session.Begin()
+	expectBlocks(t, dataChan, 1)
+	session.HandleAck(safepackets.NewSafeAck(1))
+	expectBlocks(t, dataChan, 2)
+
+	select {
+	case <-errorChan:
+		t.Fatalf("Error sent too early")
+	default:
+		// ok
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(2))
+	select {
+	case e := <-errorChan:
+		if !e.Equals(safepackets.NewReadFailedError()) {
+			t.Errorf("Received incorrect error: %v", e.Message)
+		}
+	default:
+		t.Fatalf("Error not sent when expected")
+	}
+
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Fatalf("Session should have been marked as finished")
+	}
+
+	// the session is over, so nothing the client sends afterwards gets a response
+	session.HandleAck(safepackets.NewSafeAck(2))
+	session.Resend()
+	expectBlocks(t, dataChan)
+	if len(errorChan) != 0 || len(finished) != 0 {
+		t.Errorf("Expected session to ignore the client after failing")
+	}
+}
+
+func TestOptionAckIsSentBeforeData(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 1)
+	oackChan := make(chan *safepackets.SafeOptionAck, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+		SendOptionAckHandler: func(oack *safepackets.SafeOptionAck) {
+			oackChan <- oack
+		},
+	}
+	oack := safepackets.NewSafeOptionAck(map[string]string{"blksize": "3"})
+	config := &Config{
+		Reader:    strings.NewReader("foobar"),
+		BlockSize: 3,
+		OptionAck: oack,
+	}
+	session := NewReadSession(config, handler, func() {})
+	session.Begin()
+
+	select {
+	case o := <-oackChan:
+		if o != oack {
+			t.Errorf("Session sent wrong option ack: %v", o)
+		}
+	default:
+		t.Fatalf("Did not see option ack packet in time")
+	}
+
+	select {
+	case d := <-dataChan:
+		t.Fatalf("Session sent data %v before option ack was acknowledged", d)
+	default:
+		// ok
+	}
+
+	session.Resend()
+	select {
+	case <-oackChan:
+		// ok
+	default:
+		t.Fatalf("Resend did not repeat option ack")
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(0))
+	select {
+	case d := <-dataChan:
+		if d.BlockNumber != 1 {
+			t.Errorf("Expected block number 1, got %v", d.BlockNumber)
+		}
+		if !bytes.Equal(d.Data.Data, []byte("foo")) {
+			t.Errorf("Expected data packet of 'foo', saw %v", d.Data)
+		}
+	default:
+		t.Fatalf("Did not see data packet in time")
+	}
+}
+
+func TestWindowSendsSeveralBlocksPerAck(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 10)
+	finished := make(chan bool, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+	}
+	config := &Config{
+		Reader:     strings.NewReader("abcdefghi"),
+		BlockSize:  2,
+		WindowSize: 3,
+	}
+	session := NewReadSession(config, handler, func() {
+		finished <- true
+	})
+
+	session.Begin()
+	expectBlocks(t, dataChan, 1, 2, 3)
+
+	session.HandleAck(safepackets.NewSafeAck(3))
+	expectBlocks(t, dataChan, 4, 5)
+
+	select {
+	case <-finished:
+		t.Errorf("Expected session not to be finished before last ack arrived")
+	default:
+		// ok
+	}
+
+	session.HandleAck(safepackets.NewSafeAck(5))
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Errorf("Expected session to be finished after last ack arrived")
+	}
+}
+
+func TestWindowRewindsToAckedBlock(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 10)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+	}
+	config := &Config{
+		Reader:     strings.NewReader("abcdefghijkl"),
+		BlockSize:  2,
+		WindowSize: 3,
+	}
+	session := NewReadSession(config, handler, func() {})
+
+	session.Begin()
+	expectBlocks(t, dataChan, 1, 2, 3)
+
+	// block 2 was lost, so the client acks the last block it saw in order
+	session.HandleAck(safepackets.NewSafeAck(1))
+	expectBlocks(t, dataChan, 2, 3, 4)
+
+	session.Resend()
+	expectBlocks(t, dataChan, 2, 3, 4)
+
+	session.HandleAck(safepackets.NewSafeAck(4))
+	blocks := expectBlocks(t, dataChan, 5, 6, 7)
+	if !bytes.Equal(blocks[1].Data.Data, []byte("kl")) {
+		t.Errorf("Expected kl, saw %v", blocks[1].Data.Data)
+	}
+	if len(blocks[2].Data.Data) != 0 {
+		t.Errorf("Expected empty final block, saw %v", blocks[2].Data.Data)
+	}
+}
+
+func TestWindowWaitsForOptionAckAck(t *testing.T) {
+	dataChan := make(chan *safepackets.SafeData, 10)
+	oackChan := make(chan *safepackets.SafeOptionAck, 1)
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			dataChan <- d
+		},
+		SendOptionAckHandler: func(oack *safepackets.SafeOptionAck) {
+			oackChan <- oack
+		},
+	}
+	config := &Config{
+		Reader:     strings.NewReader("abcdefghijkl"),
+		BlockSize:  2,
+		WindowSize: 2,
+		OptionAck:  safepackets.NewSafeOptionAck(map[string]string{"windowsize": "2"}),
+	}
+	session := NewReadSession(config, handler, func() {})
+
+	session.Begin()
+	select {
+	case <-oackChan:
+		// ok
+	default:
+		t.Fatalf("Did not see option ack packet in time")
+	}
+	expectBlocks(t, dataChan)
+
+	session.HandleAck(safepackets.NewSafeAck(0))
+	expectBlocks(t, dataChan, 1, 2)
+}
+
+func TestLargeTransfersRollOverBlockNumbers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large transfer in short mode")
+	}
+
+	type testCase struct {
+		rolloverTarget uint16
+		windowSize     uint16
+	}
+
+	// several times the 65535 blocks of 512 bytes that fit before the first rollover
+	const size = 200*1024*1024 + 100
+
+	testCases := []testCase{
+		{0, 1},
+		{1, 1},
+		{0, 8},
+		{1, 8},
+	}
+
+	for _, testCase := range testCases {
+		simulateLargeRead(t, size, testCase.rolloverTarget, testCase.windowSize)
+	}
+}
+
+// simulateLargeRead plays the client side of a lossless connection, acking each window once it has been sent.
+func simulateLargeRead(t *testing.T, size int64, rolloverTarget uint16, windowSize uint16) {
+	var sent []*safepackets.SafeData
+	handler := &PluggableHandler{
+		SendDataHandler: func(d *safepackets.SafeData) {
+			sent = append(sent, d)
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			t.Fatalf("Unexpected error with rollover to %v and window size %v: %v", rolloverTarget, windowSize, e.Message)
+		},
+	}
+	config := &Config{
+		Reader:        io.LimitReader(&patternReader{}, size),
+		BlockSize:     512,
+		WindowSize:    windowSize,
+		BlockSequence: safepackets.BlockSequence{RolloverTarget: rolloverTarget},
+	}
+	finished := false
+	session := NewReadSession(config, handler, func() {
+		finished = true
+	})
+
+	expected := &patternReader{}
+	expectedBlock := uint16(1)
+	var received int64
+	rollovers := 0
+	session.Begin()
+
+	for !finished {
+		if len(sent) == 0 {
+			t.Fatalf("Session stalled after %v bytes with rollover to %v and window size %v", received, rolloverTarget, windowSize)
+		}
+
+		window := sent
+		sent = nil
+		for _, d := range window {
+			if d.BlockNumber != expectedBlock {
+				t.Fatalf("Expected block number %v, got %v after %v bytes", expectedBlock, d.BlockNumber, received)
+			}
+
+			expectedData := make([]byte, len(d.Data.Data))
+			expected.Read(expectedData)
+			if !bytes.Equal(d.Data.Data, expectedData) {
+				t.Fatalf("Block %v after %v bytes had unexpected contents", d.BlockNumber, received)
+			}
+			received += int64(len(d.Data.Data))
+
+			if expectedBlock == 65535 {
+				expectedBlock = rolloverTarget
+				rollovers++
+			} else {
+				expectedBlock++
+			}
+		}
+
+		session.HandleAck(safepackets.NewSafeAck(window[len(window)-1].BlockNumber))
+	}
+
+	if received != size {
+		t.Errorf("Expected to receive %v bytes, got %v", size, received)
+	}
+	if rollovers < 2 {
+		t.Errorf("Expected block numbers to roll over several times, saw %v", rollovers)
+	}
+}
+
+// patternReader endlessly produces the same predictable bytes, so transfers can be checked without holding them in memory.
+type patternReader struct {
+	offset int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte((r.offset + int64(i)) % 251)
+	}
+	r.offset += int64(len(p))
+	return len(p), nil
+}
+
+func expectBlocks(t *testing.T, dataChan chan *safepackets.SafeData, blockNumbers ...uint16) []*safepackets.SafeData {
+	var blocks []*safepackets.SafeData
+	for _, expected := range blockNumbers {
+		select {
+		case d := <-dataChan:
+			if d.BlockNumber != expected {
+				t.Errorf("Expected block number %v, got %v", expected, d.BlockNumber)
+			}
+			blocks = append(blocks, d)
+		default:
+			t.Fatalf("Expected block number %v to be sent", expected)
+		}
+	}
+
+	select {
+	case d := <-dataChan:
+		t.Fatalf("Unexpected block number %v sent", d.BlockNumber)
+	default:
+		// ok
+	}
+
+	return blocks
+}
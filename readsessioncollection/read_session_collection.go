@@ -4,10 +4,13 @@ import (
 	"net"
 	"sync"
 
+	"github.com/mark-rushakoff/go_tftpd/clientaddr"
 	"github.com/mark-rushakoff/go_tftpd/timeoutcontroller"
 )
 
-type sessionKey string
+// Sessions are keyed on the client's normalized address, e.g. so that IPv6 zones and
+// IPv4-mapped addresses from dual-stack sockets find the same session however they are spelled.
+type sessionKey clientaddr.Key
 
 type ReadSessionCollection struct {
 	sessions map[sessionKey]timeoutcontroller.TimeoutController
@@ -33,6 +36,24 @@ func (s *ReadSessionCollection) Remove(addr net.Addr) {
 	s.remove(key(addr))
 }
 
+func (s *ReadSessionCollection) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.sessions)
+}
+
+// All returns every session in the collection at the time of the call.
+func (s *ReadSessionCollection) All() []timeoutcontroller.TimeoutController {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	sessions := make([]timeoutcontroller.TimeoutController, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
 func (s *ReadSessionCollection) add(session timeoutcontroller.TimeoutController, key sessionKey) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -53,5 +74,5 @@ func (s *ReadSessionCollection) remove(key sessionKey) {
 }
 
 func key(addr net.Addr) sessionKey {
-	return sessionKey(addr.String())
+	return sessionKey(clientaddr.KeyOf(addr))
 }
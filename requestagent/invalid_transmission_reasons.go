@@ -20,7 +20,11 @@ func (reason InvalidTransmissionReason) String() string {
 		return "Invalid opcode"
 	case MissingField:
 		return "Missing field"
+	case PacketTooLong:
+		return "Packet too long"
+	case OptionsMalformed:
+		return "Options malformed"
 	default:
-		panic(fmt.Sprintf("No string exists for reason code %d", reason))
+		return fmt.Sprintf("Unknown reason %d", int(reason))
 	}
 }
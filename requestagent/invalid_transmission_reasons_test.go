@@ -0,0 +1,27 @@
+package requestagent
+
+import (
+	"testing"
+)
+
+func TestEveryReasonHasAString(t *testing.T) {
+	expected := map[InvalidTransmissionReason]string{
+		PacketTooShort:   "Packet too short",
+		InvalidOpcode:    "Invalid opcode",
+		MissingField:     "Missing field",
+		PacketTooLong:    "Packet too long",
+		OptionsMalformed: "Options malformed",
+	}
+
+	for reason, str := range expected {
+		if reason.String() != str {
+			t.Errorf("Expected reason %d to be %q, got %q", int(reason), str, reason.String())
+		}
+	}
+}
+
+func TestUnknownReasonDoesNotPanic(t *testing.T) {
+	if InvalidTransmissionReason(99).String() != "Unknown reason 99" {
+		t.Errorf("Unexpected string for unknown reason: %q", InvalidTransmissionReason(99).String())
+	}
+}
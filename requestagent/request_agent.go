@@ -5,14 +5,24 @@ import (
 	"encoding/binary"
 	"fmt"
 	"net"
+	"net/netip"
 
 	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/pktinfo"
 )
 
 // RequestAgent watches a PacketConn and emits potentially unsafe messages on its several exposed channels.
 type RequestAgent struct {
-	Handler RequestHandler
-	conn    net.PacketConn
+	Handler       RequestHandler
+	conn          net.PacketConn
+	buffer        []byte
+	maxPacketSize int
+}
+
+// DestinationConn is a connection that can tell where each packet was sent, such as a pktinfo.Conn.
+type DestinationConn interface {
+	net.PacketConn
+	ReadFromWithDestination(b []byte) (int, net.Addr, pktinfo.Destination, error)
 }
 
 type IncomingAck struct {
@@ -33,34 +43,65 @@ type IncomingData struct {
 type IncomingReadRequest struct {
 	Read *packets.ReadRequest
 	Addr net.Addr
+
+	// The local address the request was sent to, which the session should reply from; invalid if unknown
+	LocalAddr netip.Addr
 }
 
 type IncomingWriteRequest struct {
 	Write *packets.WriteRequest
 	Addr  net.Addr
+
+	// The local address the request was sent to, which the session should reply from; invalid if unknown
+	LocalAddr netip.Addr
 }
 
+// NewRequestAgent reads packets as large as a data packet carrying the largest block size allowed by RFC 2348.
 func NewRequestAgent(conn net.PacketConn, handler RequestHandler) *RequestAgent {
+	return NewRequestAgentForBlockSize(conn, handler, packets.MaxBlockSize)
+}
+
+// NewRequestAgentForBlockSize accepts packets only as large as a data packet carrying blockSize bytes,
+// for a transfer that negotiated it; anything larger is an invalid transmission. The limit is never below
+// the default block size, so that error packets with long messages still fit.
+func NewRequestAgentForBlockSize(conn net.PacketConn, handler RequestHandler, blockSize uint16) *RequestAgent {
+	maxPacketSize := 4 + int(max(blockSize, packets.DefaultBlockSize))
+
 	return &RequestAgent{
 		conn: conn,
+		// one spare byte, as reading silently truncates datagrams that do not fit
+		buffer:        make([]byte, maxPacketSize+1),
+		maxPacketSize: maxPacketSize,
 
 		Handler: handler,
 	}
 }
 
 // Read a single message and emit it on the appropriate channel.
-func (a *RequestAgent) Read() {
-	const maxPacketSize = 516
-	b := make([]byte, maxPacketSize)
-	bytesRead, addr, err := a.conn.ReadFrom(b)
+// An error is returned only if reading from the connection failed, e.g. because it was closed.
+func (a *RequestAgent) Read() error {
+	bytesRead, addr, destination, err := a.readFrom()
 	if err != nil {
-		panic(fmt.Sprintf("Error reading from connection: %v", err.Error()))
+		return err
 	}
-	b = b[:bytesRead]
+
+	if destination.IsBroadcast() {
+		// RFC 1123 section 4.2.3.5: requests directed to a broadcast address SHOULD be silently ignored
+		return nil
+	}
+
+	// copy out of the shared buffer, as handlers may hold on to the packet
+	b := make([]byte, bytesRead)
+	copy(b, a.buffer)
 
 	if bytesRead < 3 {
 		go a.handleInvalidPacket(b, PacketTooShort, addr)
-		return
+		return nil
+	}
+
+	if bytesRead > a.maxPacketSize {
+		a.handleInvalidPacket(b, PacketTooLong, addr)
+		return nil
 	}
 
 	opcodeBuf := bytes.NewBuffer(b[0:2])
@@ -76,14 +117,25 @@ func (a *RequestAgent) Read() {
 	case packets.DataOpcode:
 		a.handleData(b, addr)
 	case packets.ReadOpcode:
-		a.handleRead(b, addr)
+		a.handleRead(b, addr, destination.Addr)
 	case packets.WriteOpcode:
-		a.handleWrite(b, addr)
+		a.handleWrite(b, addr, destination.Addr)
 	case packets.ErrorOpcode:
 		a.handleError(b, addr)
 	default:
 		a.handleInvalidPacket(b, InvalidOpcode, addr)
 	}
+
+	return nil
+}
+
+func (a *RequestAgent) readFrom() (int, net.Addr, pktinfo.Destination, error) {
+	if conn, ok := a.conn.(DestinationConn); ok {
+		return conn.ReadFromWithDestination(a.buffer)
+	}
+
+	bytesRead, addr, err := a.conn.ReadFrom(a.buffer)
+	return bytesRead, addr, pktinfo.Destination{}, err
 }
 
 func (a *RequestAgent) handleAck(b []byte, addr net.Addr) {
@@ -156,7 +208,7 @@ func (a *RequestAgent) handleError(b []byte, addr net.Addr) {
 	a.Handler.HandleError(&IncomingError{errorPacket, addr})
 }
 
-func (a *RequestAgent) handleRead(b []byte, addr net.Addr) {
+func (a *RequestAgent) handleRead(b []byte, addr net.Addr, localAddr netip.Addr) {
 	content, invalidReason, ok := parseReadWriteRequestContent(b)
 	if ok {
 		read := &packets.ReadRequest{
@@ -164,13 +216,13 @@ func (a *RequestAgent) handleRead(b []byte, addr net.Addr) {
 			Mode:     content.readWriteMode,
 			Options:  content.options,
 		}
-		a.Handler.HandleReadRequest(&IncomingReadRequest{read, addr})
+		a.Handler.HandleReadRequest(&IncomingReadRequest{read, addr, localAddr})
 	} else {
 		a.handleInvalidPacket(b, invalidReason, addr)
 	}
 }
 
-func (a *RequestAgent) handleWrite(b []byte, addr net.Addr) {
+func (a *RequestAgent) handleWrite(b []byte, addr net.Addr, localAddr netip.Addr) {
 	content, invalidReason, ok := parseReadWriteRequestContent(b)
 	if ok {
 		write := &packets.WriteRequest{
@@ -178,7 +230,7 @@ func (a *RequestAgent) handleWrite(b []byte, addr net.Addr) {
 			Mode:     content.readWriteMode,
 			Options:  content.options,
 		}
-		a.Handler.HandleWriteRequest(&IncomingWriteRequest{write, addr})
+		a.Handler.HandleWriteRequest(&IncomingWriteRequest{write, addr, localAddr})
 	} else {
 		a.handleInvalidPacket(b, invalidReason, addr)
 	}
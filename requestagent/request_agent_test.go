@@ -3,11 +3,14 @@ package requestagent
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
+	"net/netip"
 	"testing"
 	"time"
 
 	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/pktinfo"
 	"github.com/mark-rushakoff/go_tftpd/testhelpers"
 )
 
@@ -127,6 +130,30 @@ func TestDataPacketCausesData(t *testing.T) {
 	}
 }
 
+func TestLargeBlockDataPacketIsNotTruncated(t *testing.T) {
+	incomingData := make(chan *IncomingData, 1)
+	handler := &PluggableHandler{
+		DataHandler: func(data *IncomingData) {
+			incomingData <- data
+		},
+	}
+	largeBlock := bytes.Repeat([]byte{7}, int(packets.MaxBlockSize))
+	agentWithIncomingPacket(t, handler, []interface{}{
+		uint16(packets.DataOpcode),
+		uint16(1),
+		largeBlock,
+	}).Read()
+
+	select {
+	case incomingDatum := <-incomingData:
+		if !bytes.Equal(incomingDatum.Data.Data, largeBlock) {
+			t.Errorf("Received %v bytes of data, expected %v", len(incomingDatum.Data.Data), len(largeBlock))
+		}
+	case <-time.After(time.Millisecond):
+		t.Errorf("Did not receive Data in time")
+	}
+}
+
 func TestReadRequestPacketCausesReadRequest(t *testing.T) {
 	const blockNum uint16 = 9876
 
@@ -392,6 +419,109 @@ func invalidPacketCausesInvalidTransmission(t *testing.T, testCase invalidPacket
 	}
 }
 
+type destinationPacketConn struct {
+	*testhelpers.MockPacketConn
+	destination pktinfo.Destination
+}
+
+func (c *destinationPacketConn) ReadFromWithDestination(b []byte) (int, net.Addr, pktinfo.Destination, error) {
+	n, addr, err := c.ReadFrom(b)
+	return n, addr, c.destination, err
+}
+
+func agentWithIncomingPacketTo(t *testing.T, handler RequestHandler, destination pktinfo.Destination, data []interface{}) *RequestAgent {
+	conn := &destinationPacketConn{
+		MockPacketConn: &testhelpers.MockPacketConn{
+			ReadFromFunc: buildReaderFunc(t, data),
+		},
+		destination: destination,
+	}
+
+	return NewRequestAgent(conn, handler)
+}
+
+var readRequestPacket = []interface{}{
+	uint16(packets.ReadOpcode),
+	string("foo"),
+	byte(0),
+	string("octet"),
+	byte(0),
+}
+
+func TestRequestRecordsLocalAddress(t *testing.T) {
+	incomingReadRequests := make(chan *IncomingReadRequest, 1)
+	incomingWriteRequests := make(chan *IncomingWriteRequest, 1)
+	handler := &PluggableHandler{
+		ReadRequestHandler: func(read *IncomingReadRequest) {
+			incomingReadRequests <- read
+		},
+		WriteRequestHandler: func(write *IncomingWriteRequest) {
+			incomingWriteRequests <- write
+		},
+	}
+	destination := pktinfo.Destination{Addr: netip.MustParseAddr("10.0.0.2"), Ifindex: 2}
+
+	agentWithIncomingPacketTo(t, handler, destination, readRequestPacket).Read()
+	select {
+	case r := <-incomingReadRequests:
+		if r.LocalAddr != destination.Addr {
+			t.Errorf("Expected read request to record local address %v, got %v", destination.Addr, r.LocalAddr)
+		}
+	default:
+		t.Fatalf("Did not receive Read")
+	}
+
+	writeRequestPacket := append([]interface{}{uint16(packets.WriteOpcode)}, readRequestPacket[1:]...)
+	agentWithIncomingPacketTo(t, handler, destination, writeRequestPacket).Read()
+	select {
+	case w := <-incomingWriteRequests:
+		if w.LocalAddr != destination.Addr {
+			t.Errorf("Expected write request to record local address %v, got %v", destination.Addr, w.LocalAddr)
+		}
+	default:
+		t.Fatalf("Did not receive Write")
+	}
+}
+
+func TestLocalAddressIsUnknownWithoutDestination(t *testing.T) {
+	incomingReadRequests := make(chan *IncomingReadRequest, 1)
+	handler := &PluggableHandler{
+		ReadRequestHandler: func(read *IncomingReadRequest) {
+			incomingReadRequests <- read
+		},
+	}
+
+	agentWithIncomingPacket(t, handler, readRequestPacket).Read()
+	select {
+	case r := <-incomingReadRequests:
+		if r.LocalAddr.IsValid() {
+			t.Errorf("Expected local address to be unknown, got %v", r.LocalAddr)
+		}
+	default:
+		t.Fatalf("Did not receive Read")
+	}
+}
+
+func TestBroadcastPacketsAreIgnored(t *testing.T) {
+	handler := &PluggableHandler{
+		ReadRequestHandler: func(read *IncomingReadRequest) {
+			t.Errorf("Broadcast read request should have been ignored")
+		},
+		InvalidTransmissionHandler: func(i *InvalidTransmission) {
+			t.Errorf("Broadcast packet should have been ignored, not rejected")
+		},
+	}
+
+	for _, addr := range []string{"255.255.255.255", "224.0.0.1", "ff02::1"} {
+		destination := pktinfo.Destination{Addr: netip.MustParseAddr(addr)}
+
+		if err := agentWithIncomingPacketTo(t, handler, destination, readRequestPacket).Read(); err != nil {
+			t.Errorf("Expected ignoring a packet not to be an error, got %v", err)
+		}
+		agentWithIncomingPacketTo(t, handler, destination, []interface{}{uint16(99), uint16(0)}).Read()
+	}
+}
+
 func agentWithIncomingPacket(t *testing.T, handler RequestHandler, data []interface{}) *RequestAgent {
 	conn := &testhelpers.MockPacketConn{
 		ReadFromFunc: buildReaderFunc(t, data),
@@ -429,3 +559,58 @@ func buildReaderFunc(t *testing.T, data []interface{}) func([]byte) (int, net.Ad
 		return n, fakeAddr, nil
 	}
 }
+
+func TestPacketsLargerThanBlockSizeAreTooLong(t *testing.T) {
+	for _, blockSize := range []uint16{packets.DefaultBlockSize, 1428, packets.MaxBlockSize} {
+		for _, size := range []int{int(blockSize), int(blockSize) + 1, int(blockSize) + 188} {
+			data := make(chan *IncomingData, 1)
+			invalidTransmissions := make(chan *InvalidTransmission, 1)
+			handler := &PluggableHandler{
+				DataHandler: func(d *IncomingData) {
+					data <- d
+				},
+				InvalidTransmissionHandler: func(invalid *InvalidTransmission) {
+					invalidTransmissions <- invalid
+				},
+			}
+			packet := append([]byte{0, 3, 0, 1}, make([]byte, size)...)
+			conn := &testhelpers.MockPacketConn{
+				ReadFromFunc: func(b []byte) (int, net.Addr, error) {
+					// like a UDP socket, drop whatever does not fit
+					return copy(b, packet), fakeAddr, nil
+				},
+			}
+
+			NewRequestAgentForBlockSize(conn, handler, blockSize).Read()
+
+			select {
+			case d := <-data:
+				if size > int(blockSize) {
+					t.Errorf("Block of %v bytes with block size %v was passed on as %v bytes of data", size, blockSize, len(d.Data.Data))
+				} else if len(d.Data.Data) != size {
+					t.Errorf("Expected block of %v bytes, got %v", size, len(d.Data.Data))
+				}
+			case invalid := <-invalidTransmissions:
+				if size <= int(blockSize) || invalid.Reason != PacketTooLong {
+					t.Errorf("Block of %v bytes with block size %v was rejected as %v", size, blockSize, invalid.Reason)
+				}
+			default:
+				t.Errorf("Block of %v bytes with block size %v was not handled", size, blockSize)
+			}
+		}
+	}
+}
+
+func TestReadReturnsConnectionError(t *testing.T) {
+	connErr := errors.New("use of closed network connection")
+	conn := &testhelpers.MockPacketConn{
+		ReadFromFunc: func([]byte) (int, net.Addr, error) {
+			return 0, nil, connErr
+		},
+	}
+
+	err := NewRequestAgent(conn, &PluggableHandler{}).Read()
+	if err != connErr {
+		t.Errorf("Expected Read to return %v, got %v", connErr, err)
+	}
+}
@@ -10,6 +10,7 @@ type MockResponseAgent struct {
 	acks   []*safepackets.SafeAck
 	errors []*safepackets.SafeError
 	data   []*safepackets.SafeData
+	oacks  []*safepackets.SafeOptionAck
 
 	totalMessagesSent int
 
@@ -21,6 +22,7 @@ func MakeMockResponseAgent() *MockResponseAgent {
 		acks:   make([]*safepackets.SafeAck, 5),
 		errors: make([]*safepackets.SafeError, 5),
 		data:   make([]*safepackets.SafeData, 5),
+		oacks:  make([]*safepackets.SafeOptionAck, 5),
 	}
 }
 
@@ -71,11 +73,19 @@ func (a *MockResponseAgent) SendData(data *safepackets.SafeData) {
 	a.totalMessagesSent++
 }
 
+func (a *MockResponseAgent) SendOptionAck(oack *safepackets.SafeOptionAck) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.oacks = append(a.oacks, oack)
+	a.totalMessagesSent++
+}
+
 func (a *MockResponseAgent) Reset() {
 	a.lock.Lock()
 	defer a.lock.Unlock()
 	a.acks = a.acks[:0]
 	a.errors = a.errors[:0]
 	a.data = a.data[:0]
+	a.oacks = a.oacks[:0]
 	a.totalMessagesSent = 0
 }
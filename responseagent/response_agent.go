@@ -16,6 +16,7 @@ type ResponderAgent interface {
 	SendAck(ack *safepackets.SafeAck)
 	SendError(e *safepackets.SafeError)
 	SendData(data *safepackets.SafeData)
+	SendOptionAck(oack *safepackets.SafeOptionAck)
 }
 
 func NewResponseAgent(conn net.PacketConn, clientAddr net.Addr) *ResponseAgent {
@@ -36,3 +37,7 @@ func (a *ResponseAgent) SendError(e *safepackets.SafeError) {
 func (a *ResponseAgent) SendData(data *safepackets.SafeData) {
 	a.conn.WriteTo(data.Bytes(), a.clientAddr)
 }
+
+func (a *ResponseAgent) SendOptionAck(oack *safepackets.SafeOptionAck) {
+	a.conn.WriteTo(oack.Bytes(), a.clientAddr)
+}
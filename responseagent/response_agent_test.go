@@ -78,6 +78,27 @@ func TestDataSerializes(t *testing.T) {
 	}
 }
 
+func TestOptionAckSerializes(t *testing.T) {
+	// opcode 6, "blksize", "1024"
+	expectedPacketOut := []byte{0, 6, 98, 108, 107, 115, 105, 122, 101, 0, 49, 48, 50, 52, 0}
+	agent, conn, addr := buildAgentThatWrites(expectedPacketOut)
+	oack := safepackets.NewSafeOptionAck(map[string]string{"blksize": "1024"})
+	agent.SendOptionAck(oack)
+
+	lastPacketOut, lastAddr, ok := conn.LastPacketOut()
+	if !ok {
+		t.Errorf("Expected a packet to be sent but no packets were sent")
+	}
+
+	if addr != lastAddr {
+		t.Errorf("Expected agent to send to addr %v, but sent to %v", addr, lastAddr)
+	}
+
+	if !bytes.Equal(expectedPacketOut, lastPacketOut) {
+		t.Errorf("Expected outgoing packet %v, received %v", expectedPacketOut, lastPacketOut)
+	}
+}
+
 func buildAgentThatWrites(b []byte) (agent *ResponseAgent, conn *testhelpers.MockPacketConn, addr net.Addr) {
 	conn = &testhelpers.MockPacketConn{
 		WriteToFunc: func(b []byte, a net.Addr) (int, error) {
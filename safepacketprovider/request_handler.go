@@ -1,29 +1,82 @@
 package safepacketprovider
 
 import (
+	"net"
+
+	"github.com/mark-rushakoff/go_tftpd/clientaddr"
+	"github.com/mark-rushakoff/go_tftpd/ratelimiter"
 	"github.com/mark-rushakoff/go_tftpd/requestagent"
+	"github.com/mark-rushakoff/go_tftpd/responseagent"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
 	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
 )
 
 type requestHandler struct {
 	safetyFilter *safetyfilter.SafetyFilter
+	conn         net.PacketConn
+
+	// The client that owns the transfer on conn, or nil for the listening connection.
+	// Acks and data are only accepted from this address.
+	clientAddr net.Addr
+
+	invalidTransmissionPolicy InvalidTransmissionPolicy
+
+	// Shared by every connection, so that each source gets a limited number of replies to packets we reject
+	replyLimiter *ratelimiter.RateLimiter
 }
 
 func (h *requestHandler) HandleAck(a *requestagent.IncomingAck) {
+	if !h.isFromClient(a.Addr) {
+		h.rejectUnknownTransferId(a.Addr)
+		return
+	}
 	h.safetyFilter.HandleAck(a)
 }
 func (h *requestHandler) HandleError(e *requestagent.IncomingError) {
-	panic("idk how to handle error")
+	if !h.isFromClient(e.Addr) {
+		// errors are never answered, not even with an unknown transfer ID error
+		return
+	}
+	h.safetyFilter.HandleError(e)
 }
 func (h *requestHandler) HandleData(d *requestagent.IncomingData) {
-	panic("idk how to handle data")
+	if !h.isFromClient(d.Addr) {
+		h.rejectUnknownTransferId(d.Addr)
+		return
+	}
+	h.safetyFilter.HandleData(d)
 }
 func (h *requestHandler) HandleReadRequest(r *requestagent.IncomingReadRequest) {
+	if h.clientAddr != nil {
+		// new requests only belong on the listening connection
+		return
+	}
 	h.safetyFilter.HandleReadRequest(r)
 }
 func (h *requestHandler) HandleWriteRequest(w *requestagent.IncomingWriteRequest) {
-	panic("idk how to handle write")
+	if h.clientAddr != nil {
+		// new requests only belong on the listening connection
+		return
+	}
+	h.safetyFilter.HandleWriteRequest(w)
 }
 func (h *requestHandler) HandleInvalidTransmission(t *requestagent.InvalidTransmission) {
-	panic("idk how to handle invalid tx")
+	if !h.invalidTransmissionPolicy.Reply || !h.replyLimiter.Allow(t.Addr) {
+		return
+	}
+
+	responseagent.NewResponseAgent(h.conn, t.Addr).SendError(safepackets.NewIllegalTftpOperationError(t.Reason.String()))
+}
+
+func (h *requestHandler) isFromClient(addr net.Addr) bool {
+	return h.clientAddr != nil && clientaddr.KeyOf(addr) == clientaddr.KeyOf(h.clientAddr)
+}
+
+// Per RFC 1350, a packet from an unexpected source gets an error without disturbing the transfer.
+func (h *requestHandler) rejectUnknownTransferId(addr net.Addr) {
+	if !h.replyLimiter.Allow(addr) {
+		return
+	}
+
+	responseagent.NewResponseAgent(h.conn, addr).SendError(safepackets.NewUnknownTransferIdError())
 }
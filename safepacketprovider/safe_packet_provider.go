@@ -2,39 +2,88 @@ package safepacketprovider
 
 import (
 	"net"
+	"sync"
+	"time"
 
+	"github.com/mark-rushakoff/go_tftpd/ratelimiter"
 	"github.com/mark-rushakoff/go_tftpd/requestagent"
+	"github.com/mark-rushakoff/go_tftpd/responseagent"
 	"github.com/mark-rushakoff/go_tftpd/safepackets"
 	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
 )
 
+// InvalidTransmissionPolicy decides how packets that cannot be parsed are answered.
+type InvalidTransmissionPolicy struct {
+	// Whether to answer with an Illegal TFTP operation error, or the error a rejected request was rejected with;
+	// otherwise they are dropped silently
+	Reply bool
+
+	// Replies to any one source, including Unknown transfer ID errors, are limited to ReplyLimit per ReplyInterval
+	// so that the server cannot be used to reflect traffic at forged sources. A zero ReplyLimit means unlimited.
+	ReplyLimit    uint
+	ReplyInterval time.Duration
+}
+
 type SafePacketProvider struct {
-	incomingSafeAck         chan *safetyfilter.IncomingSafeAck
-	incomingSafeReadRequest chan *safetyfilter.IncomingSafeReadRequest
-	incomingInvalidMessage  chan *safetyfilter.IncomingInvalidMessage
-	requestAgent            *requestagent.RequestAgent
+	incomingSafeAck          chan *safetyfilter.IncomingSafeAck
+	incomingSafeData         chan *safetyfilter.IncomingSafeData
+	incomingSafeError        chan *safetyfilter.IncomingSafeError
+	incomingSafeReadRequest  chan *safetyfilter.IncomingSafeReadRequest
+	incomingSafeWriteRequest chan *safetyfilter.IncomingSafeWriteRequest
+	incomingInvalidMessage   chan *safetyfilter.IncomingInvalidMessage
+	safetyFilter             *safetyfilter.SafetyFilter
+	requestAgent             *requestagent.RequestAgent
+	conn                     net.PacketConn
+
+	invalidTransmissionPolicy InvalidTransmissionPolicy
+	replyLimiter              *ratelimiter.RateLimiter
+
+	closeOnce sync.Once
+	closed    chan bool
 }
 
-func NewSafePacketProvider(conn net.PacketConn) *SafePacketProvider {
+func NewSafePacketProvider(conn net.PacketConn, invalidTransmissionPolicy InvalidTransmissionPolicy) *SafePacketProvider {
 	ackChan := make(chan *safetyfilter.IncomingSafeAck, 3)
+	dataChan := make(chan *safetyfilter.IncomingSafeData, 3)
+	errorChan := make(chan *safetyfilter.IncomingSafeError, 3)
 	readChan := make(chan *safetyfilter.IncomingSafeReadRequest, 3)
+	writeChan := make(chan *safetyfilter.IncomingSafeWriteRequest, 3)
 	invalidChan := make(chan *safetyfilter.IncomingInvalidMessage, 3)
+	closed := make(chan bool)
 	safeRequestHandler := &safeRequestHandler{
 		safeAck:            ackChan,
+		safeData:           dataChan,
+		safeError:          errorChan,
 		safeReadRequest:    readChan,
+		safeWriteRequest:   writeChan,
 		safeInvalidMessage: invalidChan,
+		closed:             closed,
 	}
 	safetyFilter := safetyfilter.MakeSafetyFilter(safepackets.NewConverter(), safeRequestHandler)
+	replyLimiter := ratelimiter.NewRateLimiter(invalidTransmissionPolicy.ReplyLimit, invalidTransmissionPolicy.ReplyInterval)
 	requestHandler := &requestHandler{
-		safetyFilter: safetyFilter,
+		safetyFilter:              safetyFilter,
+		conn:                      conn,
+		invalidTransmissionPolicy: invalidTransmissionPolicy,
+		replyLimiter:              replyLimiter,
 	}
 	requestAgent := requestagent.NewRequestAgent(conn, requestHandler)
 
 	return &SafePacketProvider{
-		incomingSafeAck:         ackChan,
-		incomingSafeReadRequest: readChan,
-		incomingInvalidMessage:  invalidChan,
-		requestAgent:            requestAgent,
+		incomingSafeAck:          ackChan,
+		incomingSafeData:         dataChan,
+		incomingSafeError:        errorChan,
+		incomingSafeReadRequest:  readChan,
+		incomingSafeWriteRequest: writeChan,
+		incomingInvalidMessage:   invalidChan,
+		safetyFilter:             safetyFilter,
+		requestAgent:             requestAgent,
+		conn:                     conn,
+
+		invalidTransmissionPolicy: invalidTransmissionPolicy,
+		replyLimiter:              replyLimiter,
+
+		closed: closed,
 	}
 }
 
@@ -42,14 +91,69 @@ func (p *SafePacketProvider) IncomingSafeAck() <-chan *safetyfilter.IncomingSafe
 	return p.incomingSafeAck
 }
 
+func (p *SafePacketProvider) IncomingSafeData() <-chan *safetyfilter.IncomingSafeData {
+	return p.incomingSafeData
+}
+
+func (p *SafePacketProvider) IncomingSafeError() <-chan *safetyfilter.IncomingSafeError {
+	return p.incomingSafeError
+}
+
 func (p *SafePacketProvider) IncomingSafeReadRequest() <-chan *safetyfilter.IncomingSafeReadRequest {
 	return p.incomingSafeReadRequest
 }
 
+func (p *SafePacketProvider) IncomingSafeWriteRequest() <-chan *safetyfilter.IncomingSafeWriteRequest {
+	return p.incomingSafeWriteRequest
+}
+
 func (p *SafePacketProvider) IncomingInvalidMessage() <-chan *safetyfilter.IncomingInvalidMessage {
 	return p.incomingInvalidMessage
 }
 
-func (p *SafePacketProvider) Read() {
-	p.requestAgent.Read()
+// Close stops the provider from emitting messages, so that readers are not left blocked once nobody consumes them.
+// It does not close any connections.
+func (p *SafePacketProvider) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+}
+
+// Read a single message from the listening connection.
+func (p *SafePacketProvider) Read() error {
+	return p.requestAgent.Read()
+}
+
+// RejectInvalidMessage answers a message from IncomingInvalidMessage with the error it was rejected with,
+// as InvalidTransmissionPolicy allows.
+func (p *SafePacketProvider) RejectInvalidMessage(i *safetyfilter.IncomingInvalidMessage) {
+	if !p.invalidTransmissionPolicy.Reply || !p.replyLimiter.Allow(i.Addr) {
+		return
+	}
+
+	responseagent.NewResponseAgent(p.conn, i.Addr).SendError(&safepackets.SafeError{
+		Code:    i.ErrorCode,
+		Message: i.ErrorMessage,
+	})
+}
+
+// ServeTransfer reads packets arriving on a session's own connection, whose local port is the server's transfer ID,
+// and emits them on the same channels as the listening connection. Packets from any address but clientAddr are
+// answered with an Unknown transfer ID error. Packets are read into a buffer sized for data packets carrying blockSize bytes.
+// ServeTransfer returns once reading from conn fails, e.g. when it is closed.
+func (p *SafePacketProvider) ServeTransfer(conn net.PacketConn, clientAddr net.Addr, blockSize uint16) {
+	handler := &requestHandler{
+		safetyFilter:              p.safetyFilter,
+		conn:                      conn,
+		clientAddr:                clientAddr,
+		invalidTransmissionPolicy: p.invalidTransmissionPolicy,
+		replyLimiter:              p.replyLimiter,
+	}
+	agent := requestagent.NewRequestAgentForBlockSize(conn, handler, blockSize)
+
+	for {
+		if err := agent.Read(); err != nil {
+			return
+		}
+	}
 }
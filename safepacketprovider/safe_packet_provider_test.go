@@ -1,25 +1,31 @@
 package safepacketprovider
 
 import (
+	"bytes"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
 	"github.com/mark-rushakoff/go_tftpd/testhelpers"
 )
 
 var fakeAddr = testhelpers.MakeMockAddr("fake_network", "a")
 
+var otherFakeAddr = testhelpers.MakeMockAddr("fake_network", "b")
+
 func TestCanProvideSafeAck(t *testing.T) {
 	const blockNum uint16 = 1234
-	packetConn := testhelpers.NewMockPacketConnWithBytes(t, fakeAddr, []interface{}{
+	transferConn, _ := testhelpers.NewMockPacketConnWithBytesThenClose(t, fakeAddr, []interface{}{
 		uint16(packets.AckOpcode),
 		uint16(blockNum),
 	})
 
-	provider := NewSafePacketProvider(packetConn)
+	provider := NewSafePacketProvider(&testhelpers.MockPacketConn{}, InvalidTransmissionPolicy{})
 
-	go provider.Read()
+	go provider.ServeTransfer(transferConn, fakeAddr, packets.DefaultBlockSize)
 
 	select {
 	case incomingAck := <-provider.IncomingSafeAck():
@@ -44,7 +50,7 @@ func TestCanProvideSafeReadRequest(t *testing.T) {
 		byte(0),
 	})
 
-	provider := NewSafePacketProvider(packetConn)
+	provider := NewSafePacketProvider(packetConn, InvalidTransmissionPolicy{})
 
 	go provider.Read()
 
@@ -67,7 +73,7 @@ func TestCanProvideInvalidMessage(t *testing.T) {
 		byte(0),
 	})
 
-	provider := NewSafePacketProvider(packetConn)
+	provider := NewSafePacketProvider(packetConn, InvalidTransmissionPolicy{})
 
 	go provider.Read()
 
@@ -86,3 +92,287 @@ func TestCanProvideInvalidMessage(t *testing.T) {
 		t.Fatalf("Did not see SafeReadRequest in time")
 	}
 }
+
+func TestCanProvideSafeData(t *testing.T) {
+	const blockNum uint16 = 1234
+	transferConn, _ := testhelpers.NewMockPacketConnWithBytesThenClose(t, fakeAddr, []interface{}{
+		uint16(packets.DataOpcode),
+		uint16(blockNum),
+		"foobar",
+	})
+
+	provider := NewSafePacketProvider(&testhelpers.MockPacketConn{}, InvalidTransmissionPolicy{})
+
+	go provider.ServeTransfer(transferConn, fakeAddr, packets.DefaultBlockSize)
+
+	select {
+	case incomingData := <-provider.IncomingSafeData():
+		if incomingData.Data.BlockNumber != blockNum {
+			t.Errorf("Expected data with block number %v, got %v", blockNum, incomingData.Data.BlockNumber)
+		}
+		if incomingData.Addr != fakeAddr {
+			t.Errorf("Expected data to have address %v, got %v", fakeAddr, incomingData.Addr)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not see SafeData in time")
+	}
+}
+
+func TestCanProvideSafeError(t *testing.T) {
+	transferConn, _ := testhelpers.NewMockPacketConnWithBytesThenClose(t, fakeAddr, []interface{}{
+		uint16(packets.ErrorOpcode),
+		uint16(packets.Undefined),
+		"cancelled",
+		byte(0),
+	})
+
+	provider := NewSafePacketProvider(&testhelpers.MockPacketConn{}, InvalidTransmissionPolicy{})
+
+	go provider.ServeTransfer(transferConn, fakeAddr, packets.DefaultBlockSize)
+
+	select {
+	case incomingError := <-provider.IncomingSafeError():
+		if incomingError.Error.Message != "cancelled" {
+			t.Errorf("Expected error with message cancelled, got %v", incomingError.Error.Message)
+		}
+		if incomingError.Addr != fakeAddr {
+			t.Errorf("Expected error to have address %v, got %v", fakeAddr, incomingError.Addr)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not see SafeError in time")
+	}
+}
+
+func TestErrorFromUnexpectedSourceIsIgnored(t *testing.T) {
+	transferConn, written := testhelpers.NewMockPacketConnWithBytesThenClose(t, otherFakeAddr, []interface{}{
+		uint16(packets.ErrorOpcode),
+		uint16(packets.Undefined),
+		"cancelled",
+		byte(0),
+	})
+
+	provider := NewSafePacketProvider(&testhelpers.MockPacketConn{}, InvalidTransmissionPolicy{})
+
+	provider.ServeTransfer(transferConn, fakeAddr, packets.DefaultBlockSize)
+
+	select {
+	case <-provider.IncomingSafeError():
+		t.Fatalf("Error from unexpected source should not have been provided")
+	case b := <-written:
+		t.Fatalf("Errors should never be answered, but saw %v", b)
+	default:
+		// ok
+	}
+}
+
+func TestCanProvideSafeWriteRequest(t *testing.T) {
+	packetConn := testhelpers.NewMockPacketConnWithBytes(t, fakeAddr, []interface{}{
+		uint16(packets.WriteOpcode),
+		"foobar",
+		byte(0),
+		"octet",
+		byte(0),
+	})
+
+	provider := NewSafePacketProvider(packetConn, InvalidTransmissionPolicy{})
+
+	go provider.Read()
+
+	select {
+	case i := <-provider.IncomingSafeWriteRequest():
+		if i.Addr != fakeAddr {
+			t.Errorf("Expected write request to have address %v, got %v", fakeAddr, i.Addr)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not see SafeWriteRequest in time")
+	}
+}
+
+func TestAckFromUnexpectedSourceIsRejected(t *testing.T) {
+	transferConn, written := testhelpers.NewMockPacketConnWithBytesThenClose(t, otherFakeAddr, []interface{}{
+		uint16(packets.AckOpcode),
+		uint16(1),
+	})
+
+	provider := NewSafePacketProvider(&testhelpers.MockPacketConn{}, InvalidTransmissionPolicy{})
+
+	go provider.ServeTransfer(transferConn, fakeAddr, packets.DefaultBlockSize)
+
+	select {
+	case b := <-written:
+		expected := safepackets.NewUnknownTransferIdError().Bytes()
+		if !bytes.Equal(b, expected) {
+			t.Errorf("Expected error packet %v, got %v", expected, b)
+		}
+		if _, addr, _ := transferConn.LastPacketOut(); addr != otherFakeAddr {
+			t.Errorf("Expected error to be sent to %v, got %v", otherFakeAddr, addr)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not see error packet in time")
+	}
+
+	select {
+	case <-provider.IncomingSafeAck():
+		t.Fatalf("Ack from unexpected source should not have been provided")
+	default:
+		// ok
+	}
+}
+
+func TestAckOnListeningConnectionIsRejected(t *testing.T) {
+	packetConn, written := testhelpers.NewMockPacketConnWithBytesThenClose(t, fakeAddr, []interface{}{
+		uint16(packets.AckOpcode),
+		uint16(1),
+	})
+
+	provider := NewSafePacketProvider(packetConn, InvalidTransmissionPolicy{})
+
+	go provider.Read()
+
+	select {
+	case b := <-written:
+		expected := safepackets.NewUnknownTransferIdError().Bytes()
+		if !bytes.Equal(b, expected) {
+			t.Errorf("Expected error packet %v, got %v", expected, b)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not see error packet in time")
+	}
+
+	select {
+	case <-provider.IncomingSafeAck():
+		t.Fatalf("Ack on listening connection should not have been provided")
+	default:
+		// ok
+	}
+}
+
+func TestReadRequestOnTransferConnectionIsIgnored(t *testing.T) {
+	transferConn, _ := testhelpers.NewMockPacketConnWithBytesThenClose(t, fakeAddr, []interface{}{
+		uint16(packets.ReadOpcode),
+		"foobar",
+		byte(0),
+		"octet",
+		byte(0),
+	})
+
+	provider := NewSafePacketProvider(&testhelpers.MockPacketConn{}, InvalidTransmissionPolicy{})
+
+	provider.ServeTransfer(transferConn, fakeAddr, packets.DefaultBlockSize)
+
+	select {
+	case <-provider.IncomingSafeReadRequest():
+		t.Fatalf("Read request on transfer connection should not have been provided")
+	default:
+		// ok
+	}
+}
+
+func TestInvalidTransmissionIsAnsweredWithIllegalOperation(t *testing.T) {
+	packetConn, written := testhelpers.NewMockPacketConnWithBytesThenClose(t, fakeAddr, []interface{}{
+		uint16(99),
+		uint16(0),
+	})
+
+	provider := NewSafePacketProvider(packetConn, InvalidTransmissionPolicy{Reply: true})
+
+	provider.Read()
+
+	select {
+	case b := <-written:
+		expected := safepackets.NewIllegalTftpOperationError("Invalid opcode").Bytes()
+		if !bytes.Equal(b, expected) {
+			t.Errorf("Expected error packet %v, got %v", expected, b)
+		}
+		if _, addr, _ := packetConn.LastPacketOut(); addr != fakeAddr {
+			t.Errorf("Expected error to be sent to %v, got %v", fakeAddr, addr)
+		}
+	default:
+		t.Fatalf("Did not see error packet in time")
+	}
+}
+
+func TestInvalidTransmissionIsDroppedWithoutReplyPolicy(t *testing.T) {
+	packetConn, written := testhelpers.NewMockPacketConnWithBytesThenClose(t, fakeAddr, []interface{}{
+		uint16(99),
+		uint16(0),
+	})
+
+	provider := NewSafePacketProvider(packetConn, InvalidTransmissionPolicy{Reply: false})
+
+	provider.Read()
+
+	select {
+	case b := <-written:
+		t.Fatalf("Expected invalid transmission to be dropped, saw %v", b)
+	default:
+		// ok
+	}
+}
+
+func TestRepliesToInvalidTransmissionsAreRateLimited(t *testing.T) {
+	written := make(chan []byte, 3)
+	packetConn := &testhelpers.MockPacketConn{
+		ReadFromFunc: func(b []byte) (int, net.Addr, error) {
+			return copy(b, []byte{0, 99, 0, 0}), fakeAddr, nil
+		},
+		WriteToFunc: func(b []byte, _ net.Addr) (int, error) {
+			written <- b
+			return len(b), nil
+		},
+	}
+
+	provider := NewSafePacketProvider(packetConn, InvalidTransmissionPolicy{
+		Reply:         true,
+		ReplyLimit:    2,
+		ReplyInterval: time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		provider.Read()
+	}
+
+	if len(written) != 2 {
+		t.Errorf("Expected 2 replies within the limit, saw %v", len(written))
+	}
+}
+
+func TestRejectedMessagesAreAnsweredByPolicy(t *testing.T) {
+	rejected := &safetyfilter.IncomingInvalidMessage{
+		Addr:         fakeAddr,
+		ErrorCode:    packets.Undefined,
+		ErrorMessage: "Invalid mode string",
+	}
+
+	for _, c := range []struct {
+		policy   InvalidTransmissionPolicy
+		expected int
+	}{
+		{InvalidTransmissionPolicy{Reply: false}, 0},
+		{InvalidTransmissionPolicy{Reply: true}, 3},
+		{InvalidTransmissionPolicy{Reply: true, ReplyLimit: 2, ReplyInterval: time.Hour}, 2},
+	} {
+		written := make(chan []byte, 3)
+		packetConn := &testhelpers.MockPacketConn{
+			WriteToFunc: func(b []byte, _ net.Addr) (int, error) {
+				written <- b
+				return len(b), nil
+			},
+		}
+		provider := NewSafePacketProvider(packetConn, c.policy)
+
+		for i := 0; i < 3; i++ {
+			provider.RejectInvalidMessage(rejected)
+		}
+
+		if len(written) != c.expected {
+			t.Errorf("Expected %v replies with policy %+v, saw %v", c.expected, c.policy, len(written))
+		}
+		if c.expected > 0 {
+			expected := (&safepackets.SafeError{Code: packets.Undefined, Message: "Invalid mode string"}).Bytes()
+			if b := <-written; !bytes.Equal(b, expected) {
+				t.Errorf("Expected error packet %v, got %v", expected, b)
+			}
+		}
+	}
+}
@@ -4,20 +4,55 @@ import (
 	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
 )
 
+// Messages are dropped rather than sent once closed is closed, as nobody will receive them.
 type safeRequestHandler struct {
 	safeAck            chan<- *safetyfilter.IncomingSafeAck
+	safeData           chan<- *safetyfilter.IncomingSafeData
+	safeError          chan<- *safetyfilter.IncomingSafeError
 	safeReadRequest    chan<- *safetyfilter.IncomingSafeReadRequest
+	safeWriteRequest   chan<- *safetyfilter.IncomingSafeWriteRequest
 	safeInvalidMessage chan<- *safetyfilter.IncomingInvalidMessage
+	closed             <-chan bool
 }
 
 func (h *safeRequestHandler) HandleSafeAck(a *safetyfilter.IncomingSafeAck) {
-	h.safeAck <- a
+	select {
+	case h.safeAck <- a:
+	case <-h.closed:
+	}
+}
+
+func (h *safeRequestHandler) HandleSafeData(d *safetyfilter.IncomingSafeData) {
+	select {
+	case h.safeData <- d:
+	case <-h.closed:
+	}
+}
+
+func (h *safeRequestHandler) HandleSafeError(e *safetyfilter.IncomingSafeError) {
+	select {
+	case h.safeError <- e:
+	case <-h.closed:
+	}
 }
 
 func (h *safeRequestHandler) HandleSafeReadRequest(r *safetyfilter.IncomingSafeReadRequest) {
-	h.safeReadRequest <- r
+	select {
+	case h.safeReadRequest <- r:
+	case <-h.closed:
+	}
+}
+
+func (h *safeRequestHandler) HandleSafeWriteRequest(w *safetyfilter.IncomingSafeWriteRequest) {
+	select {
+	case h.safeWriteRequest <- w:
+	case <-h.closed:
+	}
 }
 
 func (h *safeRequestHandler) HandleError(i *safetyfilter.IncomingInvalidMessage) {
-	h.safeInvalidMessage <- i
+	select {
+	case h.safeInvalidMessage <- i:
+	case <-h.closed:
+	}
 }
@@ -0,0 +1,28 @@
+package safepackets
+
+const maxBlockNumber uint16 = 65535
+
+// BlockSequence describes how block numbers advance over a transfer.
+// After block 65535 the sequence wraps to RolloverTarget; de-facto implementations use either 0 or 1.
+// The zero value rolls over to 0.
+type BlockSequence struct {
+	RolloverTarget uint16
+}
+
+func (s BlockSequence) Next(blockNumber uint16) uint16 {
+	if blockNumber == maxBlockNumber {
+		return s.RolloverTarget
+	}
+
+	return blockNumber + 1
+}
+
+// Distance returns how many blocks after from that to comes, following the sequence across wraparound.
+// A block number that was already passed is therefore very far away rather than behind.
+func (s BlockSequence) Distance(from uint16, to uint16) int {
+	if to >= from {
+		return int(to - from)
+	}
+
+	return int(maxBlockNumber-from) + 1 + int(to) - int(s.RolloverTarget)
+}
@@ -0,0 +1,56 @@
+package safepackets
+
+import (
+	"testing"
+)
+
+func TestBlockSequenceNext(t *testing.T) {
+	type testCase struct {
+		sequence BlockSequence
+		current  uint16
+		expected uint16
+	}
+
+	testCases := []testCase{
+		{BlockSequence{}, 0, 1},
+		{BlockSequence{}, 1, 2},
+		{BlockSequence{}, 65534, 65535},
+		{BlockSequence{}, 65535, 0},
+		{BlockSequence{RolloverTarget: 1}, 65535, 1},
+		{BlockSequence{RolloverTarget: 1}, 0, 1},
+	}
+
+	for _, testCase := range testCases {
+		next := testCase.sequence.Next(testCase.current)
+		if next != testCase.expected {
+			t.Errorf("Next(%v) with rollover to %v was %v, expected %v", testCase.current, testCase.sequence.RolloverTarget, next, testCase.expected)
+		}
+	}
+}
+
+func TestBlockSequenceDistance(t *testing.T) {
+	type testCase struct {
+		sequence BlockSequence
+		from     uint16
+		to       uint16
+		expected int
+	}
+
+	testCases := []testCase{
+		{BlockSequence{}, 5, 5, 0},
+		{BlockSequence{}, 5, 8, 3},
+		{BlockSequence{}, 65535, 0, 1},
+		{BlockSequence{}, 65534, 2, 4},
+		{BlockSequence{}, 8, 5, 65533},
+		{BlockSequence{RolloverTarget: 1}, 65535, 1, 1},
+		{BlockSequence{RolloverTarget: 1}, 65534, 2, 3},
+		{BlockSequence{RolloverTarget: 1}, 8, 5, 65532},
+	}
+
+	for _, testCase := range testCases {
+		distance := testCase.sequence.Distance(testCase.from, testCase.to)
+		if distance != testCase.expected {
+			t.Errorf("Distance(%v, %v) with rollover to %v was %v, expected %v", testCase.from, testCase.to, testCase.sequence.RolloverTarget, distance, testCase.expected)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package safepackets
 
 import (
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mark-rushakoff/go_tftpd/packets"
 )
 
 type Converter interface {
 	FromAck(ack *packets.Ack) *SafeAck
+	FromData(data *packets.Data) *SafeData
+	FromError(e *packets.Error) *SafeError
 	FromReadRequest(read *packets.ReadRequest) (*SafeReadRequest, *ConversionError)
+	FromWriteRequest(write *packets.WriteRequest) (*SafeWriteRequest, *ConversionError)
 }
 
 type converter struct{}
@@ -43,19 +48,112 @@ func (converter) FromAck(ack *packets.Ack) *SafeAck {
 	}
 }
 
+func (converter) FromData(data *packets.Data) *SafeData {
+	return &SafeData{
+		packets.Data{BlockNumber: data.BlockNumber, Data: data.Data},
+	}
+}
+
+func (converter) FromError(e *packets.Error) *SafeError {
+	return &SafeError{
+		Code:    e.Code,
+		Message: e.Message,
+	}
+}
+
 func (converter) FromReadRequest(read *packets.ReadRequest) (*SafeReadRequest, *ConversionError) {
-	var mode ReadWriteMode
-	switch strings.ToLower(read.Mode) {
-	case "netascii":
-		mode = NetAscii
-	case "octet":
-		mode = Octet
-	default:
-		return nil, &ConversionError{code: packets.Undefined, message: "Invalid mode string"}
+	mode, err := modeFromString(read.Mode)
+	if err != nil {
+		return nil, err
 	}
 
 	return &SafeReadRequest{
 		Filename: read.Filename,
 		Mode:     mode,
+		Options:  optionsFromMap(read.Options),
+	}, nil
+}
+
+func (converter) FromWriteRequest(write *packets.WriteRequest) (*SafeWriteRequest, *ConversionError) {
+	mode, err := modeFromString(write.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SafeWriteRequest{
+		Filename: write.Filename,
+		Mode:     mode,
+		Options:  optionsFromMap(write.Options),
 	}, nil
 }
+
+func modeFromString(modeString string) (ReadWriteMode, *ConversionError) {
+	switch strings.ToLower(modeString) {
+	case "netascii":
+		return NetAscii, nil
+	case "octet":
+		return Octet, nil
+	case "mail":
+		// RFC 1123, section 4.2.2.1: the obsolete mail mode is rejected explicitly
+		return "", &ConversionError{code: packets.Undefined, message: "Mail mode not supported"}
+	default:
+		return "", &ConversionError{code: packets.Undefined, message: "Invalid mode string"}
+	}
+}
+
+// Unrecognized or invalid options are dropped, as permitted by RFC 2347.
+func optionsFromMap(rawOptions map[string]string) RequestOptions {
+	var options RequestOptions
+
+	for name, value := range rawOptions {
+		switch strings.ToLower(name) {
+		case packets.BlockSizeOption:
+			options.BlockSize = blockSizeFromString(value)
+		case packets.TimeoutOption:
+			options.Timeout = timeoutFromString(value)
+		case packets.WindowSizeOption:
+			options.WindowSize = windowSizeFromString(value)
+		case packets.TransferSizeOption:
+			transferSize, err := strconv.ParseUint(value, 10, 64)
+			if err == nil {
+				options.TransferSizeRequested = true
+				options.TransferSize = transferSize
+			}
+		}
+	}
+
+	return options
+}
+
+func blockSizeFromString(value string) uint16 {
+	blockSize, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || blockSize < uint64(packets.MinBlockSize) {
+		return 0
+	}
+
+	// RFC 2348 allows the server to answer with a smaller block size than requested
+	if blockSize > uint64(packets.MaxBlockSize) {
+		return packets.MaxBlockSize
+	}
+
+	return uint16(blockSize)
+}
+
+// Unlike the block size, RFC 2349 does not let the server answer with a different timeout, so out of range values are dropped.
+func timeoutFromString(value string) time.Duration {
+	seconds, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || seconds < uint64(packets.MinTimeout) || seconds > uint64(packets.MaxTimeout) {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func windowSizeFromString(value string) uint16 {
+	windowSize, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || windowSize < uint64(packets.MinWindowSize) || windowSize > uint64(packets.MaxWindowSize) {
+		return 0
+	}
+
+	return uint16(windowSize)
+}
@@ -2,6 +2,7 @@ package safepackets
 
 import (
 	"testing"
+	"time"
 
 	"github.com/mark-rushakoff/go_tftpd/packets"
 )
@@ -69,3 +70,245 @@ func TestSafeReadConversionCanReturnError(t *testing.T) {
 		t.Errorf("Incorrect error code from invalid mode")
 	}
 }
+
+func TestMailModeIsRejected(t *testing.T) {
+	write := &packets.WriteRequest{
+		Filename: "user@example.com",
+		Mode:     "MAIL",
+		Options:  nil,
+	}
+
+	_, err := NewConverter().FromWriteRequest(write)
+
+	if err == nil {
+		t.Fatalf("WriteRequest in mail mode should have caused error in conversion")
+	}
+
+	if err.Error() != "Mail mode not supported" {
+		t.Errorf("Incorrect error message from mail mode: %v", err.Error())
+	}
+}
+
+func TestSafeDataConversion(t *testing.T) {
+	data := &packets.Data{BlockNumber: 16, Data: []byte("foobar")}
+	safeData := NewConverter().FromData(data)
+	if !safeData.Equals(NewSafeData(16, []byte("foobar"))) {
+		t.Fatalf("FromData converted data incorrectly: %v", safeData)
+	}
+}
+
+func TestSafeErrorConversion(t *testing.T) {
+	e := &packets.Error{Code: packets.DiskFullOrAllocationExceeded, Message: "user cancelled"}
+	safeError := NewConverter().FromError(e)
+	if !safeError.Equals(&SafeError{Code: packets.DiskFullOrAllocationExceeded, Message: "user cancelled"}) {
+		t.Fatalf("FromError converted error incorrectly: %v", safeError)
+	}
+}
+
+func TestSafeWriteConversion(t *testing.T) {
+	type testCase struct {
+		actualFilename string
+		actualMode     string
+
+		expectedMode ReadWriteMode
+	}
+
+	testCases := []testCase{
+		{"foo", "netascii", NetAscii},
+		{"foo", "NetAscii", NetAscii},
+		{"foo", "octet", Octet},
+		{"foo", "Octet", Octet},
+	}
+
+	for _, testCase := range testCases {
+		write := &packets.WriteRequest{
+			Filename: testCase.actualFilename,
+			Mode:     testCase.actualMode,
+			Options:  nil,
+		}
+
+		safeWrite, err := NewConverter().FromWriteRequest(write)
+
+		if err != nil {
+			t.Fatalf("WriteRequest should not have caused error in conversion")
+		}
+
+		if safeWrite.Filename != testCase.actualFilename {
+			t.Fatalf("Did not convert filename correctly")
+		}
+
+		if safeWrite.Mode != testCase.expectedMode {
+			t.Fatalf("Did not convert mode correctly")
+		}
+	}
+}
+
+func TestSafeWriteConversionCanReturnError(t *testing.T) {
+	write := &packets.WriteRequest{
+		Filename: "foo",
+		Mode:     "mail",
+		Options:  nil,
+	}
+
+	_, err := NewConverter().FromWriteRequest(write)
+
+	if err == nil {
+		t.Fatalf("WriteRequest should have caused error in conversion")
+	}
+
+	if err.Code() != packets.Undefined {
+		t.Errorf("Incorrect error code from invalid mode")
+	}
+}
+
+func TestBlockSizeOptionConversion(t *testing.T) {
+	type testCase struct {
+		options map[string]string
+
+		expectedBlockSize uint16
+	}
+
+	testCases := []testCase{
+		{nil, 0},
+		{map[string]string{"blksize": "1024"}, 1024},
+		{map[string]string{"BLKSIZE": "1428"}, 1428},
+		{map[string]string{"blksize": "8"}, 8},
+		{map[string]string{"blksize": "7"}, 0},
+		{map[string]string{"blksize": "65464"}, 65464},
+		{map[string]string{"blksize": "65465"}, 65464},
+		{map[string]string{"blksize": "99999999999"}, 65464},
+		{map[string]string{"blksize": "-1"}, 0},
+		{map[string]string{"blksize": "lots"}, 0},
+		{map[string]string{"unknown": "1024"}, 0},
+	}
+
+	for _, testCase := range testCases {
+		read := &packets.ReadRequest{
+			Filename: "foo",
+			Mode:     "octet",
+			Options:  testCase.options,
+		}
+		safeRead, err := NewConverter().FromReadRequest(read)
+		if err != nil {
+			t.Fatalf("ReadRequest should not have caused error in conversion")
+		}
+		if safeRead.Options.BlockSize != testCase.expectedBlockSize {
+			t.Errorf("Options %v converted to block size %v, expected %v", testCase.options, safeRead.Options.BlockSize, testCase.expectedBlockSize)
+		}
+
+		write := &packets.WriteRequest{
+			Filename: "foo",
+			Mode:     "octet",
+			Options:  testCase.options,
+		}
+		safeWrite, err := NewConverter().FromWriteRequest(write)
+		if err != nil {
+			t.Fatalf("WriteRequest should not have caused error in conversion")
+		}
+		if safeWrite.Options.BlockSize != testCase.expectedBlockSize {
+			t.Errorf("Options %v converted to block size %v, expected %v", testCase.options, safeWrite.Options.BlockSize, testCase.expectedBlockSize)
+		}
+	}
+}
+
+func TestTransferSizeOptionConversion(t *testing.T) {
+	type testCase struct {
+		options map[string]string
+
+		expectedRequested bool
+		expectedSize      uint64
+	}
+
+	testCases := []testCase{
+		{nil, false, 0},
+		{map[string]string{"tsize": "0"}, true, 0},
+		{map[string]string{"TSize": "0"}, true, 0},
+		{map[string]string{"tsize": "123456789012"}, true, 123456789012},
+		{map[string]string{"tsize": "-1"}, false, 0},
+		{map[string]string{"tsize": ""}, false, 0},
+	}
+
+	for _, testCase := range testCases {
+		read := &packets.ReadRequest{
+			Filename: "foo",
+			Mode:     "octet",
+			Options:  testCase.options,
+		}
+		safeRead, err := NewConverter().FromReadRequest(read)
+		if err != nil {
+			t.Fatalf("ReadRequest should not have caused error in conversion")
+		}
+		if safeRead.Options.TransferSizeRequested != testCase.expectedRequested {
+			t.Errorf("Options %v converted to tsize requested %v, expected %v", testCase.options, safeRead.Options.TransferSizeRequested, testCase.expectedRequested)
+		}
+		if safeRead.Options.TransferSize != testCase.expectedSize {
+			t.Errorf("Options %v converted to tsize %v, expected %v", testCase.options, safeRead.Options.TransferSize, testCase.expectedSize)
+		}
+	}
+}
+
+func TestTimeoutOptionConversion(t *testing.T) {
+	type testCase struct {
+		options map[string]string
+
+		expectedTimeout time.Duration
+	}
+
+	testCases := []testCase{
+		{nil, 0},
+		{map[string]string{"timeout": "1"}, time.Second},
+		{map[string]string{"Timeout": "30"}, 30 * time.Second},
+		{map[string]string{"timeout": "255"}, 255 * time.Second},
+		{map[string]string{"timeout": "0"}, 0},
+		{map[string]string{"timeout": "256"}, 0},
+		{map[string]string{"timeout": "1.5"}, 0},
+	}
+
+	for _, testCase := range testCases {
+		read := &packets.ReadRequest{
+			Filename: "foo",
+			Mode:     "octet",
+			Options:  testCase.options,
+		}
+		safeRead, err := NewConverter().FromReadRequest(read)
+		if err != nil {
+			t.Fatalf("ReadRequest should not have caused error in conversion")
+		}
+		if safeRead.Options.Timeout != testCase.expectedTimeout {
+			t.Errorf("Options %v converted to timeout %v, expected %v", testCase.options, safeRead.Options.Timeout, testCase.expectedTimeout)
+		}
+	}
+}
+
+func TestWindowSizeOptionConversion(t *testing.T) {
+	type testCase struct {
+		options map[string]string
+
+		expectedWindowSize uint16
+	}
+
+	testCases := []testCase{
+		{nil, 0},
+		{map[string]string{"windowsize": "1"}, 1},
+		{map[string]string{"WindowSize": "16"}, 16},
+		{map[string]string{"windowsize": "65535"}, 65535},
+		{map[string]string{"windowsize": "0"}, 0},
+		{map[string]string{"windowsize": "65536"}, 0},
+		{map[string]string{"windowsize": "many"}, 0},
+	}
+
+	for _, testCase := range testCases {
+		read := &packets.ReadRequest{
+			Filename: "foo",
+			Mode:     "octet",
+			Options:  testCase.options,
+		}
+		safeRead, err := NewConverter().FromReadRequest(read)
+		if err != nil {
+			t.Fatalf("ReadRequest should not have caused error in conversion")
+		}
+		if safeRead.Options.WindowSize != testCase.expectedWindowSize {
+			t.Errorf("Options %v converted to window size %v, expected %v", testCase.options, safeRead.Options.WindowSize, testCase.expectedWindowSize)
+		}
+	}
+}
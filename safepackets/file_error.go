@@ -0,0 +1,25 @@
+package safepackets
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// NewErrorFromFileError chooses the error to send for err, a failure to open, read, or write a file.
+// The message never includes err's own, which may reveal paths or other details of the server;
+// fallback is sent for errors without a more specific code.
+func NewErrorFromFileError(err error, fallback *SafeError) *SafeError {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return NewFileNotFoundError()
+	case errors.Is(err, fs.ErrExist):
+		return NewFileAlreadyExistsError()
+	case errors.Is(err, fs.ErrPermission):
+		return NewAccessViolationError("Permission denied")
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EFBIG):
+		return NewDiskFullError()
+	default:
+		return fallback
+	}
+}
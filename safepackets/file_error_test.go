@@ -0,0 +1,74 @@
+package safepackets
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/mark-rushakoff/go_tftpd/packets"
+)
+
+func TestErrorFromFileError(t *testing.T) {
+	pathError := func(err error) error {
+		return &fs.PathError{Op: "open", Path: "/srv/tftp/secret/boot.img", Err: err}
+	}
+	fallback := NewUndefinedError("fallback")
+
+	cases := []struct {
+		err      error
+		expected *SafeError
+	}{
+		{pathError(syscall.ENOENT), NewFileNotFoundError()},
+		{fs.ErrNotExist, NewFileNotFoundError()},
+		{pathError(syscall.EEXIST), NewFileAlreadyExistsError()},
+		{pathError(syscall.EACCES), NewAccessViolationError("Permission denied")},
+		{pathError(syscall.EPERM), NewAccessViolationError("Permission denied")},
+		{pathError(syscall.ENOSPC), NewDiskFullError()},
+		{pathError(syscall.EDQUOT), NewDiskFullError()},
+		{pathError(syscall.EFBIG), NewDiskFullError()},
+		{fmt.Errorf("wrapped: %w", pathError(syscall.ENOSPC)), NewDiskFullError()},
+		{pathError(syscall.EIO), fallback},
+		{errors.New("/srv/tftp/secret/boot.img is haunted"), fallback},
+	}
+
+	for _, c := range cases {
+		e := NewErrorFromFileError(c.err, fallback)
+		if !e.Equals(c.expected) {
+			t.Errorf("For %v: expected %v %q, got %v %q", c.err, c.expected.Code, c.expected.Message, e.Code, e.Message)
+		}
+		if strings.Contains(e.Message, "/srv") {
+			t.Errorf("For %v: message reveals the path: %q", c.err, e.Message)
+		}
+	}
+}
+
+func TestEveryErrorCodeHasAConstructor(t *testing.T) {
+	constructed := map[packets.ErrorCode]*SafeError{
+		packets.Undefined:                    NewUndefinedError("something went wrong"),
+		packets.FileNotFound:                 NewFileNotFoundError(),
+		packets.AccessViolation:              NewAccessViolationError("Access denied"),
+		packets.DiskFullOrAllocationExceeded: NewDiskFullError(),
+		packets.IllegalTftpOperation:         NewIllegalTftpOperationError("Invalid opcode"),
+		packets.UnknownTransferId:            NewUnknownTransferIdError(),
+		packets.FileAlreadyExists:            NewFileAlreadyExistsError(),
+		packets.NoSuchUser:                   NewNoSuchUserError(),
+		packets.OptionNegotiationRefused:     NewOptionNegotiationRefusedError(),
+	}
+
+	for code := packets.Undefined; code <= packets.OptionNegotiationRefused; code++ {
+		e, ok := constructed[code]
+		if !ok {
+			t.Errorf("No constructor checked for code %v", code)
+			continue
+		}
+		if e.Code != code {
+			t.Errorf("Constructor for %v built code %v", code, uint16(e.Code))
+		}
+		if e.Message == "" {
+			t.Errorf("Constructor for %v built an empty message", code)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package safepackets
+
+import (
+	"io"
+)
+
+const (
+	carriageReturn byte = '\r'
+	lineFeed       byte = '\n'
+	nul            byte = 0
+)
+
+type netAsciiReader struct {
+	source io.Reader
+
+	// translated bytes that did not fit in the caller's buffer yet
+	pending []byte
+	err     error
+}
+
+// NewNetAsciiReader translates source into netascii as defined by RFC 764:
+// LF becomes CR LF and a bare CR becomes CR NUL.
+// Read only returns fewer bytes than requested once source is exhausted,
+// so a read session can keep treating a short block as the final block.
+func NewNetAsciiReader(source io.Reader) io.Reader {
+	return &netAsciiReader{source: source}
+}
+
+func (r *netAsciiReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.pending) > 0 {
+			copied := copy(p[n:], r.pending)
+			r.pending = r.pending[copied:]
+			n += copied
+			continue
+		}
+
+		if r.err != nil {
+			break
+		}
+
+		raw := make([]byte, len(p)-n)
+		bytesRead, err := r.source.Read(raw)
+		r.err = err
+		r.pending = encodeNetAscii(raw[:bytesRead])
+	}
+
+	if n == 0 && r.err != nil {
+		return 0, r.err
+	}
+
+	return n, nil
+}
+
+func encodeNetAscii(raw []byte) []byte {
+	encoded := make([]byte, 0, len(raw))
+	for _, b := range raw {
+		switch b {
+		case lineFeed:
+			encoded = append(encoded, carriageReturn, lineFeed)
+		case carriageReturn:
+			encoded = append(encoded, carriageReturn, nul)
+		default:
+			encoded = append(encoded, b)
+		}
+	}
+	return encoded
+}
+
+type netAsciiWriter struct {
+	destination io.Writer
+
+	// a CR that ended the previous write, whose meaning depends on the next byte
+	pendingCarriageReturn bool
+}
+
+// NewNetAsciiWriter reverses the translation of NewNetAsciiReader for incoming data:
+// CR LF becomes LF and CR NUL becomes CR, even when the pair is split across writes.
+// Close flushes a trailing CR and closes destination if it is an io.Closer.
+func NewNetAsciiWriter(destination io.Writer) io.WriteCloser {
+	return &netAsciiWriter{destination: destination}
+}
+
+func (w *netAsciiWriter) Write(p []byte) (int, error) {
+	decoded := make([]byte, 0, len(p))
+	for _, b := range p {
+		if w.pendingCarriageReturn {
+			w.pendingCarriageReturn = false
+			switch b {
+			case lineFeed:
+				decoded = append(decoded, lineFeed)
+				continue
+			case nul:
+				decoded = append(decoded, carriageReturn)
+				continue
+			default:
+				// not valid netascii, so keep the CR as it was sent
+				decoded = append(decoded, carriageReturn)
+			}
+		}
+
+		if b == carriageReturn {
+			w.pendingCarriageReturn = true
+		} else {
+			decoded = append(decoded, b)
+		}
+	}
+
+	if _, err := w.destination.Write(decoded); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *netAsciiWriter) Close() error {
+	if w.pendingCarriageReturn {
+		w.pendingCarriageReturn = false
+		if _, err := w.destination.Write([]byte{carriageReturn}); err != nil {
+			return err
+		}
+	}
+
+	if closer, ok := w.destination.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package safepackets
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+type netAsciiTestCase struct {
+	native   string
+	netAscii string
+}
+
+var netAsciiTestCases = []netAsciiTestCase{
+	{"", ""},
+	{"foobar", "foobar"},
+	{"foo\nbar\n", "foo\r\nbar\r\n"},
+	{"foo\rbar", "foo\r\x00bar"},
+	{"\n\n\r\r", "\r\n\r\n\r\x00\r\x00"},
+	{"foo\r\nbar", "foo\r\x00\r\nbar"},
+}
+
+func TestNetAsciiReaderTranslates(t *testing.T) {
+	for _, testCase := range netAsciiTestCases {
+		encoded, err := ioutil.ReadAll(NewNetAsciiReader(strings.NewReader(testCase.native)))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		if string(encoded) != testCase.netAscii {
+			t.Errorf("Encoded %q as %q, expected %q", testCase.native, encoded, testCase.netAscii)
+		}
+	}
+}
+
+func TestNetAsciiReaderFillsBlocksAcrossExpansion(t *testing.T) {
+	for _, testCase := range netAsciiTestCases {
+		for blockSize := 1; blockSize <= len(testCase.netAscii)+1; blockSize++ {
+			reader := NewNetAsciiReader(strings.NewReader(testCase.native))
+			var encoded []byte
+			for {
+				block := make([]byte, blockSize)
+				n, err := reader.Read(block)
+				encoded = append(encoded, block[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if n < blockSize {
+					// a short block must be the last one
+					if more, _ := reader.Read(make([]byte, 1)); more != 0 {
+						t.Errorf("Short block of %v bytes read for block size %v before end of %q", n, blockSize, testCase.native)
+					}
+					break
+				}
+			}
+
+			if string(encoded) != testCase.netAscii {
+				t.Errorf("Encoded %q as %q with block size %v, expected %q", testCase.native, encoded, blockSize, testCase.netAscii)
+			}
+		}
+	}
+}
+
+type closeRecordingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeRecordingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestNetAsciiWriterTranslatesAcrossWrites(t *testing.T) {
+	for _, testCase := range netAsciiTestCases {
+		for split := 0; split <= len(testCase.netAscii); split++ {
+			destination := &closeRecordingBuffer{}
+			writer := NewNetAsciiWriter(destination)
+
+			writer.Write([]byte(testCase.netAscii[:split]))
+			writer.Write([]byte(testCase.netAscii[split:]))
+			writer.Close()
+
+			if destination.String() != testCase.native {
+				t.Errorf("Decoded %q split at %v as %q, expected %q", testCase.netAscii, split, destination.String(), testCase.native)
+			}
+
+			if !destination.closed {
+				t.Errorf("Close did not close destination")
+			}
+		}
+	}
+}
+
+func TestNetAsciiWriterKeepsInvalidCarriageReturns(t *testing.T) {
+	destination := &bytes.Buffer{}
+	writer := NewNetAsciiWriter(destination)
+
+	writer.Write([]byte("foo\rbar\r"))
+	writer.Close()
+
+	if destination.String() != "foo\rbar\r" {
+		t.Errorf("Expected invalid carriage returns to be kept, got %q", destination.String())
+	}
+}
@@ -5,14 +5,29 @@ import (
 )
 
 type PluggableConverter struct {
-	FromAckHandler         func(ack *packets.Ack) *SafeAck
-	FromReadRequestHandler func(read *packets.ReadRequest) (*SafeReadRequest, *ConversionError)
+	FromAckHandler          func(ack *packets.Ack) *SafeAck
+	FromDataHandler         func(data *packets.Data) *SafeData
+	FromErrorHandler        func(e *packets.Error) *SafeError
+	FromReadRequestHandler  func(read *packets.ReadRequest) (*SafeReadRequest, *ConversionError)
+	FromWriteRequestHandler func(write *packets.WriteRequest) (*SafeWriteRequest, *ConversionError)
 }
 
 func (c *PluggableConverter) FromAck(ack *packets.Ack) *SafeAck {
 	return c.FromAckHandler(ack)
 }
 
+func (c *PluggableConverter) FromData(data *packets.Data) *SafeData {
+	return c.FromDataHandler(data)
+}
+
+func (c *PluggableConverter) FromError(e *packets.Error) *SafeError {
+	return c.FromErrorHandler(e)
+}
+
 func (c *PluggableConverter) FromReadRequest(read *packets.ReadRequest) (*SafeReadRequest, *ConversionError) {
 	return c.FromReadRequestHandler(read)
 }
+
+func (c *PluggableConverter) FromWriteRequest(write *packets.WriteRequest) (*SafeWriteRequest, *ConversionError) {
+	return c.FromWriteRequestHandler(write)
+}
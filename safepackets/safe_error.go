@@ -12,6 +12,14 @@ type SafeError struct {
 	Message string
 }
 
+// The message should explain the error, as the code alone does not.
+func NewUndefinedError(message string) *SafeError {
+	return &SafeError{
+		Code:    packets.Undefined,
+		Message: message,
+	}
+}
+
 func NewFileNotFoundError() *SafeError {
 	return &SafeError{
 		Code:    packets.FileNotFound,
@@ -26,6 +34,79 @@ func NewAccessViolationError(message string) *SafeError {
 	}
 }
 
+// The client is not told why the file could not be opened, as the underlying error may reveal details of the server's filesystem.
+func NewOpenFailedError() *SafeError {
+	return &SafeError{
+		Code:    packets.AccessViolation,
+		Message: "Could not open file",
+	}
+}
+
+// The client is not told why the read failed, as the underlying error may reveal details of the server's filesystem.
+func NewReadFailedError() *SafeError {
+	return &SafeError{
+		Code:    packets.AccessViolation,
+		Message: "Error reading file",
+	}
+}
+
+// Like NewReadFailedError, the underlying error is not revealed.
+func NewWriteFailedError() *SafeError {
+	return &SafeError{
+		Code:    packets.AccessViolation,
+		Message: "Error writing file",
+	}
+}
+
+func NewDiskFullError() *SafeError {
+	return &SafeError{
+		Code:    packets.DiskFullOrAllocationExceeded,
+		Message: "Disk full or allocation exceeded",
+	}
+}
+
+func NewIllegalTftpOperationError(message string) *SafeError {
+	return &SafeError{
+		Code:    packets.IllegalTftpOperation,
+		Message: message,
+	}
+}
+
+func NewUnknownTransferIdError() *SafeError {
+	return &SafeError{
+		Code:    packets.UnknownTransferId,
+		Message: "Unknown transfer ID",
+	}
+}
+
+func NewFileAlreadyExistsError() *SafeError {
+	return &SafeError{
+		Code:    packets.FileAlreadyExists,
+		Message: "File already exists",
+	}
+}
+
+func NewNoSuchUserError() *SafeError {
+	return &SafeError{
+		Code:    packets.NoSuchUser,
+		Message: "No such user",
+	}
+}
+
+func NewOptionNegotiationRefusedError() *SafeError {
+	return &SafeError{
+		Code:    packets.OptionNegotiationRefused,
+		Message: "Option negotiation refused",
+	}
+}
+
+func NewServerShuttingDownError() *SafeError {
+	return &SafeError{
+		Code:    packets.Undefined,
+		Message: "Server shutting down",
+	}
+}
+
 func NewAncientAckError() *SafeError {
 	return &SafeError{
 		Code:    packets.Undefined,
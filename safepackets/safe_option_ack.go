@@ -0,0 +1,54 @@
+package safepackets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/mark-rushakoff/go_tftpd/packets"
+)
+
+type SafeOptionAck struct {
+	packets.OptionAck
+}
+
+func NewSafeOptionAck(options map[string]string) *SafeOptionAck {
+	return &SafeOptionAck{
+		packets.OptionAck{Options: options},
+	}
+}
+
+func (oack *SafeOptionAck) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, packets.OptionAckOpcode)
+
+	// sort the option names so that the packet is deterministic
+	names := make([]string, 0, len(oack.Options))
+	for name := range oack.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		buf.WriteString(oack.Options[name])
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+func (oack *SafeOptionAck) Equals(other *SafeOptionAck) bool {
+	if len(oack.Options) != len(other.Options) {
+		return false
+	}
+
+	for name, value := range oack.Options {
+		otherValue, ok := other.Options[name]
+		if !ok || otherValue != value {
+			return false
+		}
+	}
+
+	return true
+}
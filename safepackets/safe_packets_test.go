@@ -1,6 +1,7 @@
 package safepackets
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -26,3 +27,31 @@ func TestSafeDataInequality(t *testing.T) {
 		t.Errorf("Expected inequality when bytes do not match: %v, %v", other, data)
 	}
 }
+
+func TestSafeOptionAckSerializesInSortedOrder(t *testing.T) {
+	oack := NewSafeOptionAck(map[string]string{
+		"tsize":   "100",
+		"blksize": "1024",
+	})
+
+	expected := []byte("\x00\x06blksize\x001024\x00tsize\x00100\x00")
+	if !bytes.Equal(oack.Bytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, oack.Bytes())
+	}
+}
+
+func TestSafeOptionAckEquality(t *testing.T) {
+	oack := NewSafeOptionAck(map[string]string{"blksize": "1024"})
+
+	if !oack.Equals(NewSafeOptionAck(map[string]string{"blksize": "1024"})) {
+		t.Errorf("Expected option acks to be equal")
+	}
+
+	if oack.Equals(NewSafeOptionAck(map[string]string{"blksize": "512"})) {
+		t.Errorf("Expected inequality when values do not match")
+	}
+
+	if oack.Equals(NewSafeOptionAck(map[string]string{"blksize": "1024", "tsize": "0"})) {
+		t.Errorf("Expected inequality when options do not match")
+	}
+}
@@ -1,5 +1,9 @@
 package safepackets
 
+import (
+	"time"
+)
+
 type ReadWriteMode string
 
 const (
@@ -7,20 +11,36 @@ const (
 	Octet    ReadWriteMode = "octet"
 )
 
+// RequestOptions holds the recognized options from a request, already validated.
+// A zero value for a field means that the client did not request that option.
+type RequestOptions struct {
+	BlockSize uint16
+
+	// The client sends tsize 0 on reads to ask for the file size, so presence is tracked separately.
+	TransferSizeRequested bool
+	TransferSize          uint64
+
+	Timeout time.Duration
+
+	WindowSize uint16
+}
+
 type SafeReadRequest struct {
 	Filename string
 	Mode     ReadWriteMode
+	Options  RequestOptions
 }
 
 type SafeWriteRequest struct {
 	Filename string
 	Mode     ReadWriteMode
+	Options  RequestOptions
 }
 
 func NewSafeReadRequest(filename string, mode ReadWriteMode) *SafeReadRequest {
-	return &SafeReadRequest{filename, mode}
+	return &SafeReadRequest{Filename: filename, Mode: mode}
 }
 
 func NewSafeWriteRequest(filename string, mode ReadWriteMode) *SafeWriteRequest {
-	return &SafeWriteRequest{filename, mode}
+	return &SafeWriteRequest{Filename: filename, Mode: mode}
 }
@@ -2,24 +2,42 @@ package safetyfilter
 
 type SafeRequestHandler interface {
 	HandleSafeAck(*IncomingSafeAck)
+	HandleSafeData(*IncomingSafeData)
+	HandleSafeError(*IncomingSafeError)
 	HandleSafeReadRequest(*IncomingSafeReadRequest)
+	HandleSafeWriteRequest(*IncomingSafeWriteRequest)
 	HandleError(*IncomingInvalidMessage)
 }
 
 type PluggableHandler struct {
-	AckHandler         func(*IncomingSafeAck)
-	ReadRequestHandler func(*IncomingSafeReadRequest)
-	ErrorHandler       func(*IncomingInvalidMessage)
+	AckHandler          func(*IncomingSafeAck)
+	DataHandler         func(*IncomingSafeData)
+	SafeErrorHandler    func(*IncomingSafeError)
+	ReadRequestHandler  func(*IncomingSafeReadRequest)
+	WriteRequestHandler func(*IncomingSafeWriteRequest)
+	ErrorHandler        func(*IncomingInvalidMessage)
 }
 
 func (h *PluggableHandler) HandleSafeAck(ack *IncomingSafeAck) {
 	h.AckHandler(ack)
 }
 
+func (h *PluggableHandler) HandleSafeData(data *IncomingSafeData) {
+	h.DataHandler(data)
+}
+
+func (h *PluggableHandler) HandleSafeError(e *IncomingSafeError) {
+	h.SafeErrorHandler(e)
+}
+
 func (h *PluggableHandler) HandleSafeReadRequest(read *IncomingSafeReadRequest) {
 	h.ReadRequestHandler(read)
 }
 
+func (h *PluggableHandler) HandleSafeWriteRequest(write *IncomingSafeWriteRequest) {
+	h.WriteRequestHandler(write)
+}
+
 func (h *PluggableHandler) HandleError(invalid *IncomingInvalidMessage) {
 	h.ErrorHandler(invalid)
 }
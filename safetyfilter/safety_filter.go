@@ -2,6 +2,7 @@ package safetyfilter
 
 import (
 	"net"
+	"net/netip"
 
 	"github.com/mark-rushakoff/go_tftpd/packets"
 	"github.com/mark-rushakoff/go_tftpd/requestagent"
@@ -27,9 +28,31 @@ type IncomingSafeAck struct {
 	Addr net.Addr
 }
 
+type IncomingSafeData struct {
+	Data *safepackets.SafeData
+	Addr net.Addr
+}
+
+// IncomingSafeError is an error sent by a client, which ends its transfer.
+type IncomingSafeError struct {
+	Error *safepackets.SafeError
+	Addr  net.Addr
+}
+
 type IncomingSafeReadRequest struct {
 	Read *safepackets.SafeReadRequest
 	Addr net.Addr
+
+	// The local address the request was sent to; invalid if unknown
+	LocalAddr netip.Addr
+}
+
+type IncomingSafeWriteRequest struct {
+	Write *safepackets.SafeWriteRequest
+	Addr  net.Addr
+
+	// The local address the request was sent to; invalid if unknown
+	LocalAddr netip.Addr
 }
 
 type IncomingInvalidMessage struct {
@@ -46,6 +69,22 @@ func (f *SafetyFilter) HandleAck(incomingAck *requestagent.IncomingAck) {
 	f.handler.HandleSafeAck(safeAck)
 }
 
+func (f *SafetyFilter) HandleData(incomingData *requestagent.IncomingData) {
+	safeData := &IncomingSafeData{
+		Addr: incomingData.Addr,
+		Data: f.converter.FromData(incomingData.Data),
+	}
+	f.handler.HandleSafeData(safeData)
+}
+
+func (f *SafetyFilter) HandleError(incomingError *requestagent.IncomingError) {
+	safeError := &IncomingSafeError{
+		Addr:  incomingError.Addr,
+		Error: f.converter.FromError(incomingError.Error),
+	}
+	f.handler.HandleSafeError(safeError)
+}
+
 func (f *SafetyFilter) HandleReadRequest(incomingReadRequest *requestagent.IncomingReadRequest) {
 	safeReadRequestPacket, err := f.converter.FromReadRequest(incomingReadRequest.Read)
 	if err != nil {
@@ -58,8 +97,28 @@ func (f *SafetyFilter) HandleReadRequest(incomingReadRequest *requestagent.Incom
 	}
 
 	safeReadRequest := &IncomingSafeReadRequest{
-		Read: safeReadRequestPacket,
-		Addr: incomingReadRequest.Addr,
+		Read:      safeReadRequestPacket,
+		Addr:      incomingReadRequest.Addr,
+		LocalAddr: incomingReadRequest.LocalAddr,
 	}
 	f.handler.HandleSafeReadRequest(safeReadRequest)
 }
+
+func (f *SafetyFilter) HandleWriteRequest(incomingWriteRequest *requestagent.IncomingWriteRequest) {
+	safeWriteRequestPacket, err := f.converter.FromWriteRequest(incomingWriteRequest.Write)
+	if err != nil {
+		f.handler.HandleError(&IncomingInvalidMessage{
+			ErrorCode:    err.Code(),
+			ErrorMessage: err.Error(),
+			Addr:         incomingWriteRequest.Addr,
+		})
+		return
+	}
+
+	safeWriteRequest := &IncomingSafeWriteRequest{
+		Write:     safeWriteRequestPacket,
+		Addr:      incomingWriteRequest.Addr,
+		LocalAddr: incomingWriteRequest.LocalAddr,
+	}
+	f.handler.HandleSafeWriteRequest(safeWriteRequest)
+}
@@ -157,3 +157,176 @@ func TestRejectsReadRequestWithInvalidMode(t *testing.T) {
 		t.Fatalf("Did not receive read request in time")
 	}
 }
+
+func TestConvertsDataToSafeData(t *testing.T) {
+	incomingData := make(chan *IncomingSafeData, 1)
+	handler := &PluggableHandler{
+		DataHandler: func(data *IncomingSafeData) {
+			incomingData <- data
+		},
+	}
+
+	dataPacket := &packets.Data{
+		BlockNumber: 500,
+		Data:        []byte("foobar"),
+	}
+
+	fakeSafeData := safepackets.NewSafeData(500, []byte("foobar"))
+	fakeConverter := &safepackets.PluggableConverter{
+		FromDataHandler: func(data *packets.Data) *safepackets.SafeData {
+			if data != dataPacket {
+				t.Fatalf("fakeConverter called with unexpected argument")
+			}
+
+			return fakeSafeData
+		},
+	}
+
+	data := &requestagent.IncomingData{
+		Data: dataPacket,
+		Addr: fakeAddr,
+	}
+
+	MakeSafetyFilter(fakeConverter, handler).HandleData(data)
+
+	select {
+	case incoming := <-incomingData:
+		if incoming.Data != fakeSafeData {
+			t.Fatalf("SafetyFilter did not use data provided by converter")
+		}
+
+		if incoming.Addr != fakeAddr {
+			t.Fatalf("SafetyFilter did not use correct addr on incoming data")
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not receive data in time")
+	}
+}
+
+func TestConvertsWriteRequestsToSafeWriteRequests(t *testing.T) {
+	incomingWriteRequests := make(chan *IncomingSafeWriteRequest, 1)
+	handler := &PluggableHandler{
+		WriteRequestHandler: func(write *IncomingSafeWriteRequest) {
+			incomingWriteRequests <- write
+		},
+	}
+
+	fakeIncomingWritePacket := &packets.WriteRequest{
+		Filename: "some file",
+		Mode:     "octet",
+	}
+
+	fakeSafeWrite := safepackets.NewSafeWriteRequest("some file", safepackets.Octet)
+	fakeConverter := &safepackets.PluggableConverter{
+		FromWriteRequestHandler: func(write *packets.WriteRequest) (*safepackets.SafeWriteRequest, *safepackets.ConversionError) {
+			if write != fakeIncomingWritePacket {
+				t.Fatalf("fakeConverter called with unexpected argument")
+			}
+
+			return fakeSafeWrite, nil
+		},
+	}
+
+	fakeIncomingWriteRequest := &requestagent.IncomingWriteRequest{
+		Write: fakeIncomingWritePacket,
+		Addr:  fakeAddr,
+	}
+	MakeSafetyFilter(fakeConverter, handler).HandleWriteRequest(fakeIncomingWriteRequest)
+
+	select {
+	case incomingWrite := <-incomingWriteRequests:
+		if incomingWrite.Addr.String() != fakeAddr.String() {
+			t.Errorf("Received incorrect addr: %v", incomingWrite.Addr)
+		}
+
+		if incomingWrite.Write != fakeSafeWrite {
+			t.Fatalf("SafetyFilter did not use write provided by fake converter")
+		}
+
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not receive write request in time")
+	}
+}
+
+func TestRejectsWriteRequestWithInvalidMode(t *testing.T) {
+	incomingInvalidMessages := make(chan *IncomingInvalidMessage, 1)
+	handler := &PluggableHandler{
+		ErrorHandler: func(message *IncomingInvalidMessage) {
+			incomingInvalidMessages <- message
+		},
+	}
+
+	fakeIncomingWritePacket := &packets.WriteRequest{
+		Filename: "foobar",
+		Mode:     "an invalid mode",
+	}
+
+	fakeConverter := &safepackets.PluggableConverter{
+		FromWriteRequestHandler: func(write *packets.WriteRequest) (*safepackets.SafeWriteRequest, *safepackets.ConversionError) {
+			return nil, safepackets.NewConversionError(packets.Undefined, "Invalid mode string")
+		},
+	}
+
+	MakeSafetyFilter(fakeConverter, handler).HandleWriteRequest(&requestagent.IncomingWriteRequest{
+		Write: fakeIncomingWritePacket,
+		Addr:  fakeAddr,
+	})
+
+	select {
+	case invalid := <-incomingInvalidMessages:
+		if invalid.Addr.String() != fakeAddr.String() {
+			t.Errorf("Received incorrect addr: %v", invalid.Addr)
+		}
+
+		if invalid.ErrorCode != packets.Undefined {
+			t.Errorf("Received code %v, expected code %v", invalid.ErrorCode, packets.Undefined)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not receive invalid message in time")
+	}
+}
+
+func TestConvertsErrorsToSafeErrors(t *testing.T) {
+	incomingErrors := make(chan *IncomingSafeError, 1)
+	handler := &PluggableHandler{
+		SafeErrorHandler: func(e *IncomingSafeError) {
+			incomingErrors <- e
+		},
+	}
+
+	errorPacket := &packets.Error{
+		Code:    packets.Undefined,
+		Message: "cancelled",
+	}
+
+	fakeSafeError := &safepackets.SafeError{Code: packets.Undefined, Message: "cancelled"}
+	fakeConverter := &safepackets.PluggableConverter{
+		FromErrorHandler: func(e *packets.Error) *safepackets.SafeError {
+			if e != errorPacket {
+				t.Fatalf("fakeConverter called with unexpected argument")
+			}
+
+			return fakeSafeError
+		},
+	}
+
+	e := &requestagent.IncomingError{
+		Error: errorPacket,
+		Addr:  fakeAddr,
+	}
+
+	MakeSafetyFilter(fakeConverter, handler).HandleError(e)
+
+	select {
+	case incomingError := <-incomingErrors:
+		if incomingError.Error != fakeSafeError {
+			t.Fatalf("SafetyFilter did not use error provided by converter")
+		}
+
+		if incomingError.Addr != fakeAddr {
+			t.Fatalf("SafetyFilter did not use correct addr on incoming error")
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Did not receive error in time")
+	}
+}
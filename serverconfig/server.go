@@ -0,0 +1,420 @@
+package serverconfig
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/dirfs"
+	"github.com/mark-rushakoff/go_tftpd/pktinfo"
+	"github.com/mark-rushakoff/go_tftpd/readsessioncollection"
+	"github.com/mark-rushakoff/go_tftpd/responseagent"
+	"github.com/mark-rushakoff/go_tftpd/safepacketprovider"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
+	"github.com/mark-rushakoff/go_tftpd/sessioncreator"
+	"github.com/mark-rushakoff/go_tftpd/sessionlimiter"
+	"github.com/mark-rushakoff/go_tftpd/sessionrouter"
+	"github.com/mark-rushakoff/go_tftpd/writesessioncollection"
+)
+
+// ErrServerClosed is returned by Serve once Shutdown has been called.
+var ErrServerClosed = errors.New("serverconfig: Server closed")
+
+var errServerAlreadyServing = errors.New("serverconfig: Server is already serving")
+
+var errNoListeners = errors.New("serverconfig: No listeners configured")
+
+// How often a draining server checks whether its sessions have all ended
+var drainPollInterval = 10 * time.Millisecond
+
+type Server struct {
+	config    *ServerConfig
+	listeners []*listener
+	limiter   *sessionlimiter.SessionLimiter
+
+	mutex   sync.Mutex
+	serving bool
+
+	shutdownOnce sync.Once
+	draining     chan bool // closed once Shutdown is called
+	abortOnce    sync.Once
+	aborting     chan bool // closed once Shutdown gives up waiting for sessions to end
+	done         chan bool // closed once Serve returns
+}
+
+type listener struct {
+	config *ListenerConfig
+	conn   net.PacketConn
+}
+
+// NewServer listens on the Address of every listener whose PacketConn is not already set.
+func NewServer(config *ServerConfig) (*Server, error) {
+	if len(config.Listeners) == 0 {
+		return nil, errNoListeners
+	}
+
+	listeners := make([]*listener, 0, len(config.Listeners))
+	for i := range config.Listeners {
+		conn, err := listen(&config.Listeners[i])
+		if err != nil {
+			for _, l := range listeners {
+				l.conn.Close()
+			}
+			return nil, err
+		}
+
+		listeners = append(listeners, &listener{
+			config: &config.Listeners[i],
+			conn:   conn,
+		})
+	}
+
+	return &Server{
+		config:    config,
+		listeners: listeners,
+		limiter:   sessionlimiter.NewSessionLimiter(config.SessionLimits),
+		draining:  make(chan bool),
+		aborting:  make(chan bool),
+		done:      make(chan bool),
+	}, nil
+}
+
+func listen(config *ListenerConfig) (net.PacketConn, error) {
+	conn := config.PacketConn
+	if conn == nil {
+		addr, err := net.ResolveUDPAddr("udp", config.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// knowing where requests were sent lets broadcasts be ignored and sessions reply from the right address;
+	// without it, requests are still served
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		if destinationConn, err := pktinfo.NewConn(udpConn); err == nil {
+			conn = destinationConn
+		}
+	}
+
+	return conn, nil
+}
+
+// Addr is the address the first listener accepts requests on.
+func (s *Server) Addr() net.Addr {
+	return s.listeners[0].conn.LocalAddr()
+}
+
+// Addrs are the addresses every listener accepts requests on, in the order they were configured.
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, l := range s.listeners {
+		addrs[i] = l.conn.LocalAddr()
+	}
+	return addrs
+}
+
+// SessionStats counts the active, queued and refused sessions of every listener.
+func (s *Server) SessionStats() sessionlimiter.Stats {
+	return s.limiter.Stats()
+}
+
+// Serve handles requests until ctx is done, Shutdown is called, or reading from any listener fails.
+// When ctx is done, every active session is aborted and ctx.Err() is returned.
+// After Shutdown, ErrServerClosed is returned, including when Serve is called after Shutdown.
+func (s *Server) Serve(ctx context.Context) error {
+	s.mutex.Lock()
+	select {
+	case <-s.draining:
+		s.mutex.Unlock()
+		return ErrServerClosed
+	default:
+	}
+	if s.serving {
+		s.mutex.Unlock()
+		return errServerAlreadyServing
+	}
+	s.serving = true
+	s.mutex.Unlock()
+
+	defer close(s.done)
+	for _, l := range s.listeners {
+		defer l.conn.Close()
+	}
+
+	var workingDir *dirfs.DirFS
+	for _, l := range s.listeners {
+		if l.config.Root != nil || workingDir != nil {
+			continue
+		}
+
+		var err error
+		workingDir, err = dirfs.NewDirFS(".", dirfs.FollowWithinRoot)
+		if err != nil {
+			return err
+		}
+		defer workingDir.Close()
+	}
+
+	// one table for every listener, so that shutdown sees every session
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	sessionRouter := sessionrouter.NewSessionRouter(readSessions, writeSessions)
+
+	readErr := make(chan error, len(s.listeners))
+	stop := make(chan bool)
+	var listening sync.WaitGroup
+	sessionCreators := make([]*sessioncreator.SessionCreator, 0, len(s.listeners))
+	for i, l := range s.listeners {
+		root := l.config.Root
+		if root == nil {
+			root = workingDir
+		}
+
+		provider := safepacketprovider.NewSafePacketProvider(l.conn, s.config.InvalidTransmissionPolicy)
+		defer provider.Close()
+
+		go func() {
+			for {
+				if err := provider.Read(); err != nil {
+					readErr <- err
+					return
+				}
+			}
+		}()
+
+		var writerFactory sessioncreator.WriterFromFilename
+		if l.config.AllowWrites {
+			writerFactory = sessioncreator.WriterFromFS(root)
+		}
+
+		sessionCreator := sessioncreator.NewSessionCreator(
+			readSessions,
+			writeSessions,
+			&sessioncreator.Config{
+				ReaderFactory:   sessioncreator.ReaderFromFS(root),
+				WriterFactory:   writerFactory,
+				TransferFactory: l.transferFromAddr(provider),
+				TimeoutPolicy: sessioncreator.TimeoutPolicy{
+					Default: l.config.DefaultTimeout,
+					Min:     l.config.MinTimeout,
+					Max:     l.config.MaxTimeout,
+				},
+				BlockSizePolicy: sessioncreator.BlockSizePolicy{Max: l.config.MaxBlockSize},
+				TryLimit:        l.config.TryLimit,
+				BlockSequence:   safepackets.BlockSequence{RolloverTarget: l.config.RolloverTarget},
+				AccessList:      l.config.AccessList,
+				OnAccessDenied:  s.config.OnAccessDenied,
+				OnClientError:   s.config.OnClientError,
+				SessionLimiter:  s.limiter,
+				// listeners may serve different roots, where the same name is a different file
+				SessionLimiterScope: strconv.Itoa(i) + ":",
+				OnSessionLimited:    s.config.OnSessionLimited,
+			},
+		)
+		sessionCreators = append(sessionCreators, sessionCreator)
+
+		listening.Add(1)
+		go func() {
+			defer listening.Done()
+			s.handleIncoming(provider, sessionCreator, sessionRouter, stop)
+		}()
+	}
+
+	// listeners are stopped before sessions are aborted, so that no new session can slip in afterwards,
+	// and requests still waiting for a session slot are refused
+	stopListening := func() {
+		close(stop)
+		listening.Wait()
+		for _, sessionCreator := range sessionCreators {
+			sessionCreator.Close()
+		}
+		s.limiter.Close()
+	}
+	abortSessions := func() {
+		stopListening()
+		for _, session := range readSessions.All() {
+			session.Abort(safepackets.NewServerShuttingDownError())
+		}
+		for _, session := range writeSessions.All() {
+			session.Abort(safepackets.NewServerShuttingDownError())
+		}
+	}
+	// requests waiting for a session slot were received before Shutdown, so they are served too
+	drained := func() bool {
+		return readSessions.Len() == 0 && writeSessions.Len() == 0 && s.limiter.Stats().Queued == 0
+	}
+
+	draining := false
+	drainStarted := s.draining
+	var drainTick <-chan time.Time
+
+	for {
+		select {
+		case err := <-readErr:
+			if draining {
+				// Shutdown closed the listeners to stop new requests
+				continue
+			}
+			abortSessions()
+			return err
+		case <-drainStarted:
+			draining = true
+			drainStarted = nil
+			if drained() {
+				stopListening()
+				return ErrServerClosed
+			}
+			ticker := time.NewTicker(drainPollInterval)
+			defer ticker.Stop()
+			drainTick = ticker.C
+		case <-drainTick:
+			if drained() {
+				stopListening()
+				return ErrServerClosed
+			}
+		case <-s.aborting:
+			abortSessions()
+			return ErrServerClosed
+		case <-ctx.Done():
+			abortSessions()
+			return ctx.Err()
+		}
+	}
+}
+
+// handleIncoming acts on the packets of one listener and the transfers it started until stop is closed.
+// Once Shutdown is called, new requests are ignored while existing sessions continue.
+func (s *Server) handleIncoming(
+	provider *safepacketprovider.SafePacketProvider,
+	sessionCreator *sessioncreator.SessionCreator,
+	sessionRouter *sessionrouter.SessionRouter,
+	stop <-chan bool,
+) {
+	draining := false
+	drainStarted := s.draining
+
+	for {
+		select {
+		case r := <-provider.IncomingSafeReadRequest():
+			if !draining {
+				sessionCreator.CreateRead(r)
+			}
+		case w := <-provider.IncomingSafeWriteRequest():
+			if !draining {
+				sessionCreator.CreateWrite(w)
+			}
+		case ack := <-provider.IncomingSafeAck():
+			sessionRouter.RouteAck(ack)
+		case data := <-provider.IncomingSafeData():
+			sessionRouter.RouteData(data)
+		case e := <-provider.IncomingSafeError():
+			sessionRouter.RouteError(e)
+		case i := <-provider.IncomingInvalidMessage():
+			if !draining {
+				s.rejectInvalidMessage(provider, i)
+			}
+		case <-drainStarted:
+			draining = true
+			drainStarted = nil
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Shutdown stops accepting new requests and waits for active sessions to end.
+// If ctx is done first, the remaining sessions are aborted and ctx.Err() is returned.
+// The server cannot be served again afterwards.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shutdownOnce.Do(func() {
+		close(s.draining)
+	})
+	serving := s.serving
+	s.mutex.Unlock()
+
+	// unblocks the listeners; transfers have their own connections and keep going
+	for _, l := range s.listeners {
+		l.conn.Close()
+	}
+
+	if !serving {
+		return nil
+	}
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		s.abortOnce.Do(func() {
+			close(s.aborting)
+		})
+		<-s.done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) rejectInvalidMessage(provider *safepacketprovider.SafePacketProvider, i *safetyfilter.IncomingInvalidMessage) {
+	provider.RejectInvalidMessage(i)
+
+	if s.config.OnInvalidMessage != nil {
+		s.config.OnInvalidMessage(i)
+	}
+}
+
+// Every session gets its own connection on an ephemeral port of the address its request was sent to,
+// so that the port serves as the server's transfer ID (RFC 1350).
+func (l *listener) transferFromAddr(provider *safepacketprovider.SafePacketProvider) sessioncreator.TransferFromAddr {
+	return func(addr net.Addr, requestedAddr netip.Addr) (sessioncreator.Transfer, error) {
+		localAddr := &net.UDPAddr{}
+		if requestedAddr.IsValid() {
+			// clients on multi-homed hosts reject replies from any address but the one they asked
+			localAddr.IP = requestedAddr.AsSlice()
+			localAddr.Zone = requestedAddr.Zone()
+		} else if listenAddr, ok := l.conn.LocalAddr().(*net.UDPAddr); ok {
+			localAddr.IP = listenAddr.IP
+			localAddr.Zone = listenAddr.Zone
+		}
+
+		conn, err := net.ListenUDP("udp", localAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		return &transfer{
+			ResponseAgent: responseagent.NewResponseAgent(conn, addr),
+			conn:          conn,
+			clientAddr:    addr,
+			provider:      provider,
+		}, nil
+	}
+}
+
+type transfer struct {
+	*responseagent.ResponseAgent
+	conn        net.PacketConn
+	clientAddr  net.Addr
+	provider    *safepacketprovider.SafePacketProvider
+	receiveOnce sync.Once
+}
+
+// Receive starts reading the client's packets; until then they wait in the socket's buffer.
+func (t *transfer) Receive(blockSize uint16) {
+	t.receiveOnce.Do(func() {
+		go t.provider.ServeTransfer(t.conn, t.clientAddr, blockSize)
+	})
+}
+
+func (t *transfer) Close() error {
+	return t.conn.Close()
+}
@@ -1,71 +1,73 @@
 package serverconfig
 
 import (
-	"io"
+	"io/fs"
 	"net"
-	"os"
-	"path"
 	"time"
 
-	"github.com/mark-rushakoff/go_tftpd/readsession"
-	"github.com/mark-rushakoff/go_tftpd/readsessioncollection"
-	"github.com/mark-rushakoff/go_tftpd/responseagent"
+	"github.com/mark-rushakoff/go_tftpd/accesscontrol"
 	"github.com/mark-rushakoff/go_tftpd/safepacketprovider"
+	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
 	"github.com/mark-rushakoff/go_tftpd/sessioncreator"
-	"github.com/mark-rushakoff/go_tftpd/sessionrouter"
+	"github.com/mark-rushakoff/go_tftpd/sessionlimiter"
 )
 
 type ServerConfig struct {
-	// The PacketConn to use for incoming and outgoing messages
+	// Where requests are accepted, each with its own files and policies, e.g. one per network the host is on.
+	// Sessions from every listener share the server's session table and hooks.
+	Listeners []ListenerConfig
+
+	// Caps on the sessions of every listener together, and whether requests over them wait; zero values are unlimited
+	SessionLimits sessionlimiter.Limits
+
+	// Called with every request refused by SessionLimits, after the client has been sent an error; may be nil
+	OnSessionLimited func(*sessioncreator.SessionLimited)
+
+	// Called with every request refused by a listener's AccessList, after the client has been sent an error; may be nil
+	OnAccessDenied func(*sessioncreator.AccessDenied)
+
+	// Called with every session the client aborted by sending an error, once the session has ended; may be nil
+	OnClientError func(*sessioncreator.ClientError)
+
+	// Called with every request that was rejected, after the requester has been sent an error if InvalidTransmissionPolicy allows; may be nil
+	OnInvalidMessage func(*safetyfilter.IncomingInvalidMessage)
+
+	// How to answer packets that cannot be parsed and requests that are rejected
+	InvalidTransmissionPolicy safepacketprovider.InvalidTransmissionPolicy
+}
+
+type ListenerConfig struct {
+	// The PacketConn to use for incoming requests; when nil, the server listens on Address instead.
+	// The server closes it when it stops serving.
 	PacketConn net.PacketConn
 
+	// The UDP address to listen on when PacketConn is nil, e.g. "127.0.0.1:69"; port 0 picks a free port.
+	// "[::]:69" listens on IPv4 and IPv6 alike, and link-local addresses need a zone, e.g. "[fe80::1%eth0]:69".
+	Address string
+
+	// The files to serve; when nil, the current working directory, following symlinks only within it.
+	Root fs.FS
+
+	// Whether write requests may create files in Root, which must then be able to create files, as dirfs.DirFS can.
+	// When false, every write request is refused.
+	AllowWrites bool
+
+	// Which clients may read and write which files; nil allows every request
+	AccessList *accesscontrol.AccessList
+
 	// How long to wait until retrying to send a packet
 	DefaultTimeout time.Duration
 
+	// Bounds on the timeout a client may request with the timeout option; zero means unbounded
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
 	// How many tries to use when sending a packet until giving up
 	TryLimit uint
-}
 
-func (c *ServerConfig) Serve() {
-	provider := safepacketprovider.NewSafePacketProvider(c.PacketConn)
-
-	go func() {
-		for {
-			provider.Read()
-		}
-	}()
-
-	sessions := readsessioncollection.NewReadSessionCollection()
-	sessionCreator := sessioncreator.NewSessionCreator(sessions, readerFromFilename, c.outgoingHandlerFromAddr(), c.DefaultTimeout, c.TryLimit)
-	sessionRouter := sessionrouter.NewSessionRouter(sessions)
-
-	for {
-		select {
-		case r := <-provider.IncomingSafeReadRequest():
-			sessionCreator.Create(r)
-		case ack := <-provider.IncomingSafeAck():
-			sessionRouter.RouteAck(ack)
-		}
-	}
-}
-
-func readerFromFilename(filename string) (io.Reader, error) {
-	workingDir, err := os.Getwd()
-	if err != nil {
-		return nil, err
-	}
-
-	// serve files as though the filesystem root is the working directory
-	file, err := os.Open(path.Join(workingDir, path.Clean(filename)))
-	if err != nil {
-		return nil, err
-	}
-
-	return file, nil
-}
+	// The largest block size to agree to with the blksize option, e.g. to fit the network's MTU; zero means unbounded
+	MaxBlockSize uint16
 
-func (c *ServerConfig) outgoingHandlerFromAddr() sessioncreator.OutgoingHandlerFromAddr {
-	return func(addr net.Addr) readsession.OutgoingHandler {
-		return responseagent.NewResponseAgent(c.PacketConn, addr)
-	}
+	// The block number that follows block 65535 in transfers larger than 65535 blocks; either 0 or 1
+	RolloverTarget uint16
 }
@@ -0,0 +1,52 @@
+package serverconfig
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Every address in 127.0.0.0/8 reaches the loopback interface, which stands in for a host with several addresses.
+func TestSessionsReplyFromRequestedAddress(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerOn(t, ctx, "0.0.0.0:0", time.Second)
+	port := server.Addr().(*net.UDPAddr).Port
+
+	for _, ip := range []string{"127.0.0.1", "127.0.0.2"} {
+		c := newClient(t)
+		c.sendReadRequest(&net.UDPAddr{IP: net.ParseIP(ip), Port: port}, "file")
+		transferAddr := c.expectData(1)
+
+		if !transferAddr.(*net.UDPAddr).IP.Equal(net.ParseIP(ip)) {
+			t.Errorf("Expected request to %v to be answered from it, was answered from %v", ip, transferAddr)
+		}
+	}
+}
+
+func TestBroadcastRequestsAreIgnored(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerOn(t, ctx, "0.0.0.0:0", time.Second)
+	port := server.Addr().(*net.UDPAddr).Port
+
+	c := newClient(t)
+	raw, err := c.conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+
+	// the broadcast address of the loopback interface's 127.0.0.0/8
+	c.sendReadRequest(&net.UDPAddr{IP: net.IPv4(127, 255, 255, 255), Port: port}, "file")
+	if b, _ := c.receive(100 * time.Millisecond); b != nil {
+		t.Errorf("Expected a broadcast request to be ignored, received %q", b)
+	}
+
+	c.sendReadRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, "file")
+	c.expectData(1)
+}
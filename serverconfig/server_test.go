@@ -0,0 +1,815 @@
+package serverconfig
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/dirfs"
+	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/safepacketprovider"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
+	"github.com/mark-rushakoff/go_tftpd/sessioncreator"
+	"github.com/mark-rushakoff/go_tftpd/sessionlimiter"
+)
+
+// Serves a 1200 byte file, i.e. 3 blocks of the default size.
+func startServer(t *testing.T, ctx context.Context, defaultTimeout time.Duration) (*Server, <-chan error) {
+	return startServerOn(t, ctx, "127.0.0.1:0", defaultTimeout)
+}
+
+func startServerOn(t *testing.T, ctx context.Context, address string, defaultTimeout time.Duration) (*Server, <-chan error) {
+	return startServerWith(t, ctx, &ServerConfig{
+		Listeners: []ListenerConfig{{
+			Address: address,
+			Root: fstest.MapFS{
+				"file": &fstest.MapFile{Data: bytes.Repeat([]byte("x"), 1200)},
+			},
+			DefaultTimeout: defaultTimeout,
+			TryLimit:       3,
+		}},
+	})
+}
+
+func startServerWith(t *testing.T, ctx context.Context, config *ServerConfig) (*Server, <-chan error) {
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ctx)
+	}()
+
+	return server, served
+}
+
+type client struct {
+	t    *testing.T
+	conn *net.UDPConn
+}
+
+func newClient(t *testing.T) *client {
+	return newClientOn(t, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+}
+
+func newClientOn(t *testing.T, addr *net.UDPAddr) *client {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	return &client{t: t, conn: conn}
+}
+
+func (c *client) sendReadRequest(to net.Addr, filename string) {
+	c.sendRequest(to, packets.ReadOpcode, filename)
+}
+
+func (c *client) sendWriteRequest(to net.Addr, filename string) {
+	c.sendRequest(to, packets.WriteOpcode, filename)
+}
+
+func (c *client) sendRequest(to net.Addr, opcode uint16, filename string) {
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.BigEndian, opcode)
+	b.WriteString(filename + "\x00octet\x00")
+	if _, err := c.conn.WriteTo(b.Bytes(), to); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) sendAck(to net.Addr, blockNumber uint16) {
+	if _, err := c.conn.WriteTo(safepackets.NewSafeAck(blockNumber).Bytes(), to); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) sendData(to net.Addr, blockNumber uint16, data []byte) {
+	if _, err := c.conn.WriteTo(safepackets.NewSafeData(blockNumber, data).Bytes(), to); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Returns the next packet and where it came from, or nil if none arrives within timeout.
+func (c *client) receive(timeout time.Duration) ([]byte, net.Addr) {
+	buf := make([]byte, 1024)
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := c.conn.ReadFrom(buf)
+	if err != nil {
+		return nil, nil
+	}
+	return buf[:n], addr
+}
+
+func (c *client) expectData(blockNumber uint16) net.Addr {
+	b, addr := c.receive(time.Second)
+	if b == nil {
+		c.t.Fatalf("Expected data block %v, received nothing", blockNumber)
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != packets.DataOpcode || binary.BigEndian.Uint16(b[2:4]) != blockNumber {
+		c.t.Fatalf("Expected data block %v, received %q", blockNumber, b)
+	}
+	return addr
+}
+
+func (c *client) expectAck(blockNumber uint16) net.Addr {
+	b, addr := c.receive(time.Second)
+	if b == nil {
+		c.t.Fatalf("Expected ack %v, received nothing", blockNumber)
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != packets.AckOpcode || binary.BigEndian.Uint16(b[2:4]) != blockNumber {
+		c.t.Fatalf("Expected ack %v, received %q", blockNumber, b)
+	}
+	return addr
+}
+
+func (c *client) expectError(message string) {
+	b, _ := c.receive(time.Second)
+	if b == nil {
+		c.t.Fatalf("Expected error %q, received nothing", message)
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != packets.ErrorOpcode || string(b[4:len(b)-1]) != message {
+		c.t.Fatalf("Expected error %q, received %q", message, b)
+	}
+}
+
+func expectServed(t *testing.T, served <-chan error, expected error) {
+	select {
+	case err := <-served:
+		if err != expected {
+			t.Errorf("Expected Serve to return %v, got %v", expected, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return")
+	}
+}
+
+func TestServesFilesFromRoot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServer(t, ctx, time.Second)
+
+	c := newClient(t)
+	c.sendReadRequest(server.Addr(), "/file")
+	c.expectData(1)
+
+	c.sendReadRequest(server.Addr(), "missing")
+	c.expectError("File not found")
+
+	c.sendReadRequest(server.Addr(), "../file")
+	c.expectError("Filename leaves the served directory")
+}
+
+func TestWritesAreRefusedUnlessAllowed(t *testing.T) {
+	dir := t.TempDir()
+	root, err := dirfs.NewDirFS(dir, dirfs.FollowWithinRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerWith(t, ctx, &ServerConfig{
+		Listeners: []ListenerConfig{{
+			Address:        "127.0.0.1:0",
+			Root:           root,
+			DefaultTimeout: time.Second,
+			TryLimit:       3,
+		}},
+	})
+
+	c := newClient(t)
+	c.sendWriteRequest(server.Addr(), "upload")
+	c.expectError("Writes not supported")
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected nothing to be created, got %v", entries)
+	}
+}
+
+func TestReadOnlyRootRefusesWrites(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerWith(t, ctx, &ServerConfig{
+		Listeners: []ListenerConfig{{
+			Address:        "127.0.0.1:0",
+			Root:           fstest.MapFS{},
+			AllowWrites:    true,
+			DefaultTimeout: time.Second,
+			TryLimit:       3,
+		}},
+	})
+
+	c := newClient(t)
+	c.sendWriteRequest(server.Addr(), "upload")
+	c.expectError("Writes not supported")
+}
+
+func TestShutdownWithoutSessionsStopsServing(t *testing.T) {
+	server, served := startServer(t, context.Background(), time.Second)
+
+	c := newClient(t)
+	c.sendReadRequest(server.Addr(), "file")
+	transferAddr := c.expectData(1)
+	c.sendAck(transferAddr, 1)
+	c.expectData(2)
+	c.sendAck(transferAddr, 2)
+	c.expectData(3)
+	c.sendAck(transferAddr, 3)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Expected Shutdown to succeed, got %v", err)
+	}
+	expectServed(t, served, ErrServerClosed)
+
+	if err := server.Serve(context.Background()); err != ErrServerClosed {
+		t.Errorf("Expected serving after Shutdown to return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestShutdownBeforeServe(t *testing.T) {
+	server, err := NewServer(&ServerConfig{
+		Listeners: []ListenerConfig{{Address: "127.0.0.1:0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected Shutdown to succeed, got %v", err)
+	}
+	if err := server.Serve(context.Background()); err != ErrServerClosed {
+		t.Errorf("Expected serving after Shutdown to return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestShutdownDrainsActiveSessions(t *testing.T) {
+	server, served := startServer(t, context.Background(), time.Second)
+
+	c := newClient(t)
+	c.sendReadRequest(server.Addr(), "file")
+	transferAddr := c.expectData(1)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	// give Shutdown a moment to stop accepting requests
+	time.Sleep(50 * time.Millisecond)
+
+	latecomer := newClient(t)
+	latecomer.sendReadRequest(server.Addr(), "file")
+	if b, _ := latecomer.receive(100 * time.Millisecond); b != nil {
+		t.Errorf("Expected no reply to a request while shutting down, received %q", b)
+	}
+
+	c.sendAck(transferAddr, 1)
+	c.expectData(2)
+	c.sendAck(transferAddr, 2)
+	c.expectData(3)
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the session finished: %v", err)
+	default:
+		// ok
+	}
+
+	c.sendAck(transferAddr, 3)
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Expected Shutdown to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Shutdown did not return after the session finished")
+	}
+	expectServed(t, served, ErrServerClosed)
+}
+
+func TestShutdownDeadlineAbortsSessions(t *testing.T) {
+	server, served := startServer(t, context.Background(), 10*time.Second)
+
+	c := newClient(t)
+	c.sendReadRequest(server.Addr(), "file")
+	c.expectData(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to give up at its deadline, got %v", err)
+	}
+
+	c.expectError("Server shutting down")
+	expectServed(t, served, ErrServerClosed)
+}
+
+func TestCancellingServeAbortsSessions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server, served := startServer(t, ctx, 10*time.Second)
+
+	c := newClient(t)
+	c.sendReadRequest(server.Addr(), "file")
+	c.expectData(1)
+
+	cancel()
+
+	c.expectError("Server shutting down")
+	expectServed(t, served, context.Canceled)
+}
+
+func requireIPv6(t *testing.T) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 is unavailable: %v", err)
+	}
+	conn.Close()
+}
+
+// Returns a link-local address of an interface that is up, with its zone, for exercising scoped addresses.
+func linkLocalAddr(t *testing.T) *net.UDPAddr {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return &net.UDPAddr{IP: ipNet.IP, Zone: iface.Name}
+			}
+		}
+	}
+
+	t.Skip("No interface has an IPv6 link-local address")
+	return nil
+}
+
+func readWholeFile(t *testing.T, c *client, server net.Addr) net.Addr {
+	c.sendReadRequest(server, "file")
+	transferAddr := c.expectData(1)
+	c.sendAck(transferAddr, 1)
+	c.expectData(2)
+	c.sendAck(transferAddr, 2)
+	c.expectData(3)
+	c.sendAck(transferAddr, 3)
+	return transferAddr
+}
+
+func TestReadOverIPv6(t *testing.T) {
+	requireIPv6(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerOn(t, ctx, "[::1]:0", time.Second)
+
+	transferAddr := readWholeFile(t, newClientOn(t, &net.UDPAddr{IP: net.IPv6loopback}), server.Addr())
+	if !transferAddr.(*net.UDPAddr).IP.Equal(net.IPv6loopback) {
+		t.Errorf("Expected the transfer to come from ::1, came from %v", transferAddr)
+	}
+}
+
+func TestWriteOverIPv6(t *testing.T) {
+	requireIPv6(t)
+	dir := t.TempDir()
+	root, err := dirfs.NewDirFS(dir, dirfs.FollowWithinRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerWith(t, ctx, &ServerConfig{
+		Listeners: []ListenerConfig{{
+			Address:        "[::1]:0",
+			Root:           root,
+			AllowWrites:    true,
+			DefaultTimeout: time.Second,
+			TryLimit:       3,
+		}},
+	})
+
+	c := newClientOn(t, &net.UDPAddr{IP: net.IPv6loopback})
+	c.sendWriteRequest(server.Addr(), "upload")
+	transferAddr := c.expectAck(0)
+	c.sendData(transferAddr, 1, bytes.Repeat([]byte("a"), 512))
+	c.expectAck(1)
+	c.sendData(transferAddr, 2, []byte("bc"))
+	c.expectAck(2)
+
+	written, err := os.ReadFile(filepath.Join(dir, "upload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.Repeat("a", 512) + "bc"; string(written) != expected {
+		t.Errorf("Expected %v bytes to be written, got %q", len(expected), written)
+	}
+}
+
+func TestReadOverIPv6LinkLocal(t *testing.T) {
+	local := linkLocalAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerOn(t, ctx, local.String(), time.Second)
+
+	c := newClientOn(t, local)
+	transferAddr := readWholeFile(t, c, server.Addr()).(*net.UDPAddr)
+	if !transferAddr.IP.Equal(local.IP) || transferAddr.Zone != local.Zone {
+		t.Errorf("Expected the transfer to come from %v, came from %v", local, transferAddr)
+	}
+}
+
+// IPv4 clients of a dual-stack listener appear as IPv4-mapped IPv6 addresses,
+// and must still be recognized when their acks arrive.
+func TestDualStackServesIPv4AndIPv6Clients(t *testing.T) {
+	requireIPv6(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerOn(t, ctx, "[::]:0", time.Second)
+	port := server.Addr().(*net.UDPAddr).Port
+
+	v4 := newClient(t)
+	v6 := newClientOn(t, &net.UDPAddr{IP: net.IPv6loopback})
+
+	v4.sendReadRequest(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, "file")
+	v4Transfer := v4.expectData(1)
+	v6.sendReadRequest(&net.UDPAddr{IP: net.IPv6loopback, Port: port}, "file")
+	v6Transfer := v6.expectData(1)
+
+	for block := uint16(1); block < 3; block++ {
+		v4.sendAck(v4Transfer, block)
+		v4.expectData(block + 1)
+		v6.sendAck(v6Transfer, block)
+		v6.expectData(block + 1)
+	}
+
+	if v4Transfer.(*net.UDPAddr).IP.To4() == nil {
+		t.Errorf("Expected the IPv4 client to be answered over IPv4, was answered from %v", v4Transfer)
+	}
+}
+
+func TestNewServerRequiresListeners(t *testing.T) {
+	if _, err := NewServer(&ServerConfig{}); err != errNoListeners {
+		t.Errorf("Expected errNoListeners, got %v", err)
+	}
+}
+
+func startLabAndProdServer(t *testing.T, ctx context.Context) (*Server, <-chan error) {
+	return startServerWith(t, ctx, &ServerConfig{
+		Listeners: []ListenerConfig{
+			{
+				Address: "127.0.0.1:0",
+				Root: fstest.MapFS{
+					"file":     &fstest.MapFile{Data: bytes.Repeat([]byte("l"), 1200)},
+					"lab-only": &fstest.MapFile{Data: []byte("lab")},
+				},
+				DefaultTimeout: time.Second,
+				TryLimit:       3,
+			},
+			{
+				Address: "127.0.0.1:0",
+				Root: fstest.MapFS{
+					"file": &fstest.MapFile{Data: bytes.Repeat([]byte("p"), 1200)},
+				},
+				DefaultTimeout: time.Second,
+				TryLimit:       3,
+				MaxBlockSize:   600,
+			},
+		},
+	})
+}
+
+func TestListenersServeTheirOwnRoots(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startLabAndProdServer(t, ctx)
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf("Expected 2 addresses, got %v", addrs)
+	}
+
+	lab := newClient(t)
+	lab.sendReadRequest(addrs[0], "file")
+	if b, _ := lab.receive(time.Second); b == nil || b[4] != 'l' {
+		t.Errorf("Expected the lab file, received %q", b)
+	}
+
+	prod := newClient(t)
+	prod.sendReadRequest(addrs[1], "file")
+	if b, _ := prod.receive(time.Second); b == nil || b[4] != 'p' {
+		t.Errorf("Expected the production file, received %q", b)
+	}
+
+	prod.sendReadRequest(addrs[1], "lab-only")
+	prod.expectError("File not found")
+}
+
+func TestListenersHaveTheirOwnBlockSizePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startLabAndProdServer(t, ctx)
+
+	for i, expected := range []string{"1024", "600"} {
+		c := newClient(t)
+		b := &bytes.Buffer{}
+		binary.Write(b, binary.BigEndian, packets.ReadOpcode)
+		b.WriteString("file\x00octet\x00blksize\x001024\x00")
+		if _, err := c.conn.WriteTo(b.Bytes(), server.Addrs()[i]); err != nil {
+			t.Fatal(err)
+		}
+
+		reply, _ := c.receive(time.Second)
+		if expectedReply := "\x00\x06blksize\x00" + expected + "\x00"; string(reply) != expectedReply {
+			t.Errorf("Expected listener %v to answer %q, received %q", i, expectedReply, reply)
+		}
+	}
+}
+
+func TestShutdownDrainsSessionsOfEveryListener(t *testing.T) {
+	server, served := startLabAndProdServer(t, context.Background())
+
+	clients := []*client{newClient(t), newClient(t)}
+	transferAddrs := make([]net.Addr, len(clients))
+	for i, c := range clients {
+		c.sendReadRequest(server.Addrs()[i], "file")
+		transferAddrs[i] = c.expectData(1)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	for i, c := range clients {
+		for block := uint16(1); block < 3; block++ {
+			c.sendAck(transferAddrs[i], block)
+			c.expectData(block + 1)
+		}
+	}
+
+	clients[0].sendAck(transferAddrs[0], 3)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the second listener's session finished: %v", err)
+	default:
+		// ok
+	}
+
+	clients[1].sendAck(transferAddrs[1], 3)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("Expected Shutdown to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Shutdown did not return after every session finished")
+	}
+	expectServed(t, served, ErrServerClosed)
+}
+
+func limitedServerConfig(limits sessionlimiter.Limits) *ServerConfig {
+	return &ServerConfig{
+		Listeners: []ListenerConfig{{
+			Address: "127.0.0.1:0",
+			Root: fstest.MapFS{
+				"file": &fstest.MapFile{Data: bytes.Repeat([]byte("x"), 1200)},
+			},
+			DefaultTimeout: time.Second,
+			TryLimit:       3,
+		}},
+		SessionLimits: limits,
+	}
+}
+
+func TestSessionLimitsRefuseRequestsOverTheCap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := limitedServerConfig(sessionlimiter.Limits{PerClient: 1})
+	limited := make(chan *sessioncreator.SessionLimited, 1)
+	config.OnSessionLimited = func(l *sessioncreator.SessionLimited) {
+		limited <- l
+	}
+	server, _ := startServerWith(t, ctx, config)
+
+	first := newClient(t)
+	first.sendReadRequest(server.Addr(), "file")
+	first.expectData(1)
+
+	// every client is on 127.0.0.1
+	second := newClient(t)
+	second.sendReadRequest(server.Addr(), "file")
+	second.expectError("Too many transfers from this client")
+
+	select {
+	case l := <-limited:
+		if l.Reason != sessionlimiter.ErrTooManyClientSessions {
+			t.Errorf("Expected the refusal to be reported as ErrTooManyClientSessions, got %v", l.Reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Refusal was not reported")
+	}
+
+	if stats := server.SessionStats(); stats.Active != 1 || stats.Refused != 1 {
+		t.Errorf("Expected 1 active session and 1 refusal, got %+v", stats)
+	}
+}
+
+func TestRequestsOverTheCapWaitForASlot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerWith(t, ctx, limitedServerConfig(sessionlimiter.Limits{
+		Total:        1,
+		QueueTimeout: 5 * time.Second,
+		QueueLength:  1,
+	}))
+
+	first := newClient(t)
+	first.sendReadRequest(server.Addr(), "file")
+	transferAddr := first.expectData(1)
+
+	second := newClient(t)
+	second.sendReadRequest(server.Addr(), "file")
+	if b, _ := second.receive(50 * time.Millisecond); b != nil {
+		t.Fatalf("Expected the second request to wait, received %q", b)
+	}
+	if queued := server.SessionStats().Queued; queued != 1 {
+		t.Errorf("Expected 1 queued request, got %v", queued)
+	}
+
+	first.sendAck(transferAddr, 1)
+	first.expectData(2)
+	first.sendAck(transferAddr, 2)
+	first.expectData(3)
+	first.sendAck(transferAddr, 3)
+
+	second.expectData(1)
+}
+
+func TestCancellingServeRefusesQueuedRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server, served := startServerWith(t, ctx, limitedServerConfig(sessionlimiter.Limits{
+		Total:        1,
+		QueueTimeout: 5 * time.Second,
+		QueueLength:  1,
+	}))
+
+	first := newClient(t)
+	first.sendReadRequest(server.Addr(), "file")
+	first.expectData(1)
+
+	second := newClient(t)
+	second.sendReadRequest(server.Addr(), "file")
+	for server.SessionStats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+
+	first.expectError("Server shutting down")
+	second.expectError("Server shutting down")
+	expectServed(t, served, context.Canceled)
+}
+
+func TestRetransmittedReadRequestIsAnsweredByTheSameTransfer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServer(t, ctx, time.Second)
+
+	c := newClient(t)
+	c.sendReadRequest(server.Addr(), "file")
+	transferAddr := c.expectData(1)
+
+	c.sendReadRequest(server.Addr(), "file")
+	if resentFrom := c.expectData(1); resentFrom.String() != transferAddr.String() {
+		t.Fatalf("Expected data 1 to be resent from %v, came from %v", transferAddr, resentFrom)
+	}
+
+	c.sendAck(transferAddr, 1)
+	c.expectData(2)
+	c.sendAck(transferAddr, 2)
+	c.expectData(3)
+	c.sendAck(transferAddr, 3)
+
+	deadline := time.Now().Add(time.Second)
+	for server.SessionStats().Active != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no session to be left over, %v are active", server.SessionStats().Active)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func rejectingServerConfig(policy safepacketprovider.InvalidTransmissionPolicy, rejected chan<- *safetyfilter.IncomingInvalidMessage) *ServerConfig {
+	return &ServerConfig{
+		Listeners: []ListenerConfig{{
+			Address: "127.0.0.1:0",
+			Root: fstest.MapFS{
+				"file": &fstest.MapFile{Data: []byte("x")},
+			},
+			DefaultTimeout: time.Second,
+			TryLimit:       3,
+		}},
+		OnInvalidMessage: func(i *safetyfilter.IncomingInvalidMessage) {
+			rejected <- i
+		},
+		InvalidTransmissionPolicy: policy,
+	}
+}
+
+func (c *client) sendBadModeReadRequest(to net.Addr) {
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.BigEndian, packets.ReadOpcode)
+	b.WriteString("file\x00x\x00")
+	if _, err := c.conn.WriteTo(b.Bytes(), to); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func TestRejectedRequestsAreAnsweredWithoutStallingTheListener(t *testing.T) {
+	const badRequests = 5
+	rejected := make(chan *safetyfilter.IncomingInvalidMessage, badRequests)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerWith(t, ctx, rejectingServerConfig(safepacketprovider.InvalidTransmissionPolicy{Reply: true}, rejected))
+
+	c := newClient(t)
+	for i := 0; i < badRequests; i++ {
+		c.sendBadModeReadRequest(server.Addr())
+		c.expectError("Invalid mode string")
+	}
+
+	c.sendReadRequest(server.Addr(), "file")
+	c.expectData(1)
+
+	for i := 0; i < badRequests; i++ {
+		select {
+		case r := <-rejected:
+			if r.ErrorMessage != "Invalid mode string" {
+				t.Errorf("OnInvalidMessage was called with %q", r.ErrorMessage)
+			}
+		default:
+			t.Fatalf("OnInvalidMessage was called for %v of %v rejected requests", i, badRequests)
+		}
+	}
+}
+
+func TestRejectedRequestsFollowInvalidTransmissionPolicy(t *testing.T) {
+	const badRequests = 5
+	rejected := make(chan *safetyfilter.IncomingInvalidMessage, badRequests)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, _ := startServerWith(t, ctx, rejectingServerConfig(safepacketprovider.InvalidTransmissionPolicy{
+		Reply:         true,
+		ReplyLimit:    2,
+		ReplyInterval: time.Hour,
+	}, rejected))
+
+	c := newClient(t)
+	for i := 0; i < badRequests; i++ {
+		c.sendBadModeReadRequest(server.Addr())
+	}
+	c.expectError("Invalid mode string")
+	c.expectError("Invalid mode string")
+
+	// the listener still serves valid requests, whose data is the next thing the client receives
+	c.sendReadRequest(server.Addr(), "file")
+	c.expectData(1)
+
+	deadline := time.Now().Add(time.Second)
+	for len(rejected) != badRequests {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected OnInvalidMessage to be called for every rejected request, was called %v times", len(rejected))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,75 @@
+package sessioncreator
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/mark-rushakoff/go_tftpd/dirfs"
+	"github.com/mark-rushakoff/go_tftpd/pathresolver"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+// CreateFS is a file system that write requests can create new files in, such as dirfs.DirFS.
+type CreateFS interface {
+	fs.FS
+	Create(name string) (io.WriteCloser, error)
+}
+
+// discarder is implemented by writers whose file only appears once they are closed, such as those of dirfs.DirFS.
+// Transfers that do not complete discard their writer, so that they leave nothing behind.
+type discarder interface {
+	Discard() error
+}
+
+var errWritesNotSupported = errors.New("Writes not supported")
+
+// errorFromOpenError chooses the error to send when a file cannot be opened.
+// Refusals of our own making explain themselves without revealing anything about the server, so their messages are passed on.
+func errorFromOpenError(err error) *safepackets.SafeError {
+	for _, refusal := range []error{
+		pathresolver.ErrInvalidFilename,
+		pathresolver.ErrOutsideRoot,
+		dirfs.ErrSymlink,
+		errWritesNotSupported,
+	} {
+		if errors.Is(err, refusal) {
+			return safepackets.NewAccessViolationError(refusal.Error())
+		}
+	}
+
+	return safepackets.NewErrorFromFileError(err, safepackets.NewOpenFailedError())
+}
+
+// ReaderFromFS opens files for read requests through fsys, confining filenames to its root as pathresolver.Resolve does.
+func ReaderFromFS(fsys fs.FS) ReaderFromFilename {
+	return func(filename string) (io.Reader, error) {
+		name, err := pathresolver.Resolve(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		return fsys.Open(name)
+	}
+}
+
+func refuseWrites(string) (io.Writer, error) {
+	return nil, errWritesNotSupported
+}
+
+// WriterFromFS creates files for write requests through fsys; write requests are refused unless fsys is a CreateFS.
+func WriterFromFS(fsys fs.FS) WriterFromFilename {
+	return func(filename string) (io.Writer, error) {
+		createFS, ok := fsys.(CreateFS)
+		if !ok {
+			return nil, errWritesNotSupported
+		}
+
+		name, err := pathresolver.Resolve(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		return createFS.Create(name)
+	}
+}
@@ -0,0 +1,128 @@
+package sessioncreator
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/mark-rushakoff/go_tftpd/dirfs"
+	"github.com/mark-rushakoff/go_tftpd/pathresolver"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+func TestReaderFromFSOpensFilesRelativeToRoot(t *testing.T) {
+	fsys := fstest.MapFS{
+		"boot/pxelinux.0": &fstest.MapFile{Data: []byte("bootloader")},
+	}
+	readerFactory := ReaderFromFS(fsys)
+
+	for _, filename := range []string{"boot/pxelinux.0", "/boot/pxelinux.0", "boot/./pxelinux.0"} {
+		reader, err := readerFactory(filename)
+		if err != nil {
+			t.Errorf("Expected to open %q, got %v", filename, err)
+			continue
+		}
+
+		content, _ := io.ReadAll(reader)
+		if string(content) != "bootloader" {
+			t.Errorf("Read wrong content for %q: %q", filename, content)
+		}
+	}
+
+	if _, err := readerFactory("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected missing file to fail with ErrNotExist, got %v", err)
+	}
+}
+
+func TestFromFSConfinesFilenamesToRoot(t *testing.T) {
+	fsys := &recordingCreateFS{
+		MapFS:   fstest.MapFS{"foo": &fstest.MapFile{Data: []byte("foo")}},
+		created: make(map[string]*closeRecordingWriter),
+	}
+
+	if _, err := ReaderFromFS(fsys)("../foo"); err != pathresolver.ErrOutsideRoot {
+		t.Errorf("Expected reading outside the root to be refused, got %v", err)
+	}
+
+	if _, err := WriterFromFS(fsys)("../foo"); err != pathresolver.ErrOutsideRoot {
+		t.Errorf("Expected writing outside the root to be refused, got %v", err)
+	}
+	if len(fsys.created) != 0 {
+		t.Errorf("Expected nothing to be created, created %v", fsys.created)
+	}
+}
+
+func TestOpenErrorsDoNotRevealServerDetails(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected *safepackets.SafeError
+	}{
+		{pathresolver.ErrOutsideRoot, safepackets.NewAccessViolationError("Filename leaves the served directory")},
+		{pathresolver.ErrInvalidFilename, safepackets.NewAccessViolationError("Invalid filename")},
+		{errWritesNotSupported, safepackets.NewAccessViolationError("Writes not supported")},
+		{&fs.PathError{Op: "open", Path: "link", Err: dirfs.ErrSymlink}, safepackets.NewAccessViolationError("Symlinks are not followed")},
+		{&fs.PathError{Op: "open", Path: "/srv/tftp/missing", Err: fs.ErrNotExist}, safepackets.NewFileNotFoundError()},
+		{&fs.PathError{Op: "create", Path: "/srv/tftp/existing", Err: fs.ErrExist}, safepackets.NewFileAlreadyExistsError()},
+		{&fs.PathError{Op: "open", Path: "/srv/tftp/private", Err: fs.ErrPermission}, safepackets.NewAccessViolationError("Permission denied")},
+		{errors.New("openat /srv/tftp/boot: path escapes from parent"), safepackets.NewOpenFailedError()},
+	}
+
+	for _, c := range cases {
+		e := errorFromOpenError(c.err)
+		if !e.Equals(c.expected) {
+			t.Errorf("For %v: expected %v %q, got %v %q", c.err, c.expected.Code, c.expected.Message, e.Code, e.Message)
+		}
+	}
+}
+
+func TestReaderFromFSAnswersTransferSize(t *testing.T) {
+	fsys := fstest.MapFS{
+		"foo": &fstest.MapFile{Data: []byte("12345")},
+	}
+
+	reader, err := ReaderFromFS(fsys)("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, ok := transferSize(reader)
+	if !ok || size != 5 {
+		t.Errorf("Expected transfer size 5, got %v (ok: %v)", size, ok)
+	}
+}
+
+type recordingCreateFS struct {
+	fstest.MapFS
+	created map[string]*closeRecordingWriter
+}
+
+func (f *recordingCreateFS) Create(name string) (io.WriteCloser, error) {
+	w := &closeRecordingWriter{}
+	f.created[name] = w
+	return w, nil
+}
+
+func TestWriterFromFSCreatesFilesRelativeToRoot(t *testing.T) {
+	fsys := &recordingCreateFS{created: make(map[string]*closeRecordingWriter)}
+
+	writer, err := WriterFromFS(fsys)("/upload/foo")
+	if err != nil {
+		t.Fatalf("Expected to create file, got %v", err)
+	}
+
+	if writer != fsys.created["upload/foo"] {
+		t.Errorf("Expected file to be created as upload/foo, created %v", fsys.created)
+	}
+}
+
+func TestWriterFromFSRefusesReadOnlyFS(t *testing.T) {
+	_, err := WriterFromFS(fstest.MapFS{})("foo")
+	if err == nil {
+		t.Fatalf("Expected a read-only file system to refuse writes")
+	}
+	if err.Error() != "Writes not supported" {
+		t.Errorf("Wrong error for read-only file system: %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package sessioncreator
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+// RFC 7440 lets the server answer with a smaller window than requested;
+// this bounds how many blocks a single read session buffers.
+const maxWindowSize uint16 = 64
+
+type negotiatedOptions struct {
+	blockSize  uint16
+	timeout    time.Duration
+	windowSize uint16
+
+	// nil when no options were accepted, in which case the session proceeds as plain RFC 1350
+	optionAck *safepackets.SafeOptionAck
+}
+
+// statter is implemented by *os.File, which lets the tsize option be answered for files on disk.
+type statter interface {
+	Stat() (os.FileInfo, error)
+}
+
+func negotiateReadOptions(requested safepackets.RequestOptions, timeoutPolicy TimeoutPolicy, blockSizePolicy BlockSizePolicy, reader io.Reader) *negotiatedOptions {
+	negotiated, accepted := negotiateCommonOptions(requested, timeoutPolicy, blockSizePolicy)
+
+	if requested.WindowSize != 0 {
+		negotiated.windowSize = requested.WindowSize
+		if negotiated.windowSize > maxWindowSize {
+			negotiated.windowSize = maxWindowSize
+		}
+		accepted[packets.WindowSizeOption] = strconv.Itoa(int(negotiated.windowSize))
+	}
+
+	if requested.TransferSizeRequested {
+		// the option is left out of the OACK when the reader cannot tell us its size
+		if size, ok := transferSize(reader); ok {
+			accepted[packets.TransferSizeOption] = strconv.FormatInt(size, 10)
+		}
+	}
+
+	negotiated.setOptionAck(accepted)
+	return negotiated
+}
+
+// Write sessions are always lock-step, so a requested window size is not acknowledged.
+func negotiateWriteOptions(requested safepackets.RequestOptions, timeoutPolicy TimeoutPolicy, blockSizePolicy BlockSizePolicy) *negotiatedOptions {
+	negotiated, accepted := negotiateCommonOptions(requested, timeoutPolicy, blockSizePolicy)
+	negotiated.setOptionAck(accepted)
+	return negotiated
+}
+
+func negotiateCommonOptions(requested safepackets.RequestOptions, timeoutPolicy TimeoutPolicy, blockSizePolicy BlockSizePolicy) (*negotiatedOptions, map[string]string) {
+	negotiated := &negotiatedOptions{
+		blockSize:  packets.DefaultBlockSize,
+		timeout:    timeoutPolicy.Default,
+		windowSize: 1,
+	}
+	accepted := make(map[string]string)
+
+	if requested.BlockSize != 0 {
+		// unlike the timeout, RFC 2348 lets the server answer with a smaller block size than requested
+		negotiated.blockSize = blockSizePolicy.clamp(requested.BlockSize)
+		accepted[packets.BlockSizeOption] = strconv.Itoa(int(negotiated.blockSize))
+	}
+
+	if requested.Timeout != 0 {
+		negotiated.timeout = timeoutPolicy.clamp(requested.Timeout)
+
+		// RFC 2349 requires the acknowledged timeout to match the request exactly,
+		// so a clamped timeout is used for our retransmissions but not acknowledged
+		if negotiated.timeout == requested.Timeout {
+			accepted[packets.TimeoutOption] = strconv.Itoa(int(requested.Timeout / time.Second))
+		}
+	}
+
+	return negotiated, accepted
+}
+
+func (n *negotiatedOptions) setOptionAck(accepted map[string]string) {
+	if len(accepted) > 0 {
+		n.optionAck = safepackets.NewSafeOptionAck(accepted)
+	}
+}
+
+func transferSize(reader io.Reader) (size int64, ok bool) {
+	s, isStatter := reader.(statter)
+	if !isStatter {
+		return 0, false
+	}
+
+	info, err := s.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return 0, false
+	}
+
+	return info.Size(), true
+}
+
+func (p TimeoutPolicy) clamp(timeout time.Duration) time.Duration {
+	if p.Min != 0 && timeout < p.Min {
+		return p.Min
+	}
+
+	if p.Max != 0 && timeout > p.Max {
+		return p.Max
+	}
+
+	return timeout
+}
+
+func (p BlockSizePolicy) clamp(blockSize uint16) uint16 {
+	if p.Max != 0 && blockSize > p.Max {
+		return p.Max
+	}
+
+	return blockSize
+}
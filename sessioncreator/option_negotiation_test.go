@@ -0,0 +1,181 @@
+package sessioncreator
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+var defaultTimeoutPolicy = TimeoutPolicy{Default: time.Second}
+
+func TestNoOptionsMeansNoOptionAck(t *testing.T) {
+	negotiated := negotiateReadOptions(safepackets.RequestOptions{}, defaultTimeoutPolicy, BlockSizePolicy{}, strings.NewReader("foobar"))
+
+	if negotiated.optionAck != nil {
+		t.Errorf("Expected no option ack, got %v", negotiated.optionAck.Options)
+	}
+
+	if negotiated.blockSize != 512 {
+		t.Errorf("Expected default block size of 512, got %v", negotiated.blockSize)
+	}
+}
+
+func TestTransferSizeIsAnsweredFromFileStat(t *testing.T) {
+	file, err := ioutil.TempFile("", "tsize")
+	if err != nil {
+		t.Fatalf("Could not create temp file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	file.WriteString("foobar")
+
+	requested := safepackets.RequestOptions{TransferSizeRequested: true}
+	negotiated := negotiateReadOptions(requested, defaultTimeoutPolicy, BlockSizePolicy{}, file)
+
+	expected := safepackets.NewSafeOptionAck(map[string]string{"tsize": "6"})
+	if negotiated.optionAck == nil || !negotiated.optionAck.Equals(expected) {
+		t.Errorf("Expected option ack %v, got %v", expected, negotiated.optionAck)
+	}
+}
+
+func TestTransferSizeIsOmittedWhenSizeIsUnknown(t *testing.T) {
+	requested := safepackets.RequestOptions{TransferSizeRequested: true, BlockSize: 1024}
+	negotiated := negotiateReadOptions(requested, defaultTimeoutPolicy, BlockSizePolicy{}, strings.NewReader("foobar"))
+
+	expected := safepackets.NewSafeOptionAck(map[string]string{"blksize": "1024"})
+	if negotiated.optionAck == nil || !negotiated.optionAck.Equals(expected) {
+		t.Errorf("Expected option ack %v, got %v", expected, negotiated.optionAck)
+	}
+}
+
+func TestTransferSizeOnlyRequestWithUnknownSizeMeansNoOptionAck(t *testing.T) {
+	requested := safepackets.RequestOptions{TransferSizeRequested: true}
+	negotiated := negotiateReadOptions(requested, defaultTimeoutPolicy, BlockSizePolicy{}, strings.NewReader("foobar"))
+
+	if negotiated.optionAck != nil {
+		t.Errorf("Expected no option ack, got %v", negotiated.optionAck.Options)
+	}
+}
+
+func TestTimeoutIsAcknowledgedWithinPolicy(t *testing.T) {
+	policy := TimeoutPolicy{Default: time.Second, Min: time.Second, Max: 30 * time.Second}
+	requested := safepackets.RequestOptions{Timeout: 10 * time.Second}
+	negotiated := negotiateWriteOptions(requested, policy, BlockSizePolicy{})
+
+	if negotiated.timeout != 10*time.Second {
+		t.Errorf("Expected timeout of 10s, got %v", negotiated.timeout)
+	}
+
+	expected := safepackets.NewSafeOptionAck(map[string]string{"timeout": "10"})
+	if negotiated.optionAck == nil || !negotiated.optionAck.Equals(expected) {
+		t.Errorf("Expected option ack %v, got %v", expected, negotiated.optionAck)
+	}
+}
+
+func TestTimeoutIsClampedButNotAcknowledgedOutsidePolicy(t *testing.T) {
+	policy := TimeoutPolicy{Default: time.Second, Min: 2 * time.Second, Max: 30 * time.Second}
+
+	type testCase struct {
+		requested time.Duration
+		expected  time.Duration
+	}
+
+	testCases := []testCase{
+		{time.Second, 2 * time.Second},
+		{255 * time.Second, 30 * time.Second},
+	}
+
+	for _, testCase := range testCases {
+		requested := safepackets.RequestOptions{Timeout: testCase.requested}
+		negotiated := negotiateReadOptions(requested, policy, BlockSizePolicy{}, strings.NewReader("foobar"))
+
+		if negotiated.timeout != testCase.expected {
+			t.Errorf("Expected timeout of %v for request of %v, got %v", testCase.expected, testCase.requested, negotiated.timeout)
+		}
+
+		if negotiated.optionAck != nil {
+			t.Errorf("Expected no option ack for clamped timeout, got %v", negotiated.optionAck.Options)
+		}
+	}
+}
+
+func TestUnrequestedTimeoutUsesPolicyDefault(t *testing.T) {
+	policy := TimeoutPolicy{Default: 3 * time.Second, Min: 5 * time.Second}
+	negotiated := negotiateWriteOptions(safepackets.RequestOptions{}, policy, BlockSizePolicy{})
+
+	if negotiated.timeout != 3*time.Second {
+		t.Errorf("Expected default timeout of 3s, got %v", negotiated.timeout)
+	}
+}
+
+func TestWindowSizeIsAcknowledgedForReads(t *testing.T) {
+	requested := safepackets.RequestOptions{WindowSize: 8}
+	negotiated := negotiateReadOptions(requested, defaultTimeoutPolicy, BlockSizePolicy{}, strings.NewReader("foobar"))
+
+	if negotiated.windowSize != 8 {
+		t.Errorf("Expected window size of 8, got %v", negotiated.windowSize)
+	}
+
+	expected := safepackets.NewSafeOptionAck(map[string]string{"windowsize": "8"})
+	if negotiated.optionAck == nil || !negotiated.optionAck.Equals(expected) {
+		t.Errorf("Expected option ack %v, got %v", expected, negotiated.optionAck)
+	}
+}
+
+func TestLargeWindowSizeIsReduced(t *testing.T) {
+	requested := safepackets.RequestOptions{WindowSize: 65535}
+	negotiated := negotiateReadOptions(requested, defaultTimeoutPolicy, BlockSizePolicy{}, strings.NewReader("foobar"))
+
+	if negotiated.windowSize != maxWindowSize {
+		t.Errorf("Expected window size of %v, got %v", maxWindowSize, negotiated.windowSize)
+	}
+
+	expected := safepackets.NewSafeOptionAck(map[string]string{"windowsize": "64"})
+	if negotiated.optionAck == nil || !negotiated.optionAck.Equals(expected) {
+		t.Errorf("Expected option ack %v, got %v", expected, negotiated.optionAck)
+	}
+}
+
+func TestWindowSizeIsNotAcknowledgedForWrites(t *testing.T) {
+	requested := safepackets.RequestOptions{WindowSize: 8}
+	negotiated := negotiateWriteOptions(requested, defaultTimeoutPolicy, BlockSizePolicy{})
+
+	if negotiated.windowSize != 1 {
+		t.Errorf("Expected window size of 1, got %v", negotiated.windowSize)
+	}
+
+	if negotiated.optionAck != nil {
+		t.Errorf("Expected no option ack, got %v", negotiated.optionAck.Options)
+	}
+}
+
+func TestBlockSizeIsReducedToPolicyMax(t *testing.T) {
+	policy := BlockSizePolicy{Max: 1428}
+	testCases := []struct {
+		requested uint16
+		expected  uint16
+	}{
+		{1024, 1024},
+		{1428, 1428},
+		{65464, 1428},
+	}
+
+	for _, testCase := range testCases {
+		requested := safepackets.RequestOptions{BlockSize: testCase.requested}
+		negotiated := negotiateWriteOptions(requested, defaultTimeoutPolicy, policy)
+
+		if negotiated.blockSize != testCase.expected {
+			t.Errorf("Expected block size of %v for request of %v, got %v", testCase.expected, testCase.requested, negotiated.blockSize)
+		}
+
+		expected := safepackets.NewSafeOptionAck(map[string]string{"blksize": strconv.Itoa(int(testCase.expected))})
+		if negotiated.optionAck == nil || !negotiated.optionAck.Equals(expected) {
+			t.Errorf("Expected option ack %v, got %v", expected, negotiated.optionAck)
+		}
+	}
+}
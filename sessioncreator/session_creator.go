@@ -3,64 +3,576 @@ package sessioncreator
 import (
 	"io"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 
+	"github.com/mark-rushakoff/go_tftpd/accesscontrol"
+	"github.com/mark-rushakoff/go_tftpd/clientaddr"
+	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/pathresolver"
 	"github.com/mark-rushakoff/go_tftpd/readsession"
 	"github.com/mark-rushakoff/go_tftpd/readsessioncollection"
 	"github.com/mark-rushakoff/go_tftpd/safepackets"
 	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
+	"github.com/mark-rushakoff/go_tftpd/sessionlimiter"
 	"github.com/mark-rushakoff/go_tftpd/timeoutcontroller"
+	"github.com/mark-rushakoff/go_tftpd/writesession"
+	"github.com/mark-rushakoff/go_tftpd/writesessioncollection"
 )
 
+// OutgoingHandler can send every packet needed by both read and write sessions.
+type OutgoingHandler interface {
+	SendAck(*safepackets.SafeAck)
+	SendData(*safepackets.SafeData)
+	SendError(*safepackets.SafeError)
+	SendOptionAck(*safepackets.SafeOptionAck)
+}
+
+// Transfer is the connection dedicated to a single session. Its local port is the server's transfer ID (RFC 1350).
+// Nothing is read from it until Receive, which is told the largest block the client's data packets may carry.
+type Transfer interface {
+	OutgoingHandler
+	Receive(blockSize uint16)
+	Close() error
+}
+
 type ReaderFromFilename func(filename string) (io.Reader, error)
-type OutgoingHandlerFromAddr func(net.Addr) readsession.OutgoingHandler
+type WriterFromFilename func(filename string) (io.Writer, error)
+
+// TransferFromAddr opens a transfer to clientAddr; when valid, localAddr is where the client sent its request,
+// and the transfer should reply from it.
+type TransferFromAddr func(clientAddr net.Addr, localAddr netip.Addr) (Transfer, error)
+
+// TimeoutPolicy decides how long a session waits before retransmitting.
+// Clients may ask for a different timeout with the RFC 2349 timeout option;
+// requests are clamped to Min and Max, where a zero bound means unbounded.
+type TimeoutPolicy struct {
+	Default time.Duration
+	Min     time.Duration
+	Max     time.Duration
+}
+
+// BlockSizePolicy bounds the block size a client may request with the RFC 2348 blksize option,
+// e.g. so that blocks fit in a network's MTU. Larger requests are answered with Max; zero means unbounded.
+type BlockSizePolicy struct {
+	Max uint16
+}
+
+type Config struct {
+	ReaderFactory ReaderFromFilename
+
+	// Creates the files of write requests; nil refuses every write request
+	WriterFactory WriterFromFilename
+
+	TransferFactory TransferFromAddr
+	TimeoutPolicy   TimeoutPolicy
+	BlockSizePolicy BlockSizePolicy
+
+	// How many tries to use when sending a packet until giving up
+	TryLimit uint
+
+	// How block numbers wrap after block 65535, for transfers larger than 65535 blocks
+	BlockSequence safepackets.BlockSequence
+
+	// Requests are checked against AccessList before any file is opened; nil allows every request
+	AccessList *accesscontrol.AccessList
+
+	// Called with every request refused by AccessList, after the client has been sent an error; may be nil
+	OnAccessDenied func(*AccessDenied)
+
+	// Every session holds a slot of SessionLimiter until it ends, and requests it cannot fit are refused; nil is unlimited
+	SessionLimiter *sessionlimiter.SessionLimiter
+
+	// Prefixes the files counted against SessionLimiter's per-file limit, so that creators serving different roots
+	// from one limiter do not count each other's files; may be empty
+	SessionLimiterScope string
+
+	// Called with every request refused by SessionLimiter, after the client has been sent an error; may be nil
+	OnSessionLimited func(*SessionLimited)
+
+	// Called with every session the client aborted by sending an error, once the session has ended; may be nil
+	OnClientError func(*ClientError)
+}
+
+// AccessDenied describes a request refused by the access list.
+type AccessDenied struct {
+	Addr      net.Addr
+	Operation accesscontrol.Operation
+	Filename  string
+}
+
+// SessionLimited describes a request refused by the session limiter.
+type SessionLimited struct {
+	Addr      net.Addr
+	Operation accesscontrol.Operation
+	Filename  string
+
+	// One of the limit errors of package sessionlimiter
+	Reason error
+}
+
+// ClientError describes a session the client aborted by sending an error.
+type ClientError struct {
+	Addr      net.Addr
+	Operation accesscontrol.Operation
+	Filename  string
+	Error     *safepackets.SafeError
+}
 
 type SessionCreator struct {
-	readSessions           *readsessioncollection.ReadSessionCollection
-	readerFactory          ReaderFromFilename
-	outgoingHandlerFactory OutgoingHandlerFromAddr
-	timeout                time.Duration
-	tryLimit               uint
+	readSessions  *readsessioncollection.ReadSessionCollection
+	writeSessions *writesessioncollection.WriteSessionCollection
+	config        *Config
+
+	// Held while starting a session, as requests that waited for a session slot start on their own goroutines
+	mutex  sync.Mutex
+	closed bool
+
+	// The request each client has waiting for a session slot, if any
+	waiting map[clientaddr.Key]*waiter
 }
 
 func NewSessionCreator(
 	readSessions *readsessioncollection.ReadSessionCollection,
-	readerFactory ReaderFromFilename,
-	outgoingHandlerFactory OutgoingHandlerFromAddr,
-	timeout time.Duration,
-	tryLimit uint,
+	writeSessions *writesessioncollection.WriteSessionCollection,
+	config *Config,
 ) *SessionCreator {
 	return &SessionCreator{
-		readSessions:           readSessions,
-		readerFactory:          readerFactory,
-		outgoingHandlerFactory: outgoingHandlerFactory,
-		timeout:                timeout,
-		tryLimit:               tryLimit,
+		readSessions:  readSessions,
+		writeSessions: writeSessions,
+		config:        config,
+		waiting:       make(map[clientaddr.Key]*waiter),
+	}
+}
+
+// activeRead is what the creator keeps in the read session collection,
+// so that later requests from the same client can be compared with the one that started the session.
+type activeRead struct {
+	timeoutcontroller.TimeoutController
+	request    *safepackets.SafeReadRequest
+	endSession func()
+}
+
+type activeWrite struct {
+	timeoutcontroller.WriteTimeoutController
+	request    *safepackets.SafeWriteRequest
+	endSession func()
+}
+
+// CreateRead starts a session for r, unless r retransmits the request of the client's current read session,
+// in which case that session answers it instead. Any other session of the client is ended first,
+// as a client's address identifies a single transfer.
+// A request waiting for a session slot is answered once it starts, so its retransmissions are ignored meanwhile.
+func (c *SessionCreator) CreateRead(r *safetyfilter.IncomingSafeReadRequest) {
+	c.startWithinLimits(
+		request{accesscontrol.Read, r.Addr, r.LocalAddr, r.Read.Filename, *r.Read},
+		func() bool {
+			return c.handledByActiveRead(r)
+		},
+		func(release func()) bool {
+			return c.createRead(r, release)
+		},
+	)
+}
+
+// CreateWrite is CreateRead for write requests.
+func (c *SessionCreator) CreateWrite(w *safetyfilter.IncomingSafeWriteRequest) {
+	c.startWithinLimits(
+		request{accesscontrol.Write, w.Addr, w.LocalAddr, w.Write.Filename, *w.Write},
+		func() bool {
+			return c.handledByActiveWrite(w)
+		},
+		func(release func()) bool {
+			return c.createWrite(w, release)
+		},
+	)
+}
+
+// Close keeps requests still waiting for a session slot from starting; they are told the server is shutting down.
+// Sessions that already started are unaffected.
+func (c *SessionCreator) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+}
+
+// handledByActiveRead resends the first packet of the client's read session if r is a duplicate of its request,
+// and otherwise ends whatever session the client has.
+func (c *SessionCreator) handledByActiveRead(r *safetyfilter.IncomingSafeReadRequest) bool {
+	if session, found := c.readSessions.Fetch(r.Addr); found {
+		if active, ok := session.(*activeRead); ok && *active.request == *r.Read {
+			session.HandleDuplicateRequest()
+			return true
+		}
 	}
+
+	c.endSessionsOf(r.Addr)
+	return false
 }
 
-func (c *SessionCreator) Create(r *safetyfilter.IncomingSafeReadRequest) {
-	reader, err := c.readerFactory(r.Read.Filename)
+func (c *SessionCreator) handledByActiveWrite(w *safetyfilter.IncomingSafeWriteRequest) bool {
+	if session, found := c.writeSessions.Fetch(w.Addr); found {
+		if active, ok := session.(*activeWrite); ok && *active.request == *w.Write {
+			session.HandleDuplicateRequest()
+			return true
+		}
+	}
+
+	c.endSessionsOf(w.Addr)
+	return false
+}
+
+// endSessionsOf ends the sessions of the client at addr without telling it, as it has moved on to a new request.
+func (c *SessionCreator) endSessionsOf(addr net.Addr) {
+	if session, found := c.readSessions.Fetch(addr); found {
+		if active, ok := session.(*activeRead); ok {
+			active.endSession()
+		} else {
+			session.Cancel()
+			c.readSessions.Remove(addr)
+		}
+	}
+
+	if session, found := c.writeSessions.Fetch(addr); found {
+		if active, ok := session.(*activeWrite); ok {
+			active.endSession()
+		} else {
+			session.Cancel()
+			c.writeSessions.Remove(addr)
+		}
+	}
+}
+
+// createRead reports whether it started a session, which then calls release when it ends.
+func (c *SessionCreator) createRead(r *safetyfilter.IncomingSafeReadRequest, release func()) bool {
+	transfer, err := c.config.TransferFactory(r.Addr, r.LocalAddr)
 	if err != nil {
-		handler := c.outgoingHandlerFactory(r.Addr)
+		// without a connection of our own there is no way to answer the client
+		return false
+	}
 
-		handler.SendError(safepackets.NewAccessViolationError(err.Error()))
-		return
+	if !c.permitted(accesscontrol.Read, r.Read.Filename, r.Addr, transfer) {
+		return false
 	}
 
+	reader, err := c.config.ReaderFactory(r.Read.Filename)
+	if err != nil {
+		transfer.SendError(errorFromOpenError(err))
+		transfer.Close()
+		return false
+	}
+
+	// the opened reader, before any translation wraps it
+	source := reader
+
+	if r.Read.Mode == safepackets.NetAscii {
+		// the translated size is unknown up front, so this also keeps tsize out of the option ack
+		reader = safepackets.NewNetAsciiReader(reader)
+	}
+
+	options := negotiateReadOptions(r.Read.Options, c.config.TimeoutPolicy, c.config.BlockSizePolicy, reader)
 	sessionConfig := &readsession.Config{
-		Reader:    reader,
-		BlockSize: 512,
+		Reader:        reader,
+		BlockSize:     options.blockSize,
+		WindowSize:    options.windowSize,
+		BlockSequence: c.config.BlockSequence,
+		OptionAck:     options.optionAck,
+	}
+
+	// endSession releases everything the session holds, whether it finished, failed or expired.
+	var timeoutController timeoutcontroller.TimeoutController
+	var clientError func() *safepackets.SafeError
+	var endOnce sync.Once
+	endSession := func() {
+		endOnce.Do(func() {
+			timeoutController.Cancel()
+			if closer, ok := source.(io.Closer); ok {
+				closer.Close()
+			}
+			c.readSessions.Remove(r.Addr)
+			transfer.Close()
+			release()
+			c.reportClientError(accesscontrol.Read, r.Addr, r.Read.Filename, clientError())
+		})
+	}
+
+	session := readsession.NewReadSession(sessionConfig, transfer, endSession)
+	clientError = session.ClientError
+
+	timeoutController = timeoutcontroller.NewTimeoutController(options.timeout, c.config.TryLimit, session, endSession)
+
+	// the client of a read sends only acks and errors, however large the blocks it receives
+	transfer.Receive(packets.DefaultBlockSize)
+
+	c.readSessions.Add(&activeRead{
+		TimeoutController: timeoutController,
+		request:           r.Read,
+		endSession:        endSession,
+	}, r.Addr)
+	go timeoutController.BeginSession()
+	return true
+}
+
+// createWrite reports whether it started a session, which then calls release when it ends.
+func (c *SessionCreator) createWrite(w *safetyfilter.IncomingSafeWriteRequest, release func()) bool {
+	transfer, err := c.config.TransferFactory(w.Addr, w.LocalAddr)
+	if err != nil {
+		// without a connection of our own there is no way to answer the client
+		return false
+	}
+
+	if !c.permitted(accesscontrol.Write, w.Write.Filename, w.Addr, transfer) {
+		return false
 	}
 
-	removeSession := func() {
-		c.readSessions.Remove(r.Addr)
+	writerFactory := c.config.WriterFactory
+	if writerFactory == nil {
+		writerFactory = refuseWrites
 	}
 
-	session := readsession.NewReadSession(sessionConfig, c.outgoingHandlerFactory(r.Addr), removeSession)
+	file, err := writerFactory(w.Write.Filename)
+	if err != nil {
+		transfer.SendError(errorFromOpenError(err))
+		transfer.Close()
+		return false
+	}
+
+	writer := file
+	if w.Write.Mode == safepackets.NetAscii {
+		writer = safepackets.NewNetAsciiWriter(writer)
+	}
+
+	// closeWriter keeps the file once all of it was received, and otherwise discards it if it can
+	var closeOnce sync.Once
+	var closeErr error
+	closeWriter := func(complete bool) error {
+		closeOnce.Do(func() {
+			d, discardable := file.(discarder)
+			if discardable && !complete {
+				d.Discard()
+			}
+			if closer, ok := writer.(io.Closer); ok {
+				closeErr = closer.Close()
+			}
+			if discardable && closeErr != nil {
+				d.Discard()
+			}
+		})
+		return closeErr
+	}
+
+	options := negotiateWriteOptions(w.Write.Options, c.config.TimeoutPolicy, c.config.BlockSizePolicy)
+	sessionConfig := &writesession.Config{
+		Writer:        writer,
+		BlockSize:     options.blockSize,
+		BlockSequence: c.config.BlockSequence,
+		OptionAck:     options.optionAck,
+		Commit: func() error {
+			return closeWriter(true)
+		},
+	}
+
+	// The session stays in the collection after finishing so that it can dally,
+	// re-acknowledging a retransmitted final block until the timeout controller expires it.
+	var timeoutController timeoutcontroller.WriteTimeoutController
+	var clientError func() *safepackets.SafeError
+	var endOnce sync.Once
+	endSession := func() {
+		endOnce.Do(func() {
+			timeoutController.Cancel()
+			closeWriter(false)
+			c.writeSessions.Remove(w.Addr)
+			transfer.Close()
+			release()
+			c.reportClientError(accesscontrol.Write, w.Addr, w.Write.Filename, clientError())
+		})
+	}
 
-	timeoutController := timeoutcontroller.NewTimeoutController(c.timeout, c.tryLimit, session, removeSession)
+	session := writesession.NewWriteSession(sessionConfig, transfer, func() {
+		// a complete file was already committed; otherwise writing failed
+		closeWriter(false)
+	})
+	clientError = session.ClientError
 
-	c.readSessions.Add(timeoutController, r.Addr)
+	timeoutController = timeoutcontroller.NewWriteTimeoutController(options.timeout, c.config.TryLimit, session, endSession)
+	transfer.Receive(options.blockSize)
+
+	c.writeSessions.Add(&activeWrite{
+		WriteTimeoutController: timeoutController,
+		request:                w.Write,
+		endSession:             endSession,
+	}, w.Addr)
 	go timeoutController.BeginSession()
+	return true
+}
+
+// request is what the session limiter needs to know about a read or write request.
+type request struct {
+	op        accesscontrol.Operation
+	addr      net.Addr
+	localAddr netip.Addr
+	filename  string
+
+	// The request packet itself, to recognize retransmissions
+	packet any
+}
+
+// waiter is a request waiting for a session slot.
+type waiter struct {
+	packet any
+}
+
+// startWithinLimits calls start with a session slot, before any transfer or file is opened,
+// unless handled finds that the client's active session answers the request.
+// A request over a limit waits for a slot on its own goroutine if the limiter queues, and is refused otherwise.
+// Both are called with the creator locked, so that they see every session started before them.
+func (c *SessionCreator) startWithinLimits(r request, handled func() bool, start func(release func()) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if handled() {
+		return
+	}
+
+	key := clientaddr.KeyOf(r.addr)
+	if w, found := c.waiting[key]; found && w.packet == r.packet {
+		return
+	}
+	// the client has moved on from any request it had waiting
+	delete(c.waiting, key)
+
+	limiter := c.config.SessionLimiter
+	if limiter == nil {
+		c.start(r, start, func() {})
+		return
+	}
+
+	file := c.config.SessionLimiterScope + limitedFile(r.filename)
+	release, err := limiter.TryAcquire(r.addr, file)
+	switch {
+	case err == nil:
+		c.start(r, start, release)
+	case err != sessionlimiter.ErrClosed && limiter.Queues():
+		w := &waiter{packet: r.packet}
+		c.waiting[key] = w
+		go c.wait(r, key, w, file, start)
+	default:
+		c.refuse(r, err)
+	}
+}
+
+// wait starts r once it gets a session slot, unless the client has sent another request in the meantime.
+func (c *SessionCreator) wait(r request, key clientaddr.Key, w *waiter, file string, start func(release func()) bool) {
+	release, err := c.config.SessionLimiter.Wait(r.addr, file)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.waiting[key] != w {
+		if err == nil {
+			release()
+		}
+		return
+	}
+	delete(c.waiting, key)
+
+	if err != nil {
+		c.refuse(r, err)
+		return
+	}
+	c.start(r, start, release)
+}
+
+// start gives the slot back if no session starts, including when the creator is closed.
+// The creator must be locked.
+func (c *SessionCreator) start(r request, start func(release func()) bool, release func()) {
+	if c.closed {
+		release()
+		c.refuse(r, sessionlimiter.ErrClosed)
+		return
+	}
+
+	if !start(release) {
+		release()
+	}
+}
+
+func (c *SessionCreator) refuse(r request, reason error) {
+	if transfer, err := c.config.TransferFactory(r.addr, r.localAddr); err == nil {
+		transfer.SendError(errorFromLimitError(reason))
+		transfer.Close()
+	}
+
+	if reason != sessionlimiter.ErrClosed && c.config.OnSessionLimited != nil {
+		c.config.OnSessionLimited(&SessionLimited{
+			Addr:      r.addr,
+			Operation: r.op,
+			Filename:  r.filename,
+			Reason:    reason,
+		})
+	}
+}
+
+// reportClientError passes on e if the client sent it; sessions that ended for any other reason have none.
+func (c *SessionCreator) reportClientError(op accesscontrol.Operation, addr net.Addr, filename string, e *safepackets.SafeError) {
+	if e == nil || c.config.OnClientError == nil {
+		return
+	}
+
+	c.config.OnClientError(&ClientError{
+		Addr:      addr,
+		Operation: op,
+		Filename:  filename,
+		Error:     e,
+	})
+}
+
+func errorFromLimitError(err error) *safepackets.SafeError {
+	if err == sessionlimiter.ErrClosed {
+		return safepackets.NewServerShuttingDownError()
+	}
+
+	// RFC 1350 has no code for a busy server, so the message explains it
+	return safepackets.NewUndefinedError(err.Error())
+}
+
+// Equivalent spellings of a filename count as the same file; names that cannot be resolved are refused when opened anyway.
+func limitedFile(filename string) string {
+	if name, err := pathresolver.Resolve(filename); err == nil {
+		return name
+	}
+	return filename
+}
+
+// permitted checks the request against the access list, answering the client and closing the transfer if it is refused.
+// Rules are matched against the filename as resolved within the root, so that equivalent spellings cannot evade them.
+func (c *SessionCreator) permitted(op accesscontrol.Operation, filename string, addr net.Addr, transfer Transfer) bool {
+	if c.config.AccessList == nil {
+		return true
+	}
+
+	name, err := pathresolver.Resolve(filename)
+	if err != nil {
+		transfer.SendError(errorFromOpenError(err))
+		transfer.Close()
+		return false
+	}
+
+	if c.config.AccessList.Allows(op, addr, name) {
+		return true
+	}
+
+	transfer.SendError(safepackets.NewAccessViolationError("Access denied"))
+	transfer.Close()
+
+	if c.config.OnAccessDenied != nil {
+		c.config.OnAccessDenied(&AccessDenied{
+			Addr:      addr,
+			Operation: op,
+			Filename:  filename,
+		})
+	}
+
+	return false
 }
@@ -1,25 +1,36 @@
 package sessioncreator
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/mark-rushakoff/go_tftpd/accesscontrol"
+	"github.com/mark-rushakoff/go_tftpd/dirfs"
 	"github.com/mark-rushakoff/go_tftpd/packets"
-	"github.com/mark-rushakoff/go_tftpd/readsession"
 	"github.com/mark-rushakoff/go_tftpd/readsessioncollection"
 	"github.com/mark-rushakoff/go_tftpd/safepackets"
 	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
+	"github.com/mark-rushakoff/go_tftpd/sessionlimiter"
 	"github.com/mark-rushakoff/go_tftpd/testhelpers"
+	"github.com/mark-rushakoff/go_tftpd/writesessioncollection"
 )
 
 var fakeAddr = testhelpers.MakeMockAddr("fake_network", "a")
 
 func TestCreateAddsNewSessionToCollection(t *testing.T) {
 	readRequest := &safetyfilter.IncomingSafeReadRequest{
-		Read: safepackets.NewSafeReadRequest("foobar", safepackets.NetAscii),
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
 		Addr: fakeAddr,
 	}
 
@@ -28,13 +39,16 @@ func TestCreateAddsNewSessionToCollection(t *testing.T) {
 	outgoing := make(chan *safepackets.SafeData, 1)
 	sessionCreator := NewSessionCreator(
 		readSessions,
-		readerFactory(reader),
-		outgoingFactory(outgoing, nil),
-		2*time.Millisecond,
-		2,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   readerFactory(reader),
+			TransferFactory: outgoingFactory(outgoing, nil, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: 2 * time.Millisecond},
+			TryLimit:        2,
+		},
 	)
 
-	sessionCreator.Create(readRequest)
+	sessionCreator.CreateRead(readRequest)
 
 	select {
 	case reader <- []byte("foobar"):
@@ -76,7 +90,7 @@ func TestCreateAddsNewSessionToCollection(t *testing.T) {
 
 func TestSuccessfulFinishRemovesSessionFromCollection(t *testing.T) {
 	readRequest := &safetyfilter.IncomingSafeReadRequest{
-		Read: safepackets.NewSafeReadRequest("foobar", safepackets.NetAscii),
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
 		Addr: fakeAddr,
 	}
 
@@ -85,13 +99,16 @@ func TestSuccessfulFinishRemovesSessionFromCollection(t *testing.T) {
 	outgoing := make(chan *safepackets.SafeData, 1)
 	sessionCreator := NewSessionCreator(
 		readSessions,
-		readerFactory(reader),
-		outgoingFactory(outgoing, nil),
-		2*time.Millisecond,
-		2,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   readerFactory(reader),
+			TransferFactory: outgoingFactory(outgoing, nil, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: 2 * time.Millisecond},
+			TryLimit:        2,
+		},
 	)
 
-	sessionCreator.Create(readRequest)
+	sessionCreator.CreateRead(readRequest)
 
 	select {
 	case reader <- []byte("foobar"):
@@ -124,7 +141,7 @@ func TestSuccessfulFinishRemovesSessionFromCollection(t *testing.T) {
 
 func TestErrorCreatingReaderCausesErrorMessage(t *testing.T) {
 	readRequest := &safetyfilter.IncomingSafeReadRequest{
-		Read: safepackets.NewSafeReadRequest("foobar", safepackets.NetAscii),
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
 		Addr: fakeAddr,
 	}
 
@@ -133,16 +150,19 @@ func TestErrorCreatingReaderCausesErrorMessage(t *testing.T) {
 	errors := make(chan *safepackets.SafeError, 1)
 	sessionCreator := NewSessionCreator(
 		readSessions,
-		errorReaderFactory(err),
-		outgoingFactory(nil, errors),
-		2*time.Millisecond,
-		2,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   errorReaderFactory(err),
+			TransferFactory: outgoingFactory(nil, nil, errors),
+			TimeoutPolicy:   TimeoutPolicy{Default: 2 * time.Millisecond},
+			TryLimit:        2,
+		},
 	)
 
-	sessionCreator.Create(readRequest)
+	sessionCreator.CreateRead(readRequest)
 	select {
 	case e := <-errors:
-		expected := &safepackets.SafeError{Code: packets.AccessViolation, Message: "something about foobar"}
+		expected := safepackets.NewOpenFailedError()
 		if !e.Equals(expected) {
 			t.Fatalf("Session sent wrong error packet: got %v, expected %v", e.Bytes(), expected.Bytes())
 		}
@@ -151,48 +171,1527 @@ func TestErrorCreatingReaderCausesErrorMessage(t *testing.T) {
 	}
 }
 
-type channelReader struct {
-	In <-chan []byte
+func TestCreateWriteAddsNewSessionToCollection(t *testing.T) {
+	writeRequest := &safetyfilter.IncomingSafeWriteRequest{
+		Write: safepackets.NewSafeWriteRequest("foobar", safepackets.Octet),
+		Addr:  fakeAddr,
+	}
+
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	writer := &closeRecordingWriter{}
+	acks := make(chan *safepackets.SafeAck, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writeSessions,
+		&Config{
+			WriterFactory:   writerFactory(writer),
+			TransferFactory: outgoingFactory(nil, acks, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: 2 * time.Millisecond},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateWrite(writeRequest)
+
+	select {
+	case ack := <-acks:
+		if ack.BlockNumber != 0 {
+			t.Fatalf("Session sent wrong ack: got %v, expected 0", ack.BlockNumber)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Session did not send ack during BeginSession")
+	}
+
+	session, found := writeSessions.Fetch(fakeAddr)
+	if !found {
+		t.Fatalf("SessionCreator did not expose the session")
+	}
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("foobar")))
+	select {
+	case ack := <-acks:
+		if ack.BlockNumber != 1 {
+			t.Fatalf("Session sent wrong ack: got %v, expected 1", ack.BlockNumber)
+		}
+	default:
+		t.Fatalf("Session did not ack data")
+	}
+
+	if writer.String() != "foobar" {
+		t.Errorf("Session wrote %v, expected foobar", writer.String())
+	}
+	if !writer.closed {
+		t.Errorf("Session did not close writer after final block")
+	}
+
+	_, found = writeSessions.Fetch(fakeAddr)
+	if !found {
+		t.Fatalf("Finished write session should dally in collection")
+	}
+
+	// let the dally period elapse
+	time.Sleep(15 * time.Millisecond)
+
+	_, found = writeSessions.Fetch(fakeAddr)
+	if found {
+		t.Fatalf("Should have timed out and removed itself from collection")
+	}
 }
 
-func (r *channelReader) Read(p []byte) (n int, err error) {
-	return copy(p, <-r.In), nil
+func TestAbortedUploadLeavesNoFileAndCanBeRetried(t *testing.T) {
+	dir := t.TempDir()
+	root, err := dirfs.NewDirFS(dir, dirfs.FollowWithinRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	acks := make(chan *safepackets.SafeAck, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writeSessions,
+		&Config{
+			WriterFactory:   WriterFromFS(root),
+			TransferFactory: outgoingFactory(nil, acks, make(chan *safepackets.SafeError, 1)),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+	writeRequest := &safetyfilter.IncomingSafeWriteRequest{
+		Write: safepackets.NewSafeWriteRequest("backup.cfg", safepackets.Octet),
+		Addr:  fakeAddr,
+	}
+	firstBlock := bytes.Repeat([]byte("a"), 512)
+
+	sessionCreator.CreateWrite(writeRequest)
+	<-acks
+	session, _ := writeSessions.Fetch(fakeAddr)
+	session.HandleData(safepackets.NewSafeData(1, firstBlock))
+	<-acks
+	session.Abort(safepackets.NewServerShuttingDownError())
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("Expected nothing to be left of the aborted upload, got %v", entries)
+	}
+
+	sessionCreator.CreateWrite(writeRequest)
+	select {
+	case ack := <-acks:
+		if ack.BlockNumber != 0 {
+			t.Fatalf("Session sent wrong ack: got %v, expected 0", ack.BlockNumber)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Retried upload was not acknowledged")
+	}
+	session, _ = writeSessions.Fetch(fakeAddr)
+	session.HandleData(safepackets.NewSafeData(1, firstBlock))
+	<-acks
+	session.HandleData(safepackets.NewSafeData(2, []byte("b")))
+	<-acks
+
+	content, err := os.ReadFile(filepath.Join(dir, "backup.cfg"))
+	if err != nil {
+		t.Fatalf("Expected the retried upload to be written, got %v", err)
+	}
+	if string(content) != string(firstBlock)+"b" {
+		t.Errorf("Expected %v bytes to be written, got %v", len(firstBlock)+1, len(content))
+	}
 }
 
-func readerFactory(in chan []byte) ReaderFromFilename {
-	reader := &channelReader{
-		In: in,
+func TestErrorCreatingWriterCausesErrorMessage(t *testing.T) {
+	writeRequest := &safetyfilter.IncomingSafeWriteRequest{
+		Write: safepackets.NewSafeWriteRequest("foobar", safepackets.Octet),
+		Addr:  fakeAddr,
 	}
 
-	return func(filename string) (io.Reader, error) {
-		return reader, nil
+	err := errors.New("something about foobar")
+	errors := make(chan *safepackets.SafeError, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			WriterFactory:   errorWriterFactory(err),
+			TransferFactory: outgoingFactory(nil, nil, errors),
+			TimeoutPolicy:   TimeoutPolicy{Default: 2 * time.Millisecond},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateWrite(writeRequest)
+	select {
+	case e := <-errors:
+		expected := safepackets.NewOpenFailedError()
+		if !e.Equals(expected) {
+			t.Fatalf("Session sent wrong error packet: got %v, expected %v", e.Bytes(), expected.Bytes())
+		}
+	default:
+		t.Fatalf("Session did not send error")
 	}
 }
 
-func errorReaderFactory(err error) ReaderFromFilename {
-	return func(string) (io.Reader, error) {
-		return nil, err
+func TestBlockSizeOptionIsNegotiated(t *testing.T) {
+	safeRead := safepackets.NewSafeReadRequest("foobar", safepackets.Octet)
+	safeRead.Options.BlockSize = 3
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safeRead,
+		Addr: fakeAddr,
+	}
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	reader := make(chan []byte, 1)
+	outgoing := make(chan *safepackets.SafeData, 1)
+	oacks := make(chan *safepackets.SafeOptionAck, 1)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   readerFactory(reader),
+			TransferFactory: oackOutgoingFactory(outgoing, nil, nil, oacks),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case oack := <-oacks:
+		expected := safepackets.NewSafeOptionAck(map[string]string{"blksize": "3"})
+		if !oack.Equals(expected) {
+			t.Fatalf("Session sent wrong option ack: got %v, expected %v", oack.Bytes(), expected.Bytes())
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Session did not send option ack during BeginSession")
+	}
+
+	session, found := readSessions.Fetch(fakeAddr)
+	if !found {
+		t.Fatalf("SessionCreator did not expose the session")
+	}
+
+	reader <- []byte("foobar")
+	session.HandleAck(safepackets.NewSafeAck(0))
+	select {
+	case data := <-outgoing:
+		expected := safepackets.NewSafeData(1, []byte("foo"))
+		if !data.Equals(expected) {
+			t.Fatalf("Session sent wrong data packet: got %v, expected %v", data.Bytes(), expected.Bytes())
+		}
+	default:
+		t.Fatalf("Session did not send data after ack 0")
 	}
 }
 
-type channelNotifier struct {
-	Out chan<- *safepackets.SafeData
-	Err chan<- *safepackets.SafeError
+func TestTransferReceivesBlocksOfNegotiatedSize(t *testing.T) {
+	safeRead := safepackets.NewSafeReadRequest("foobar", safepackets.Octet)
+	safeRead.Options.BlockSize = 1428
+	safeWrite := safepackets.NewSafeWriteRequest("foobar", safepackets.Octet)
+	safeWrite.Options.BlockSize = 1428
+
+	received := make(chan uint16, 2)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory: readerFactory(make(chan []byte, 1)),
+			WriterFactory: writerFactory(&bytes.Buffer{}),
+			TransferFactory: transferFactory(&channelNotifier{
+				Oacks:    make(chan *safepackets.SafeOptionAck, 2),
+				Received: received,
+			}),
+			TimeoutPolicy: TimeoutPolicy{Default: time.Second},
+			TryLimit:      2,
+		},
+	)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{Read: safeRead, Addr: fakeAddr})
+	select {
+	case blockSize := <-received:
+		if blockSize != packets.DefaultBlockSize {
+			t.Errorf("Read transfer should receive only acks and errors, got block size %v", blockSize)
+		}
+	default:
+		t.Fatalf("Read transfer did not start receiving")
+	}
+
+	sessionCreator.CreateWrite(&safetyfilter.IncomingSafeWriteRequest{Write: safeWrite, Addr: fakeAddr})
+	select {
+	case blockSize := <-received:
+		if blockSize != 1428 {
+			t.Errorf("Write transfer should receive the negotiated block size 1428, got %v", blockSize)
+		}
+	default:
+		t.Fatalf("Write transfer did not start receiving")
+	}
 }
 
-func (n *channelNotifier) SendData(data *safepackets.SafeData) {
-	n.Out <- data
+func TestTransferIsClosedWhenSessionFinishes(t *testing.T) {
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	}
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	reader := make(chan []byte, 1)
+	outgoing := make(chan *safepackets.SafeData, 1)
+	closed := make(chan bool, 2)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   readerFactory(reader),
+			TransferFactory: transferFactory(&channelNotifier{Out: outgoing, Closed: closed}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	reader <- []byte("foobar")
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Session did not send data during BeginSession")
+	}
+
+	select {
+	case <-closed:
+		t.Fatalf("Transfer closed before session finished")
+	default:
+		// ok
+	}
+
+	session, _ := readSessions.Fetch(fakeAddr)
+	session.HandleAck(safepackets.NewSafeAck(1))
+
+	select {
+	case <-closed:
+		// ok
+	default:
+		t.Fatalf("Transfer was not closed when session finished")
+	}
 }
 
-func (n *channelNotifier) SendError(err *safepackets.SafeError) {
-	n.Err <- err
+func TestClientErrorTearsDownReadSession(t *testing.T) {
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.NetAscii),
+		Addr: fakeAddr,
+	}
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	reader := &closeRecordingReader{Reader: strings.NewReader("foobar")}
+	outgoing := make(chan *safepackets.SafeData, 1)
+	closed := make(chan bool, 2)
+	reported := make(chan *ClientError, 1)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory: func(string) (io.Reader, error) {
+				return reader, nil
+			},
+			TransferFactory: transferFactory(&channelNotifier{Out: outgoing, Closed: closed}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			OnClientError: func(e *ClientError) {
+				reported <- e
+			},
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Session did not send data during BeginSession")
+	}
+
+	session, _ := readSessions.Fetch(fakeAddr)
+	session.HandleError(&safepackets.SafeError{Message: "cancelled"})
+
+	select {
+	case <-closed:
+		// ok
+	default:
+		t.Fatalf("Transfer was not closed after client error")
+	}
+
+	if !reader.closed {
+		t.Errorf("Reader was not closed after client error")
+	}
+
+	if _, found := readSessions.Fetch(fakeAddr); found {
+		t.Errorf("Session was not removed after client error")
+	}
+
+	select {
+	case e := <-reported:
+		if e.Operation != accesscontrol.Read || e.Filename != "foobar" || e.Addr != fakeAddr || e.Error.Message != "cancelled" {
+			t.Errorf("Reported wrong client error: %+v", e)
+		}
+	default:
+		t.Errorf("Client error was not reported")
+	}
+}
+
+func TestOnlyErrorsSentByClientAreReported(t *testing.T) {
+	writeRequest := &safetyfilter.IncomingSafeWriteRequest{
+		Write: safepackets.NewSafeWriteRequest("foobar", safepackets.Octet),
+		Addr:  fakeAddr,
+	}
+
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	acks := make(chan *safepackets.SafeAck, 1)
+	reported := make(chan *ClientError, 2)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writeSessions,
+		&Config{
+			WriterFactory:   writerFactory(&closeRecordingWriter{}),
+			TransferFactory: outgoingFactory(nil, acks, make(chan *safepackets.SafeError, 1)),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			OnClientError: func(e *ClientError) {
+				reported <- e
+			},
+		},
+	)
+
+	sessionCreator.CreateWrite(writeRequest)
+	<-acks
+	session, _ := writeSessions.Fetch(fakeAddr)
+	session.Abort(safepackets.NewServerShuttingDownError())
+
+	select {
+	case e := <-reported:
+		t.Fatalf("Session aborted by the server was reported as client error: %+v", e)
+	default:
+		// ok
+	}
+
+	sessionCreator.CreateWrite(writeRequest)
+	<-acks
+	session, _ = writeSessions.Fetch(fakeAddr)
+	session.HandleError(&safepackets.SafeError{Code: packets.DiskFullOrAllocationExceeded, Message: "disk full"})
+
+	select {
+	case e := <-reported:
+		if e.Operation != accesscontrol.Write || e.Filename != "foobar" || e.Error.Code != packets.DiskFullOrAllocationExceeded {
+			t.Errorf("Reported wrong client error: %+v", e)
+		}
+	default:
+		t.Errorf("Client error was not reported")
+	}
 }
 
-func outgoingFactory(out chan *safepackets.SafeData, err chan *safepackets.SafeError) OutgoingHandlerFromAddr {
-	return func(net.Addr) readsession.OutgoingHandler {
-		return &channelNotifier{
-			Out: out,
-			Err: err,
+func TestReadFailureTearsDownReadSession(t *testing.T) {
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	}
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	reader := &closeRecordingReader{Reader: iotest.ErrReader(errors.New("input/output error"))}
+	errorsSent := make(chan *safepackets.SafeError, 1)
+	closed := make(chan bool, 2)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory: func(string) (io.Reader, error) {
+				return reader, nil
+			},
+			TransferFactory: transferFactory(&channelNotifier{Err: errorsSent, Closed: closed}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case e := <-errorsSent:
+		if !e.Equals(safepackets.NewReadFailedError()) {
+			t.Errorf("Sent incorrect error: %v", e.Message)
 		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Error was not sent after read failure")
+	}
+
+	select {
+	case <-closed:
+		// ok
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Transfer was not closed after read failure")
+	}
+
+	if !reader.closed {
+		t.Errorf("Reader was not closed after read failure")
+	}
+
+	if _, found := readSessions.Fetch(fakeAddr); found {
+		t.Errorf("Session was not removed after read failure")
+	}
+}
+
+func TestTransferIsClosedAfterErrorCreatingReader(t *testing.T) {
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	}
+
+	errors := make(chan *safepackets.SafeError, 1)
+	closed := make(chan bool, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   errorReaderFactory(io.ErrUnexpectedEOF),
+			TransferFactory: transferFactory(&channelNotifier{Err: errors, Closed: closed}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case <-errors:
+		// ok
+	default:
+		t.Fatalf("Error was not sent")
+	}
+
+	select {
+	case <-closed:
+		// ok
+	default:
+		t.Fatalf("Transfer was not closed after sending error")
+	}
+}
+
+func TestErrorCreatingTransferCreatesNoSession(t *testing.T) {
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	}
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   errorReaderFactory(errors.New("should not open file")),
+			TransferFactory: errorTransferFactory(errors.New("no ports available")),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	_, found := readSessions.Fetch(fakeAddr)
+	if found {
+		t.Fatalf("Session should not have been created without a transfer")
+	}
+}
+
+func TestAccessListDeniesReadBeforeOpeningFile(t *testing.T) {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1234}
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("/prod//pxelinux.0", safepackets.Octet),
+		Addr: clientAddr,
+	}
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	errors := make(chan *safepackets.SafeError, 1)
+	closed := make(chan bool, 1)
+	denials := make(chan *AccessDenied, 1)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   errorReaderFactory(fmt.Errorf("should not open file")),
+			TransferFactory: transferFactory(&channelNotifier{Err: errors, Closed: closed}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			AccessList: &accesscontrol.AccessList{
+				Rules: []accesscontrol.Rule{
+					{Action: accesscontrol.Deny, Network: netip.MustParsePrefix("10.1.0.0/16"), Pattern: "prod/*"},
+				},
+			},
+			OnAccessDenied: func(d *AccessDenied) {
+				denials <- d
+			},
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case e := <-errors:
+		expected := safepackets.NewAccessViolationError("Access denied")
+		if !e.Equals(expected) {
+			t.Fatalf("Session sent wrong error packet: got %v, expected %v", e.Bytes(), expected.Bytes())
+		}
+	default:
+		t.Fatalf("Error was not sent")
+	}
+
+	select {
+	case <-closed:
+		// ok
+	default:
+		t.Fatalf("Transfer was not closed after denying access")
+	}
+
+	select {
+	case d := <-denials:
+		if d.Addr != clientAddr || d.Operation != accesscontrol.Read || d.Filename != "/prod//pxelinux.0" {
+			t.Errorf("Denial described the wrong request: %+v", d)
+		}
+	default:
+		t.Fatalf("Denial was not reported")
+	}
+
+	if _, found := readSessions.Fetch(clientAddr); found {
+		t.Fatalf("Session should not have been created for a denied request")
+	}
+}
+
+func TestAccessListDeniesWriteBeforeCreatingFile(t *testing.T) {
+	writeRequest := &safetyfilter.IncomingSafeWriteRequest{
+		Write: safepackets.NewSafeWriteRequest(`uploads\log`, safepackets.Octet),
+		Addr:  fakeAddr,
+	}
+
+	errors := make(chan *safepackets.SafeError, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			WriterFactory:   errorWriterFactory(fmt.Errorf("should not create file")),
+			TransferFactory: transferFactory(&channelNotifier{Err: errors}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			AccessList: &accesscontrol.AccessList{
+				Rules: []accesscontrol.Rule{
+					{Action: accesscontrol.Allow, Operation: accesscontrol.Read},
+				},
+				DefaultAction: accesscontrol.Deny,
+			},
+		},
+	)
+
+	sessionCreator.CreateWrite(writeRequest)
+
+	select {
+	case e := <-errors:
+		expected := safepackets.NewAccessViolationError("Access denied")
+		if !e.Equals(expected) {
+			t.Fatalf("Session sent wrong error packet: got %v, expected %v", e.Bytes(), expected.Bytes())
+		}
+	default:
+		t.Fatalf("Error was not sent")
+	}
+}
+
+func TestAccessListAllowsMatchingRequests(t *testing.T) {
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest(`\lab\pxelinux.0`, safepackets.Octet),
+		Addr: fakeAddr,
+	}
+
+	outgoing := make(chan *safepackets.SafeData, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   stringReaderFactory("foo"),
+			TransferFactory: outgoingFactory(outgoing, nil, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			AccessList: &accesscontrol.AccessList{
+				Rules: []accesscontrol.Rule{
+					{Action: accesscontrol.Allow, Operation: accesscontrol.Read, Pattern: "lab/*"},
+				},
+				DefaultAction: accesscontrol.Deny,
+			},
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Allowed request was not served")
+	}
+}
+
+func TestTransferRepliesFromRequestedAddress(t *testing.T) {
+	localAddr := netip.MustParseAddr("10.0.0.2")
+	requestedFrom := make(chan netip.Addr, 2)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory: errorReaderFactory(io.ErrUnexpectedEOF),
+			WriterFactory: errorWriterFactory(io.ErrUnexpectedEOF),
+			TransferFactory: func(clientAddr net.Addr, localAddr netip.Addr) (Transfer, error) {
+				requestedFrom <- localAddr
+				return &channelNotifier{Err: make(chan *safepackets.SafeError, 1)}, nil
+			},
+			TimeoutPolicy: TimeoutPolicy{Default: time.Second},
+			TryLimit:      2,
+		},
+	)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read:      safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr:      fakeAddr,
+		LocalAddr: localAddr,
+	})
+	sessionCreator.CreateWrite(&safetyfilter.IncomingSafeWriteRequest{
+		Write:     safepackets.NewSafeWriteRequest("foobar", safepackets.Octet),
+		Addr:      fakeAddr,
+		LocalAddr: localAddr,
+	})
+
+	for i := 0; i < 2; i++ {
+		select {
+		case addr := <-requestedFrom:
+			if addr != localAddr {
+				t.Errorf("Expected transfer to reply from %v, got %v", localAddr, addr)
+			}
+		default:
+			t.Fatalf("Transfer was not opened")
+		}
+	}
+}
+
+func TestSessionLimiterRefusesReadBeforeOpeningFile(t *testing.T) {
+	clientAddr := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1234}
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("/pxelinux.0", safepackets.Octet),
+		Addr: clientAddr,
+	}
+
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{PerFile: 1})
+	limiter.TryAcquire(fakeAddr, "pxelinux.0")
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	errors := make(chan *safepackets.SafeError, 1)
+	closed := make(chan bool, 1)
+	limited := make(chan *SessionLimited, 1)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   errorReaderFactory(fmt.Errorf("should not open file")),
+			TransferFactory: transferFactory(&channelNotifier{Err: errors, Closed: closed}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			SessionLimiter:  limiter,
+			OnSessionLimited: func(l *SessionLimited) {
+				limited <- l
+			},
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case e := <-errors:
+		expected := safepackets.NewUndefinedError("Too many transfers of this file")
+		if !e.Equals(expected) {
+			t.Fatalf("Session sent wrong error packet: got %v, expected %v", e.Bytes(), expected.Bytes())
+		}
+	default:
+		t.Fatalf("Error was not sent")
+	}
+
+	select {
+	case <-closed:
+		// ok
+	default:
+		t.Fatalf("Transfer was not closed after refusing the request")
+	}
+
+	select {
+	case l := <-limited:
+		if l.Addr != clientAddr || l.Operation != accesscontrol.Read || l.Filename != "/pxelinux.0" || l.Reason != sessionlimiter.ErrTooManyFileSessions {
+			t.Errorf("Refusal described the wrong request: %+v", l)
+		}
+	default:
+		t.Fatalf("Refusal was not reported")
+	}
+
+	if _, found := readSessions.Fetch(clientAddr); found {
+		t.Fatalf("Session should not have been created for a refused request")
+	}
+	if stats := limiter.Stats(); stats.Active != 1 || stats.Refused != 1 {
+		t.Errorf("Expected 1 active session and 1 refusal, got %+v", stats)
+	}
+}
+
+func TestSessionSlotIsReleasedWhenSessionEnds(t *testing.T) {
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{})
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	outgoing := make(chan *safepackets.SafeData, 1)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   stringReaderFactory("foobar"),
+			TransferFactory: outgoingFactory(outgoing, nil, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			SessionLimiter:  limiter,
+		},
+	)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Session did not send data")
+	}
+
+	if active := limiter.Stats().Active; active != 1 {
+		t.Fatalf("Expected the session to hold a slot, %v are active", active)
+	}
+
+	session, _ := readSessions.Fetch(fakeAddr)
+	session.HandleAck(safepackets.NewSafeAck(1))
+
+	if active := limiter.Stats().Active; active != 0 {
+		t.Errorf("Expected the finished session to give back its slot, %v are active", active)
+	}
+}
+
+func TestSessionSlotIsReleasedWhenOpeningFails(t *testing.T) {
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{})
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   errorReaderFactory(os.ErrNotExist),
+			TransferFactory: outgoingFactory(nil, nil, make(chan *safepackets.SafeError, 1)),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			SessionLimiter:  limiter,
+		},
+	)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("missing", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	if active := limiter.Stats().Active; active != 0 {
+		t.Errorf("Expected no slot to be held, %v are active", active)
+	}
+}
+
+func queueingCreator(limiter *sessionlimiter.SessionLimiter, notifier *channelNotifier) *SessionCreator {
+	return NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   stringReaderFactory("foobar"),
+			TransferFactory: transferFactory(notifier),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			SessionLimiter:  limiter,
+		},
+	)
+}
+
+func TestQueuedRequestStartsWhenSlotIsReleased(t *testing.T) {
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{Total: 1, QueueTimeout: time.Second, QueueLength: 1})
+	release, _ := limiter.TryAcquire(fakeAddr, "other")
+
+	outgoing := make(chan *safepackets.SafeData, 1)
+	sessionCreator := queueingCreator(limiter, &channelNotifier{Out: outgoing})
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	select {
+	case <-outgoing:
+		t.Fatalf("Session started while over the limit")
+	case <-time.After(10 * time.Millisecond):
+		// ok
+	}
+
+	release()
+
+	select {
+	case data := <-outgoing:
+		expected := safepackets.NewSafeData(1, []byte("foobar"))
+		if !data.Equals(expected) {
+			t.Fatalf("Session sent wrong data packet: got %v, expected %v", data.Bytes(), expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Queued request did not start once a slot was released")
+	}
+}
+
+func TestRetransmittedQueuedRequestStartsOneSession(t *testing.T) {
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{PerClient: 1, QueueTimeout: time.Second, QueueLength: 2})
+	release, _ := limiter.TryAcquire(fakeAddr, "other")
+
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	outgoing := make(chan *safepackets.SafeData, 2)
+	errors := make(chan *safepackets.SafeError, 1)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   stringReaderFactory("foobar"),
+			TransferFactory: outgoingFactory(outgoing, nil, errors),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			SessionLimiter:  limiter,
+		},
+	)
+
+	for i := 0; i < 2; i++ {
+		sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+			Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+			Addr: fakeAddr,
+		})
+	}
+
+	for limiter.Stats().Queued == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if queued := limiter.Stats().Queued; queued != 1 {
+		t.Fatalf("Expected the retransmission not to wait as well, %v are queued", queued)
+	}
+
+	release()
+
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Queued request did not start once a slot was released")
+	}
+
+	session, _ := readSessions.Fetch(fakeAddr)
+	session.HandleAck(safepackets.NewSafeAck(1))
+
+	select {
+	case data := <-outgoing:
+		t.Fatalf("A second session sent data block %v", data.BlockNumber)
+	case e := <-errors:
+		t.Fatalf("A second session was refused with %q", e.Message)
+	case <-time.After(50 * time.Millisecond):
+		// ok
+	}
+
+	if stats := limiter.Stats(); stats.Active != 0 || stats.Queued != 0 {
+		t.Errorf("Expected no session to be left, got %+v", stats)
+	}
+}
+
+func TestClosedCreatorRefusesQueuedRequests(t *testing.T) {
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{Total: 1, QueueTimeout: time.Second, QueueLength: 1})
+	release, _ := limiter.TryAcquire(fakeAddr, "other")
+
+	errors := make(chan *safepackets.SafeError, 1)
+	sessionCreator := queueingCreator(limiter, &channelNotifier{Err: errors})
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	sessionCreator.Close()
+	release()
+
+	select {
+	case e := <-errors:
+		expected := safepackets.NewServerShuttingDownError()
+		if !e.Equals(expected) {
+			t.Fatalf("Session sent wrong error packet: got %v, expected %v", e.Bytes(), expected.Bytes())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Queued request was not refused")
+	}
+
+	if active := limiter.Stats().Active; active != 0 {
+		t.Errorf("Expected the refused request to give back its slot, %v are active", active)
+	}
+}
+
+func TestDuplicateReadRequestResendsFirstData(t *testing.T) {
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{PerClient: 1})
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	outgoing := make(chan *safepackets.SafeData, 1)
+	opened := 0
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory: func(filename string) (io.Reader, error) {
+				opened++
+				return strings.NewReader("foobar"), nil
+			},
+			TransferFactory: outgoingFactory(outgoing, nil, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			SessionLimiter:  limiter,
+		},
+	)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Session did not send data")
+	}
+	session, _ := readSessions.Fetch(fakeAddr)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	select {
+	case data := <-outgoing:
+		expected := safepackets.NewSafeData(1, []byte("foobar"))
+		if !data.Equals(expected) {
+			t.Fatalf("Session sent wrong data packet: got %v, expected %v", data.Bytes(), expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Duplicate request did not resend the first data")
+	}
+
+	if opened != 1 {
+		t.Errorf("Expected the file to be opened once, was opened %v times", opened)
+	}
+	if duplicate, _ := readSessions.Fetch(fakeAddr); duplicate != session {
+		t.Errorf("Duplicate request replaced the session")
+	}
+	if stats := limiter.Stats(); stats.Active != 1 || stats.Refused != 0 {
+		t.Errorf("Expected the duplicate to use the session's slot, got %+v", stats)
+	}
+}
+
+func TestDifferentReadRequestReplacesSession(t *testing.T) {
+	limiter := sessionlimiter.NewSessionLimiter(sessionlimiter.Limits{})
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	outgoing := make(chan *safepackets.SafeData, 1)
+	closed := make(chan bool, 1)
+	readers := make(map[string]*closeRecordingReader)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory: func(filename string) (io.Reader, error) {
+				readers[filename] = &closeRecordingReader{Reader: strings.NewReader(filename)}
+				return readers[filename], nil
+			},
+			TransferFactory: transferFactory(&channelNotifier{Out: outgoing, Closed: closed}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+			SessionLimiter:  limiter,
+		},
+	)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foo", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Session did not send data")
+	}
+	first, _ := readSessions.Fetch(fakeAddr)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("bar", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+
+	select {
+	case <-closed:
+		// ok
+	default:
+		t.Fatalf("Transfer of the replaced session was not closed")
+	}
+	if !readers["foo"].closed {
+		t.Errorf("File of the replaced session was not closed")
+	}
+
+	select {
+	case data := <-outgoing:
+		expected := safepackets.NewSafeData(1, []byte("bar"))
+		if !data.Equals(expected) {
+			t.Fatalf("Session sent wrong data packet: got %v, expected %v", data.Bytes(), expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("New session did not send data")
+	}
+
+	if second, found := readSessions.Fetch(fakeAddr); !found || second == first {
+		t.Errorf("New request did not replace the session")
+	}
+	if active := limiter.Stats().Active; active != 1 {
+		t.Errorf("Expected the replaced session to give back its slot, %v are active", active)
+	}
+}
+
+func TestDuplicateWriteRequestResendsAck(t *testing.T) {
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	acks := make(chan *safepackets.SafeAck, 1)
+	created := 0
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writeSessions,
+		&Config{
+			WriterFactory: func(filename string) (io.Writer, error) {
+				created++
+				return &bytes.Buffer{}, nil
+			},
+			TransferFactory: outgoingFactory(nil, acks, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	for i := 0; i < 2; i++ {
+		sessionCreator.CreateWrite(&safetyfilter.IncomingSafeWriteRequest{
+			Write: safepackets.NewSafeWriteRequest("foobar", safepackets.Octet),
+			Addr:  fakeAddr,
+		})
+
+		select {
+		case ack := <-acks:
+			if ack.BlockNumber != 0 {
+				t.Fatalf("Session sent wrong ack: got %v, expected 0", ack.BlockNumber)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Request %v was not acknowledged", i+1)
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("Expected the file to be created once, was created %v times", created)
+	}
+}
+
+func TestWriteRequestReplacesReadSessionOfSameClient(t *testing.T) {
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	outgoing := make(chan *safepackets.SafeData, 1)
+	acks := make(chan *safepackets.SafeAck, 1)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writeSessions,
+		&Config{
+			ReaderFactory:   stringReaderFactory("foobar"),
+			WriterFactory:   writerFactory(&bytes.Buffer{}),
+			TransferFactory: outgoingFactory(outgoing, acks, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+		Addr: fakeAddr,
+	})
+	select {
+	case <-outgoing:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Session did not send data")
+	}
+
+	sessionCreator.CreateWrite(&safetyfilter.IncomingSafeWriteRequest{
+		Write: safepackets.NewSafeWriteRequest("foobar", safepackets.Octet),
+		Addr:  fakeAddr,
+	})
+	select {
+	case <-acks:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Write request was not acknowledged")
+	}
+
+	if _, found := readSessions.Fetch(fakeAddr); found {
+		t.Errorf("Read session of the client was not ended")
+	}
+	if _, found := writeSessions.Fetch(fakeAddr); !found {
+		t.Errorf("Write session was not created")
+	}
+}
+
+func TestNetAsciiModeTranslatesReads(t *testing.T) {
+	readRequest := &safetyfilter.IncomingSafeReadRequest{
+		Read: safepackets.NewSafeReadRequest("foobar", safepackets.NetAscii),
+		Addr: fakeAddr,
+	}
+
+	outgoing := make(chan *safepackets.SafeData, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory:   stringReaderFactory("foo\nbar\n"),
+			TransferFactory: outgoingFactory(outgoing, nil, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateRead(readRequest)
+
+	select {
+	case data := <-outgoing:
+		expected := safepackets.NewSafeData(1, []byte("foo\r\nbar\r\n"))
+		if !data.Equals(expected) {
+			t.Fatalf("Session sent wrong data packet: got %q, expected %q", data.Data.Data, expected.Data.Data)
+		}
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Session did not send data during BeginSession")
+	}
+}
+
+func TestNetAsciiModeTranslatesWrites(t *testing.T) {
+	writeRequest := &safetyfilter.IncomingSafeWriteRequest{
+		Write: safepackets.NewSafeWriteRequest("foobar", safepackets.NetAscii),
+		Addr:  fakeAddr,
+	}
+
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	writer := &closeRecordingWriter{}
+	acks := make(chan *safepackets.SafeAck, 1)
+	sessionCreator := NewSessionCreator(
+		readsessioncollection.NewReadSessionCollection(),
+		writeSessions,
+		&Config{
+			WriterFactory:   writerFactory(writer),
+			TransferFactory: outgoingFactory(nil, acks, nil),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	sessionCreator.CreateWrite(writeRequest)
+	select {
+	case <-acks:
+		// ok
+	case <-time.After(time.Millisecond):
+		t.Fatalf("Session did not send ack during BeginSession")
+	}
+
+	session, _ := writeSessions.Fetch(fakeAddr)
+	session.HandleData(safepackets.NewSafeData(1, []byte("foo\r\nbar\r\x00")))
+	<-acks
+
+	if writer.String() != "foo\nbar\r" {
+		t.Errorf("Session wrote %q, expected %q", writer.String(), "foo\nbar\r")
+	}
+	if !writer.closed {
+		t.Errorf("Session did not close writer after final block")
+	}
+}
+
+func TestFinishedSessionsReleaseGoroutinesAndFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "foobar")
+	if err := os.WriteFile(path, []byte("foobar"), 0644); err != nil {
+		t.Fatalf("Could not write test file: %v", err)
+	}
+
+	baselineGoroutines := runtime.NumGoroutine()
+	baselineFiles := openFileDescriptors(t)
+
+	const sessions = 20
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	outgoing := make(chan *safepackets.SafeData, sessions)
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writesessioncollection.NewWriteSessionCollection(),
+		&Config{
+			ReaderFactory: func(string) (io.Reader, error) {
+				return os.Open(path)
+			},
+			TransferFactory: transferFactory(&channelNotifier{Out: outgoing}),
+			TimeoutPolicy:   TimeoutPolicy{Default: time.Second},
+			TryLimit:        2,
+		},
+	)
+
+	for i := 0; i < sessions; i++ {
+		addr := testhelpers.MakeMockAddr("fake_network", fmt.Sprint(i))
+		sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+			Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+			Addr: addr,
+		})
+
+		select {
+		case <-outgoing:
+			// ok
+		case <-time.After(time.Second):
+			t.Fatalf("Session %v did not send data", i)
+		}
+
+		session, _ := readSessions.Fetch(addr)
+		session.HandleAck(safepackets.NewSafeAck(1))
+	}
+
+	expectGoroutinesToSettle(t, baselineGoroutines)
+	if files := openFileDescriptors(t); files != baselineFiles {
+		t.Errorf("Expected %v open files after sessions finished, found %v", baselineFiles, files)
+	}
+}
+
+func TestExpiredSessionsReleaseGoroutinesAndFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "foobar")
+	if err := os.WriteFile(path, []byte("foobar"), 0644); err != nil {
+		t.Fatalf("Could not write test file: %v", err)
+	}
+
+	baselineGoroutines := runtime.NumGoroutine()
+	baselineFiles := openFileDescriptors(t)
+
+	const sessions = 10
+	readSessions := readsessioncollection.NewReadSessionCollection()
+	writeSessions := writesessioncollection.NewWriteSessionCollection()
+	written := 0
+	sessionCreator := NewSessionCreator(
+		readSessions,
+		writeSessions,
+		&Config{
+			ReaderFactory: func(string) (io.Reader, error) {
+				return os.Open(path)
+			},
+			WriterFactory: func(string) (io.Writer, error) {
+				written++
+				return os.Create(filepath.Join(dir, fmt.Sprint(written)))
+			},
+			TransferFactory: transferFactory(&channelNotifier{
+				Out:  make(chan *safepackets.SafeData, 10*sessions),
+				Acks: make(chan *safepackets.SafeAck, 10*sessions),
+			}),
+			TimeoutPolicy: TimeoutPolicy{Default: time.Millisecond},
+			TryLimit:      2,
+		},
+	)
+
+	var addrs []net.Addr
+	for i := 0; i < sessions; i++ {
+		readAddr := testhelpers.MakeMockAddr("fake_network", fmt.Sprint("read", i))
+		sessionCreator.CreateRead(&safetyfilter.IncomingSafeReadRequest{
+			Read: safepackets.NewSafeReadRequest("foobar", safepackets.Octet),
+			Addr: readAddr,
+		})
+
+		writeAddr := testhelpers.MakeMockAddr("fake_network", fmt.Sprint("write", i))
+		sessionCreator.CreateWrite(&safetyfilter.IncomingSafeWriteRequest{
+			Write: safepackets.NewSafeWriteRequest("foobar", safepackets.Octet),
+			Addr:  writeAddr,
+		})
+
+		addrs = append(addrs, readAddr, writeAddr)
+	}
+
+	// nobody answers, so every session times out
+	deadline := time.Now().Add(time.Second)
+	for _, addr := range addrs {
+		for {
+			_, readFound := readSessions.Fetch(addr)
+			_, writeFound := writeSessions.Fetch(addr)
+			if !readFound && !writeFound {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Session for %v did not expire", addr)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	expectGoroutinesToSettle(t, baselineGoroutines)
+	if files := openFileDescriptors(t); files != baselineFiles {
+		t.Errorf("Expected %v open files after sessions expired, found %v", baselineFiles, files)
+	}
+}
+
+func expectGoroutinesToSettle(t *testing.T, baseline int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected goroutines to return to %v, but %v are running", baseline, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func openFileDescriptors(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("Cannot count open file descriptors on this platform")
+	}
+	return len(entries)
+}
+
+type channelReader struct {
+	In <-chan []byte
+}
+
+// A chunk that does not fill p ends the stream.
+func (r *channelReader) Read(p []byte) (n int, err error) {
+	n = copy(p, <-r.In)
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func readerFactory(in chan []byte) ReaderFromFilename {
+	reader := &channelReader{
+		In: in,
+	}
+
+	return func(filename string) (io.Reader, error) {
+		return reader, nil
+	}
+}
+
+func stringReaderFactory(content string) ReaderFromFilename {
+	return func(filename string) (io.Reader, error) {
+		return strings.NewReader(content), nil
+	}
+}
+
+func errorReaderFactory(err error) ReaderFromFilename {
+	return func(string) (io.Reader, error) {
+		return nil, err
+	}
+}
+
+type closeRecordingReader struct {
+	io.Reader
+	closed bool
+}
+
+func (r *closeRecordingReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+type closeRecordingWriter struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (w *closeRecordingWriter) Close() error {
+	w.closed = true
+	return nil
+}
+
+func writerFactory(writer io.Writer) WriterFromFilename {
+	return func(filename string) (io.Writer, error) {
+		return writer, nil
+	}
+}
+
+func errorWriterFactory(err error) WriterFromFilename {
+	return func(string) (io.Writer, error) {
+		return nil, err
+	}
+}
+
+type channelNotifier struct {
+	Out      chan<- *safepackets.SafeData
+	Acks     chan<- *safepackets.SafeAck
+	Err      chan<- *safepackets.SafeError
+	Oacks    chan<- *safepackets.SafeOptionAck
+	Closed   chan<- bool
+	Received chan<- uint16
+}
+
+func (n *channelNotifier) Receive(blockSize uint16) {
+	if n.Received != nil {
+		n.Received <- blockSize
+	}
+}
+
+func (n *channelNotifier) Close() error {
+	if n.Closed != nil {
+		n.Closed <- true
+	}
+	return nil
+}
+
+func (n *channelNotifier) SendOptionAck(oack *safepackets.SafeOptionAck) {
+	n.Oacks <- oack
+}
+
+func (n *channelNotifier) SendAck(ack *safepackets.SafeAck) {
+	n.Acks <- ack
+}
+
+func (n *channelNotifier) SendData(data *safepackets.SafeData) {
+	n.Out <- data
+}
+
+func (n *channelNotifier) SendError(err *safepackets.SafeError) {
+	n.Err <- err
+}
+
+func outgoingFactory(out chan *safepackets.SafeData, acks chan *safepackets.SafeAck, err chan *safepackets.SafeError) TransferFromAddr {
+	return transferFactory(&channelNotifier{
+		Out:  out,
+		Acks: acks,
+		Err:  err,
+	})
+}
+
+func oackOutgoingFactory(out chan *safepackets.SafeData, acks chan *safepackets.SafeAck, err chan *safepackets.SafeError, oacks chan *safepackets.SafeOptionAck) TransferFromAddr {
+	return transferFactory(&channelNotifier{
+		Out:   out,
+		Acks:  acks,
+		Err:   err,
+		Oacks: oacks,
+	})
+}
+
+func transferFactory(notifier *channelNotifier) TransferFromAddr {
+	return func(net.Addr, netip.Addr) (Transfer, error) {
+		return notifier, nil
+	}
+}
+
+func errorTransferFactory(err error) TransferFromAddr {
+	return func(net.Addr, netip.Addr) (Transfer, error) {
+		return nil, err
 	}
 }
@@ -0,0 +1,214 @@
+package sessionlimiter
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/clientaddr"
+)
+
+// The limit errors are worded for clients, who are sent them when their request is refused.
+var (
+	ErrTooManySessions       = errors.New("Too many transfers, try again later")
+	ErrTooManyClientSessions = errors.New("Too many transfers from this client")
+	ErrTooManyFileSessions   = errors.New("Too many transfers of this file")
+)
+
+// ErrClosed is returned to requests made or still waiting once the limiter is closed.
+var ErrClosed = errors.New("sessionlimiter: Limiter closed")
+
+// Limits bounds how many sessions may be active at once; a zero limit is unlimited.
+type Limits struct {
+	Total     uint
+	PerClient uint // per client IP address, whatever the port
+	PerFile   uint
+
+	// How long a request over a limit may wait for a slot before being refused; zero refuses it at once.
+	QueueTimeout time.Duration
+
+	// How many requests may wait at once; requests beyond it are refused at once.
+	QueueLength uint
+}
+
+// Stats counts sessions and requests at the time of the call.
+type Stats struct {
+	Active  uint
+	Queued  uint
+	Refused uint64 // since the limiter was created
+}
+
+// SessionLimiter hands out a slot to every session, as long as doing so stays within its limits.
+// It is safe for concurrent use.
+type SessionLimiter struct {
+	limits Limits
+
+	mutex   sync.Mutex
+	active  uint
+	clients map[string]uint
+	files   map[string]uint
+	queued  uint
+	refused uint64
+
+	released chan bool // closed, and replaced, whenever a slot is given back
+
+	closeOnce sync.Once
+	closed    chan bool
+}
+
+func NewSessionLimiter(limits Limits) *SessionLimiter {
+	return &SessionLimiter{
+		limits:   limits,
+		clients:  make(map[string]uint),
+		files:    make(map[string]uint),
+		released: make(chan bool),
+		closed:   make(chan bool),
+	}
+}
+
+// Queues reports whether requests over a limit may Wait for a slot.
+func (l *SessionLimiter) Queues() bool {
+	return l.limits.QueueTimeout > 0 && l.limits.QueueLength > 0
+}
+
+// TryAcquire takes a slot for a session of the client at addr on file, returning the function that gives it back,
+// or the error of the first limit that is reached. Refusals are counted unless the limiter Queues,
+// in which case they are counted once Wait gives up.
+func (l *SessionLimiter) TryAcquire(addr net.Addr, file string) (release func(), err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	release, err = l.acquire(clientKey(addr), file)
+	if err != nil && err != ErrClosed && !l.Queues() {
+		l.refused++
+	}
+	return release, err
+}
+
+// Wait is TryAcquire that waits up to Limits.QueueTimeout for a slot, unless Limits.QueueLength requests already wait.
+// Slots are not handed out in any particular order.
+func (l *SessionLimiter) Wait(addr net.Addr, file string) (release func(), err error) {
+	client := clientKey(addr)
+
+	l.mutex.Lock()
+	release, err = l.acquire(client, file)
+	if err == nil || err == ErrClosed {
+		l.mutex.Unlock()
+		return release, err
+	}
+	if !l.Queues() || l.queued >= l.limits.QueueLength {
+		l.refused++
+		l.mutex.Unlock()
+		return nil, err
+	}
+	l.queued++
+	released := l.released
+	l.mutex.Unlock()
+
+	timeout := time.NewTimer(l.limits.QueueTimeout)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case <-released:
+		case <-timeout.C:
+			l.mutex.Lock()
+			l.queued--
+			l.refused++
+			l.mutex.Unlock()
+			return nil, err
+		case <-l.closed:
+			l.mutex.Lock()
+			l.queued--
+			l.mutex.Unlock()
+			return nil, ErrClosed
+		}
+
+		l.mutex.Lock()
+		release, err = l.acquire(client, file)
+		if err == nil {
+			l.queued--
+			l.mutex.Unlock()
+			return release, nil
+		}
+		released = l.released
+		l.mutex.Unlock()
+	}
+}
+
+// Close refuses every waiting and later request with ErrClosed; slots already taken are unaffected.
+func (l *SessionLimiter) Close() {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+}
+
+func (l *SessionLimiter) Stats() Stats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return Stats{
+		Active:  l.active,
+		Queued:  l.queued,
+		Refused: l.refused,
+	}
+}
+
+// acquire must be called with the mutex held.
+func (l *SessionLimiter) acquire(client string, file string) (func(), error) {
+	select {
+	case <-l.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	if l.limits.Total != 0 && l.active >= l.limits.Total {
+		return nil, ErrTooManySessions
+	}
+	if l.limits.PerClient != 0 && l.clients[client] >= l.limits.PerClient {
+		return nil, ErrTooManyClientSessions
+	}
+	if l.limits.PerFile != 0 && l.files[file] >= l.limits.PerFile {
+		return nil, ErrTooManyFileSessions
+	}
+
+	l.active++
+	l.clients[client]++
+	l.files[file]++
+
+	var releaseOnce sync.Once
+	return func() {
+		releaseOnce.Do(func() {
+			l.release(client, file)
+		})
+	}, nil
+}
+
+func (l *SessionLimiter) release(client string, file string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.active--
+	decrement(l.clients, client)
+	decrement(l.files, file)
+
+	close(l.released)
+	l.released = make(chan bool)
+}
+
+// Entries are removed once they reach zero, so that the maps only hold active clients and files.
+func decrement(counts map[string]uint, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+func clientKey(addr net.Addr) string {
+	if addrPort, ok := clientaddr.AddrPort(addr); ok {
+		return addrPort.Addr().String()
+	}
+	return addr.String()
+}
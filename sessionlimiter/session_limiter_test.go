@@ -0,0 +1,202 @@
+package sessionlimiter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mark-rushakoff/go_tftpd/testhelpers"
+)
+
+var clientA = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+
+// the same client, from another port
+var clientAAgain = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1001}
+
+var clientB = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+
+func expectLimit(t *testing.T, err error, expected error) {
+	t.Helper()
+	if err != expected {
+		t.Errorf("Expected %v, got %v", expected, err)
+	}
+}
+
+func TestZeroLimitsAllowEverything(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{})
+
+	for i := 0; i < 100; i++ {
+		if _, err := limiter.TryAcquire(clientA, "file"); err != nil {
+			t.Fatalf("Expected session %v to be allowed, got %v", i, err)
+		}
+	}
+
+	if stats := limiter.Stats(); stats.Active != 100 || stats.Refused != 0 {
+		t.Errorf("Expected 100 active sessions and no refusals, got %+v", stats)
+	}
+}
+
+func TestTotalLimit(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{Total: 2})
+
+	release, _ := limiter.TryAcquire(clientA, "a")
+	limiter.TryAcquire(clientB, "b")
+
+	_, err := limiter.TryAcquire(clientB, "c")
+	expectLimit(t, err, ErrTooManySessions)
+
+	release()
+	release() // giving a slot back twice has no further effect
+	if _, err := limiter.TryAcquire(clientB, "c"); err != nil {
+		t.Errorf("Expected a released slot to be reused, got %v", err)
+	}
+	_, err = limiter.TryAcquire(clientB, "d")
+	expectLimit(t, err, ErrTooManySessions)
+
+	if stats := limiter.Stats(); stats.Active != 2 || stats.Refused != 2 {
+		t.Errorf("Expected 2 active sessions and 2 refusals, got %+v", stats)
+	}
+}
+
+func TestPerClientLimitCountsAddressesNotPorts(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{PerClient: 1})
+
+	limiter.TryAcquire(clientA, "a")
+	_, err := limiter.TryAcquire(clientAAgain, "b")
+	expectLimit(t, err, ErrTooManyClientSessions)
+
+	// as reported by a dual-stack socket
+	_, err = limiter.TryAcquire(&net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 1002}, "c")
+	expectLimit(t, err, ErrTooManyClientSessions)
+
+	if _, err := limiter.TryAcquire(clientB, "a"); err != nil {
+		t.Errorf("Expected another client to be allowed, got %v", err)
+	}
+	if _, err := limiter.TryAcquire(testhelpers.MakeMockAddr("fake_network", "a"), "a"); err != nil {
+		t.Errorf("Expected a client without an IP address to be allowed, got %v", err)
+	}
+}
+
+func TestPerFileLimit(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{PerFile: 2})
+
+	limiter.TryAcquire(clientA, "pxelinux.0")
+	release, _ := limiter.TryAcquire(clientB, "pxelinux.0")
+	_, err := limiter.TryAcquire(clientAAgain, "pxelinux.0")
+	expectLimit(t, err, ErrTooManyFileSessions)
+
+	if _, err := limiter.TryAcquire(clientAAgain, "other"); err != nil {
+		t.Errorf("Expected another file to be allowed, got %v", err)
+	}
+
+	release()
+	if _, err := limiter.TryAcquire(clientAAgain, "pxelinux.0"); err != nil {
+		t.Errorf("Expected a released slot to be reused, got %v", err)
+	}
+}
+
+func TestWaitGetsReleasedSlot(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{Total: 1, QueueTimeout: time.Second, QueueLength: 1})
+	release, _ := limiter.TryAcquire(clientA, "a")
+
+	if _, err := limiter.TryAcquire(clientB, "b"); err != ErrTooManySessions {
+		t.Fatalf("Expected ErrTooManySessions, got %v", err)
+	}
+	if limiter.Stats().Refused != 0 {
+		t.Errorf("Expected a request that may still wait not to be counted as refused")
+	}
+
+	acquired := make(chan error, 1)
+	go func() {
+		_, err := limiter.Wait(clientB, "b")
+		acquired <- err
+	}()
+
+	for limiter.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("Wait returned before a slot was released: %v", err)
+	default:
+		// ok
+	}
+
+	release()
+
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("Expected the waiting request to get the slot, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Wait did not return after a slot was released")
+	}
+
+	if stats := limiter.Stats(); stats.Active != 1 || stats.Queued != 0 || stats.Refused != 0 {
+		t.Errorf("Expected 1 active session and nothing queued or refused, got %+v", stats)
+	}
+}
+
+func TestWaitGivesUpAfterQueueTimeout(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{PerFile: 1, QueueTimeout: 10 * time.Millisecond, QueueLength: 1})
+	limiter.TryAcquire(clientA, "a")
+
+	_, err := limiter.Wait(clientB, "a")
+	expectLimit(t, err, ErrTooManyFileSessions)
+
+	if stats := limiter.Stats(); stats.Queued != 0 || stats.Refused != 1 {
+		t.Errorf("Expected nothing queued and 1 refusal, got %+v", stats)
+	}
+}
+
+func TestWaitRefusesAtOnceWhenQueueIsFull(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{Total: 1, QueueTimeout: time.Second, QueueLength: 1})
+	limiter.TryAcquire(clientA, "a")
+
+	go limiter.Wait(clientB, "b")
+	for limiter.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err := limiter.Wait(clientB, "c")
+	expectLimit(t, err, ErrTooManySessions)
+	if time.Since(start) >= time.Second {
+		t.Errorf("Expected a request beyond the queue to be refused at once")
+	}
+
+	limiter.Close()
+}
+
+func TestCloseRefusesWaitingAndLaterRequests(t *testing.T) {
+	limiter := NewSessionLimiter(Limits{Total: 1, QueueTimeout: 10 * time.Second, QueueLength: 1})
+	release, _ := limiter.TryAcquire(clientA, "a")
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err := limiter.Wait(clientB, "b")
+		waited <- err
+	}()
+	for limiter.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	limiter.Close()
+
+	select {
+	case err := <-waited:
+		expectLimit(t, err, ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatalf("Wait did not return after Close")
+	}
+
+	release()
+	_, err := limiter.TryAcquire(clientB, "b")
+	expectLimit(t, err, ErrClosed)
+
+	if stats := limiter.Stats(); stats.Active != 0 || stats.Queued != 0 || stats.Refused != 0 {
+		t.Errorf("Expected closing not to count as refusing, got %+v", stats)
+	}
+}
@@ -3,15 +3,18 @@ package sessionrouter
 import (
 	"github.com/mark-rushakoff/go_tftpd/readsessioncollection"
 	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
+	"github.com/mark-rushakoff/go_tftpd/writesessioncollection"
 )
 
 type SessionRouter struct {
-	readSessions *readsessioncollection.ReadSessionCollection
+	readSessions  *readsessioncollection.ReadSessionCollection
+	writeSessions *writesessioncollection.WriteSessionCollection
 }
 
-func NewSessionRouter(readSessions *readsessioncollection.ReadSessionCollection) *SessionRouter {
+func NewSessionRouter(readSessions *readsessioncollection.ReadSessionCollection, writeSessions *writesessioncollection.WriteSessionCollection) *SessionRouter {
 	return &SessionRouter{
-		readSessions: readSessions,
+		readSessions:  readSessions,
+		writeSessions: writeSessions,
 	}
 }
 
@@ -23,3 +26,23 @@ func (r *SessionRouter) RouteAck(ack *safetyfilter.IncomingSafeAck) {
 
 	session.HandleAck(ack.Ack)
 }
+
+// RouteError aborts whichever session belongs to the client that sent the error.
+func (r *SessionRouter) RouteError(e *safetyfilter.IncomingSafeError) {
+	if session, found := r.readSessions.Fetch(e.Addr); found {
+		session.HandleError(e.Error)
+	}
+
+	if session, found := r.writeSessions.Fetch(e.Addr); found {
+		session.HandleError(e.Error)
+	}
+}
+
+func (r *SessionRouter) RouteData(data *safetyfilter.IncomingSafeData) {
+	session, found := r.writeSessions.Fetch(data.Addr)
+	if !found {
+		return
+	}
+
+	session.HandleData(data.Data)
+}
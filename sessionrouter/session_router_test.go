@@ -8,11 +8,12 @@ import (
 	"github.com/mark-rushakoff/go_tftpd/safetyfilter"
 	"github.com/mark-rushakoff/go_tftpd/testhelpers"
 	"github.com/mark-rushakoff/go_tftpd/timeoutcontroller"
+	"github.com/mark-rushakoff/go_tftpd/writesessioncollection"
 )
 
 func TestRouteAckRoutes(t *testing.T) {
 	sessions := readsessioncollection.NewReadSessionCollection()
-	router := NewSessionRouter(sessions)
+	router := NewSessionRouter(sessions, writesessioncollection.NewWriteSessionCollection())
 	fakeAddr := testhelpers.MakeMockAddr("fake_network", "a")
 
 	acks := make(chan *safepackets.SafeAck, 1)
@@ -40,7 +41,7 @@ func TestRouteAckRoutes(t *testing.T) {
 
 func TestRouteAckToMissingSessionDoesNotPanic(t *testing.T) {
 	sessions := readsessioncollection.NewReadSessionCollection()
-	router := NewSessionRouter(sessions)
+	router := NewSessionRouter(sessions, writesessioncollection.NewWriteSessionCollection())
 	fakeAddr := testhelpers.MakeMockAddr("fake_network", "a")
 
 	router.RouteAck(&safetyfilter.IncomingSafeAck{
@@ -50,3 +51,113 @@ func TestRouteAckToMissingSessionDoesNotPanic(t *testing.T) {
 
 	// ok
 }
+
+func TestRouteDataRoutes(t *testing.T) {
+	sessions := writesessioncollection.NewWriteSessionCollection()
+	router := NewSessionRouter(readsessioncollection.NewReadSessionCollection(), sessions)
+	fakeAddr := testhelpers.MakeMockAddr("fake_network", "a")
+
+	data := make(chan *safepackets.SafeData, 1)
+	timeoutController := &timeoutcontroller.MockWriteTimeoutController{
+		HandleDataHandler: func(d *safepackets.SafeData) {
+			data <- d
+		},
+	}
+	sessions.Add(timeoutController, fakeAddr)
+
+	router.RouteData(&safetyfilter.IncomingSafeData{
+		Addr: fakeAddr,
+		Data: safepackets.NewSafeData(8, []byte("foo")),
+	})
+
+	select {
+	case d := <-data:
+		if d.BlockNumber != 8 {
+			t.Fatalf("Received incorrect data")
+		}
+	default:
+		t.Fatalf("RouteData should have sent Data")
+	}
+}
+
+func TestRouteDataToMissingSessionDoesNotPanic(t *testing.T) {
+	router := NewSessionRouter(readsessioncollection.NewReadSessionCollection(), writesessioncollection.NewWriteSessionCollection())
+	fakeAddr := testhelpers.MakeMockAddr("fake_network", "a")
+
+	router.RouteData(&safetyfilter.IncomingSafeData{
+		Addr: fakeAddr,
+		Data: safepackets.NewSafeData(8, []byte("foo")),
+	})
+
+	// ok
+}
+
+func TestRouteErrorRoutesToReadSession(t *testing.T) {
+	sessions := readsessioncollection.NewReadSessionCollection()
+	router := NewSessionRouter(sessions, writesessioncollection.NewWriteSessionCollection())
+	fakeAddr := testhelpers.MakeMockAddr("fake_network", "a")
+
+	errors := make(chan *safepackets.SafeError, 1)
+	timeoutController := &timeoutcontroller.MockTimeoutController{
+		HandleErrorHandler: func(e *safepackets.SafeError) {
+			errors <- e
+		},
+	}
+	sessions.Add(timeoutController, fakeAddr)
+
+	sent := &safepackets.SafeError{Message: "cancelled"}
+	router.RouteError(&safetyfilter.IncomingSafeError{
+		Addr:  fakeAddr,
+		Error: sent,
+	})
+
+	select {
+	case e := <-errors:
+		if e != sent {
+			t.Fatalf("Received incorrect error")
+		}
+	default:
+		t.Fatalf("RouteError should have sent Error")
+	}
+}
+
+func TestRouteErrorRoutesToWriteSession(t *testing.T) {
+	sessions := writesessioncollection.NewWriteSessionCollection()
+	router := NewSessionRouter(readsessioncollection.NewReadSessionCollection(), sessions)
+	fakeAddr := testhelpers.MakeMockAddr("fake_network", "a")
+
+	errors := make(chan *safepackets.SafeError, 1)
+	timeoutController := &timeoutcontroller.MockWriteTimeoutController{
+		HandleErrorHandler: func(e *safepackets.SafeError) {
+			errors <- e
+		},
+	}
+	sessions.Add(timeoutController, fakeAddr)
+
+	sent := &safepackets.SafeError{Message: "cancelled"}
+	router.RouteError(&safetyfilter.IncomingSafeError{
+		Addr:  fakeAddr,
+		Error: sent,
+	})
+
+	select {
+	case e := <-errors:
+		if e != sent {
+			t.Fatalf("Received incorrect error")
+		}
+	default:
+		t.Fatalf("RouteError should have sent Error")
+	}
+}
+
+func TestRouteErrorToMissingSessionDoesNotPanic(t *testing.T) {
+	router := NewSessionRouter(readsessioncollection.NewReadSessionCollection(), writesessioncollection.NewWriteSessionCollection())
+	fakeAddr := testhelpers.MakeMockAddr("fake_network", "a")
+
+	router.RouteError(&safetyfilter.IncomingSafeError{
+		Addr:  fakeAddr,
+		Error: &safepackets.SafeError{Message: "cancelled"},
+	})
+
+	// ok
+}
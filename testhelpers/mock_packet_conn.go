@@ -3,6 +3,7 @@ package testhelpers
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
 	"testing"
 	"time"
@@ -89,3 +90,26 @@ func NewMockPacketConnWithBytes(t *testing.T, addr net.Addr, data []interface{})
 		},
 	}
 }
+
+// NewMockPacketConnWithBytesThenClose serves data on the first read, like NewMockPacketConnWithBytes,
+// and then behaves as though the connection was closed. Written packets are sent on the returned channel.
+func NewMockPacketConnWithBytesThenClose(t *testing.T, addr net.Addr, data []interface{}) (*MockPacketConn, <-chan []byte) {
+	conn := NewMockPacketConnWithBytes(t, addr, data)
+	readOnce := conn.ReadFromFunc
+	wasCalledOnce := false
+	conn.ReadFromFunc = func(b []byte) (int, net.Addr, error) {
+		if wasCalledOnce {
+			return 0, nil, errors.New("use of closed network connection")
+		}
+		wasCalledOnce = true
+		return readOnce(b)
+	}
+
+	written := make(chan []byte, 1)
+	conn.WriteToFunc = func(b []byte, _ net.Addr) (int, error) {
+		written <- b
+		return len(b), nil
+	}
+
+	return conn, written
+}
@@ -6,13 +6,68 @@ import (
 
 type MockTimeoutController struct {
 	HandleAckHandler    func(*safepackets.SafeAck)
+	HandleErrorHandler  func(*safepackets.SafeError)
+	AbortHandler        func(*safepackets.SafeError)
 	BeginSessionHandler func()
+	CancelHandler       func()
+
+	HandleDuplicateRequestHandler func()
 }
 
 func (c *MockTimeoutController) HandleAck(ack *safepackets.SafeAck) {
 	c.HandleAckHandler(ack)
 }
 
+func (c *MockTimeoutController) HandleError(e *safepackets.SafeError) {
+	c.HandleErrorHandler(e)
+}
+
 func (c *MockTimeoutController) BeginSession() {
 	c.BeginSessionHandler()
 }
+
+func (c *MockTimeoutController) HandleDuplicateRequest() {
+	c.HandleDuplicateRequestHandler()
+}
+
+func (c *MockTimeoutController) Abort(e *safepackets.SafeError) {
+	c.AbortHandler(e)
+}
+
+func (c *MockTimeoutController) Cancel() {
+	c.CancelHandler()
+}
+
+type MockWriteTimeoutController struct {
+	HandleDataHandler   func(*safepackets.SafeData)
+	HandleErrorHandler  func(*safepackets.SafeError)
+	AbortHandler        func(*safepackets.SafeError)
+	BeginSessionHandler func()
+	CancelHandler       func()
+
+	HandleDuplicateRequestHandler func()
+}
+
+func (c *MockWriteTimeoutController) HandleData(data *safepackets.SafeData) {
+	c.HandleDataHandler(data)
+}
+
+func (c *MockWriteTimeoutController) HandleError(e *safepackets.SafeError) {
+	c.HandleErrorHandler(e)
+}
+
+func (c *MockWriteTimeoutController) BeginSession() {
+	c.BeginSessionHandler()
+}
+
+func (c *MockWriteTimeoutController) HandleDuplicateRequest() {
+	c.HandleDuplicateRequestHandler()
+}
+
+func (c *MockWriteTimeoutController) Abort(e *safepackets.SafeError) {
+	c.AbortHandler(e)
+}
+
+func (c *MockWriteTimeoutController) Cancel() {
+	c.CancelHandler()
+}
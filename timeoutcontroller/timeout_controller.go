@@ -1,15 +1,39 @@
 package timeoutcontroller
 
 import (
+	"sync"
 	"time"
 
 	"github.com/mark-rushakoff/go_tftpd/readsession"
 	"github.com/mark-rushakoff/go_tftpd/safepackets"
+	"github.com/mark-rushakoff/go_tftpd/writesession"
 )
 
 type TimeoutController interface {
 	BeginSession()
 	HandleAck(*safepackets.SafeAck)
+	HandleError(*safepackets.SafeError)
+	HandleDuplicateRequest()
+	Abort(*safepackets.SafeError)
+	Cancel()
+}
+
+type WriteTimeoutController interface {
+	BeginSession()
+	HandleData(*safepackets.SafeData)
+	HandleError(*safepackets.SafeError)
+	HandleDuplicateRequest()
+	Abort(*safepackets.SafeError)
+	Cancel()
+}
+
+// resendingSession is the part of a read or write session that the timeout controller drives directly.
+type resendingSession interface {
+	Begin()
+	Resend()
+	HandleDuplicateRequest()
+	HandleError(*safepackets.SafeError)
+	Abort(*safepackets.SafeError)
 }
 
 type timeoutController struct {
@@ -19,11 +43,25 @@ type timeoutController struct {
 
 	timer timer
 
-	session readsession.ReadSession
+	session resendingSession
 
 	onExpire func()
 
-	done chan bool
+	// serializes calls into the session, which is not safe for concurrent use
+	mutex sync.Mutex
+
+	stopOnce sync.Once
+	stopped  chan bool
+}
+
+type readTimeoutController struct {
+	*timeoutController
+	readSession readsession.ReadSession
+}
+
+type writeTimeoutController struct {
+	*timeoutController
+	writeSession writesession.WriteSession
 }
 
 func NewTimeoutController(duration time.Duration, tryLimit uint, session readsession.ReadSession, onExpire func()) TimeoutController {
@@ -32,7 +70,27 @@ func NewTimeoutController(duration time.Duration, tryLimit uint, session readses
 	return manualTimeoutController(tryLimit, session, onExpire, timer)
 }
 
+func NewWriteTimeoutController(duration time.Duration, tryLimit uint, session writesession.WriteSession, onExpire func()) WriteTimeoutController {
+	timer := newTimer(duration)
+
+	return manualWriteTimeoutController(tryLimit, session, onExpire, timer)
+}
+
 func manualTimeoutController(tryLimit uint, session readsession.ReadSession, onExpire func(), timer timer) TimeoutController {
+	return &readTimeoutController{
+		timeoutController: newTimeoutController(tryLimit, session, onExpire, timer),
+		readSession:       session,
+	}
+}
+
+func manualWriteTimeoutController(tryLimit uint, session writesession.WriteSession, onExpire func(), timer timer) WriteTimeoutController {
+	return &writeTimeoutController{
+		timeoutController: newTimeoutController(tryLimit, session, onExpire, timer),
+		writeSession:      session,
+	}
+}
+
+func newTimeoutController(tryLimit uint, session resendingSession, onExpire func(), timer timer) *timeoutController {
 	counter := &tryCounter{
 		tryLimit:       tryLimit,
 		triesRemaining: tryLimit,
@@ -43,7 +101,7 @@ func manualTimeoutController(tryLimit uint, session readsession.ReadSession, onE
 		timer:      timer,
 		session:    session,
 		onExpire:   onExpire,
-		done:       make(chan bool),
+		stopped:    make(chan bool),
 	}
 
 	go func() {
@@ -51,7 +109,7 @@ func manualTimeoutController(tryLimit uint, session readsession.ReadSession, onE
 			select {
 			case <-timer.Elapsed():
 				c.resendDueToTimeout()
-			case <-c.done:
+			case <-c.stopped:
 				return
 			}
 		}
@@ -61,7 +119,15 @@ func manualTimeoutController(tryLimit uint, session readsession.ReadSession, onE
 }
 
 func (c *timeoutController) BeginSession() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	c.session.Begin()
+	if c.isStopped() {
+		// the session already finished or failed
+		return
+	}
+
 	c.tryCounter.Decrement()
 	if c.tryCounter.IsZero() {
 		c.expire()
@@ -70,13 +136,78 @@ func (c *timeoutController) BeginSession() {
 	}
 }
 
-func (c *timeoutController) HandleAck(ack *safepackets.SafeAck) {
-	c.session.HandleAck(ack)
+func (c *readTimeoutController) HandleAck(ack *safepackets.SafeAck) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readSession.HandleAck(ack)
+	c.responseReceived()
+}
+
+func (c *writeTimeoutController) HandleData(data *safepackets.SafeData) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeSession.HandleData(data)
+	c.responseReceived()
+}
+
+// HandleError aborts the session because the client sent an error; nothing is resent afterwards.
+func (c *timeoutController) HandleError(e *safepackets.SafeError) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stop()
+	c.session.HandleError(e)
+	c.onExpire()
+}
+
+// HandleDuplicateRequest lets the session answer a retransmission of the request that started it.
+// The timer is left alone, as a retransmitted request says nothing about whether the transfer is progressing.
+func (c *timeoutController) HandleDuplicateRequest() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isStopped() {
+		return
+	}
+
+	c.session.HandleDuplicateRequest()
+}
+
+// Abort ends the session on the server's initiative, e.g. when shutting down; the client is sent e.
+func (c *timeoutController) Abort(e *safepackets.SafeError) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.stop()
+	c.session.Abort(e)
+	c.onExpire()
+}
+
+// Cancel stops the timer and the goroutine waiting on it, without expiring the session.
+// It is safe to call more than once, including from the session's own callbacks.
+func (c *timeoutController) Cancel() {
+	c.stop()
+}
+
+func (c *timeoutController) responseReceived() {
+	if c.isStopped() {
+		return
+	}
+
 	c.tryCounter.Reset()
 	c.timer.Restart()
 }
 
 func (c *timeoutController) resendDueToTimeout() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.isStopped() {
+		return
+	}
+
 	if c.tryCounter.IsZero() {
 		c.expire()
 		return
@@ -88,7 +219,22 @@ func (c *timeoutController) resendDueToTimeout() {
 }
 
 func (c *timeoutController) expire() {
+	c.stop()
 	c.onExpire()
-	c.done <- true
-	c.timer.Destroy()
+}
+
+func (c *timeoutController) stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopped)
+		c.timer.Destroy()
+	})
+}
+
+func (c *timeoutController) isStopped() bool {
+	select {
+	case <-c.stopped:
+		return true
+	default:
+		return false
+	}
 }
@@ -3,9 +3,11 @@ package timeoutcontroller
 import (
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/mark-rushakoff/go_tftpd/readsession"
 	"github.com/mark-rushakoff/go_tftpd/safepackets"
+	"github.com/mark-rushakoff/go_tftpd/writesession"
 )
 
 func TestBeginSessionThenTimeoutResendsData(t *testing.T) {
@@ -355,3 +357,287 @@ func TestTimingOutWithMultipleTriesCausesFinish(t *testing.T) {
 		t.Fatalf("Controller did not call expired callback")
 	}
 }
+
+func TestWriteBeginSessionThenTimeoutResendsAck(t *testing.T) {
+	begin := make(chan bool, 1)
+	resend := make(chan bool, 1)
+	session := &writesession.MockWriteSession{
+		BeginHandler: func() {
+			begin <- true
+		},
+		ResendHandler: func() {
+			resend <- true
+		},
+	}
+	timer := NewMockTimer(make(chan bool, 1), make(chan bool, 1))
+	controller := manualWriteTimeoutController(3, session, func() {}, timer)
+	controller.BeginSession()
+
+	select {
+	case <-begin:
+	// ok
+	default:
+		t.Fatalf("Controller did not call session.BeginSession")
+	}
+
+	timer.Elapse()
+
+	select {
+	case <-resend:
+		// ok
+	default:
+		t.Fatalf("Controller did not call resend when timer elapsed")
+	}
+}
+
+func TestDataRestartsTimer(t *testing.T) {
+	restartTimer := make(chan bool, 1)
+	data := make(chan *safepackets.SafeData, 1)
+	session := &writesession.MockWriteSession{
+		BeginHandler: func() {
+		},
+		HandleDataHandler: func(d *safepackets.SafeData) {
+			data <- d
+		},
+	}
+	timer := NewMockTimer(restartTimer, make(chan bool, 1))
+	controller := manualWriteTimeoutController(3, session, func() {}, timer)
+	controller.BeginSession()
+	select {
+	case <-restartTimer:
+		// ok
+	default:
+		t.Fatalf("Timer should have been restarted upon begin")
+	}
+
+	controller.HandleData(safepackets.NewSafeData(8, []byte("foo")))
+	select {
+	case <-restartTimer:
+		// ok
+	default:
+		t.Fatalf("Timer should have been restarted upon handling data")
+	}
+	select {
+	case d := <-data:
+		if d.BlockNumber != 8 {
+			t.Errorf("Controller sent data with wrong block number")
+		}
+	default:
+		t.Fatalf("Controller did not forward data to session")
+	}
+}
+
+func TestDuplicateRequestIsForwardedWithoutTouchingTimer(t *testing.T) {
+	duplicates := make(chan bool, 1)
+	restartTimer := make(chan bool, 1)
+	session := &readsession.MockReadSession{
+		BeginHandler: func() {
+		},
+		HandleDuplicateRequestHandler: func() {
+			duplicates <- true
+		},
+		AbortHandler: func(e *safepackets.SafeError) {
+		},
+	}
+	timer := NewMockTimer(restartTimer, make(chan bool, 1))
+	controller := manualTimeoutController(3, session, func() {}, timer)
+	controller.BeginSession()
+	<-restartTimer
+
+	controller.HandleDuplicateRequest()
+
+	select {
+	case <-duplicates:
+		// ok
+	default:
+		t.Fatalf("Controller did not forward the duplicate request to the session")
+	}
+
+	select {
+	case <-restartTimer:
+		t.Fatalf("Controller restarted the timer for a duplicate request")
+	default:
+		// ok
+	}
+
+	controller.Abort(safepackets.NewServerShuttingDownError())
+	controller.HandleDuplicateRequest()
+
+	select {
+	case <-duplicates:
+		t.Fatalf("Controller forwarded a duplicate request after stopping")
+	default:
+		// ok
+	}
+}
+
+func TestErrorStopsTimerAndFinishes(t *testing.T) {
+	sessionErrors := make(chan *safepackets.SafeError, 1)
+	destroyTimer := make(chan bool, 1)
+	finished := make(chan bool, 1)
+	session := &readsession.MockReadSession{
+		BeginHandler: func() {
+		},
+		HandleErrorHandler: func(e *safepackets.SafeError) {
+			sessionErrors <- e
+		},
+	}
+	timer := NewMockTimer(make(chan bool, 1), destroyTimer)
+	controller := manualTimeoutController(3, session, func() {
+		finished <- true
+	}, timer)
+	controller.BeginSession()
+
+	sent := &safepackets.SafeError{Message: "cancelled"}
+	controller.HandleError(sent)
+
+	select {
+	case e := <-sessionErrors:
+		if e != sent {
+			t.Errorf("Controller forwarded the wrong error")
+		}
+	default:
+		t.Fatalf("Controller did not forward error to session")
+	}
+
+	select {
+	case <-destroyTimer:
+		// ok
+	default:
+		t.Fatalf("Controller did not destroy timer after error")
+	}
+
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Fatalf("Controller did not finish after error")
+	}
+}
+
+func TestAbortStopsTimerAndFinishes(t *testing.T) {
+	sessionAborts := make(chan *safepackets.SafeError, 1)
+	destroyTimer := make(chan bool, 1)
+	finished := make(chan bool, 1)
+	session := &readsession.MockReadSession{
+		BeginHandler: func() {
+		},
+		AbortHandler: func(e *safepackets.SafeError) {
+			sessionAborts <- e
+		},
+	}
+	timer := NewMockTimer(make(chan bool, 1), destroyTimer)
+	controller := manualTimeoutController(3, session, func() {
+		finished <- true
+	}, timer)
+	controller.BeginSession()
+
+	sent := safepackets.NewServerShuttingDownError()
+	controller.Abort(sent)
+
+	select {
+	case e := <-sessionAborts:
+		if e != sent {
+			t.Errorf("Controller forwarded the wrong error")
+		}
+	default:
+		t.Fatalf("Controller did not abort session")
+	}
+
+	select {
+	case <-destroyTimer:
+		// ok
+	default:
+		t.Fatalf("Controller did not destroy timer after abort")
+	}
+
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Fatalf("Controller did not finish after abort")
+	}
+}
+
+func TestExpiringStopsController(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	destroyTimer := make(chan bool, 1)
+	expired := make(chan bool, 2)
+	session := &readsession.MockReadSession{
+		BeginHandler: func() {
+		},
+		ResendHandler: func() {
+		},
+	}
+	timer := NewMockTimer(make(chan bool, 3), destroyTimer)
+	controller := manualTimeoutController(2, session, func() {
+		expired <- true
+	}, timer)
+	controller.BeginSession()
+
+	timer.Elapse()
+	timer.Elapse()
+
+	select {
+	case <-expired:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Controller did not expire")
+	}
+
+	select {
+	case <-destroyTimer:
+		// ok
+	case <-time.After(time.Second):
+		t.Fatalf("Controller did not destroy timer upon expiring")
+	}
+
+	// the controller's goroutine must have returned rather than deadlocking on itself
+	expectGoroutinesToSettle(t, baseline)
+
+	// cancelling an expired controller is harmless
+	controller.Cancel()
+	if len(expired) != 0 {
+		t.Errorf("Controller expired more than once")
+	}
+}
+
+func TestCancelStopsControllerWithoutExpiring(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	restartTimer := make(chan bool, 2)
+	destroyTimer := make(chan bool, 1)
+	session := &readsession.MockReadSession{
+		BeginHandler: func() {
+		},
+		HandleAckHandler: func(*safepackets.SafeAck) {
+		},
+	}
+	timer := NewMockTimer(restartTimer, destroyTimer)
+	controller := manualTimeoutController(3, session, func() {
+		t.Errorf("Cancelled controller should not expire")
+	}, timer)
+	controller.BeginSession()
+	<-restartTimer
+
+	controller.Cancel()
+	controller.Cancel()
+
+	select {
+	case <-destroyTimer:
+		// ok
+	default:
+		t.Fatalf("Controller did not destroy timer upon cancel")
+	}
+
+	controller.HandleAck(safepackets.NewSafeAck(1))
+	select {
+	case <-restartTimer:
+		t.Errorf("Cancelled controller should not restart its timer")
+	default:
+		// ok
+	}
+
+	expectGoroutinesToSettle(t, baseline)
+}
@@ -18,7 +18,9 @@ type manualTimer struct {
 
 	elapsed chan bool
 	restart chan bool
-	destroy chan bool
+
+	destroyOnce sync.Once
+	destroyed   chan bool
 }
 
 func newTimer(duration time.Duration) timer {
@@ -26,9 +28,9 @@ func newTimer(duration time.Duration) timer {
 		duration:   duration,
 		waitFactor: 1,
 
-		restart: make(chan bool, 1),
-		elapsed: make(chan bool, 1),
-		destroy: make(chan bool, 1),
+		restart:   make(chan bool, 1),
+		elapsed:   make(chan bool, 1),
+		destroyed: make(chan bool),
 	}
 
 	go t.watch()
@@ -41,21 +43,30 @@ func (t *manualTimer) Elapsed() <-chan bool {
 }
 
 func (t *manualTimer) Restart() {
-	t.restart <- true
+	select {
+	case t.restart <- true:
+	default:
+		// a restart is already pending
+	}
 
 	t.mutex.Lock()
 	t.waitFactor = 1
 	t.mutex.Unlock()
 }
 
+// Destroy stops the timer for good; it may be called more than once.
 func (t *manualTimer) Destroy() {
-	t.destroy <- true
+	t.destroyOnce.Do(func() {
+		close(t.destroyed)
+	})
 }
 
 func (t *manualTimer) watch() {
 	select {
 	case <-t.restart:
 		// need initial restart call to get going
+	case <-t.destroyed:
+		return
 	}
 
 	for {
@@ -65,13 +76,17 @@ func (t *manualTimer) watch() {
 
 		select {
 		case <-time.After(duration):
-			t.elapsed <- true
+			select {
+			case t.elapsed <- true:
+			case <-t.destroyed:
+				return
+			}
 			t.mutex.Lock()
 			t.waitFactor *= 2
 			t.mutex.Unlock()
 		case <-t.restart:
 			// just restart the loop
-		case <-t.destroy:
+		case <-t.destroyed:
 			return
 		}
 	}
@@ -1,6 +1,7 @@
 package timeoutcontroller
 
 import (
+	"runtime"
 	"testing"
 	"time"
 )
@@ -111,3 +112,39 @@ func TestDestroyDoesNotElapseTimer(t *testing.T) {
 		// ok
 	}
 }
+
+func TestDestroyStopsUnstartedTimers(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 10; i++ {
+		timer := newTimer(time.Millisecond)
+		timer.Destroy()
+		// a second destroy, or a restart after destroy, must not block
+		timer.Destroy()
+		timer.Restart()
+	}
+
+	expectGoroutinesToSettle(t, baseline)
+}
+
+func TestDestroyStopsTimerWaitingToDeliverElapse(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+
+	timer := newTimer(time.Millisecond)
+	timer.Restart()
+	// nobody reads Elapsed, so the timer fills its buffer and then waits to deliver another elapse
+	time.Sleep(5 * time.Millisecond)
+	timer.Destroy()
+
+	expectGoroutinesToSettle(t, baseline)
+}
+
+func expectGoroutinesToSettle(t *testing.T, baseline int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected goroutines to return to %v, but %v are running", baseline, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
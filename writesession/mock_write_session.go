@@ -0,0 +1,39 @@
+package writesession
+
+import (
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+type MockWriteSession struct {
+	BeginHandler       func()
+	HandleDataHandler  func(data *safepackets.SafeData)
+	HandleErrorHandler func(e *safepackets.SafeError)
+	AbortHandler       func(e *safepackets.SafeError)
+	ResendHandler      func()
+
+	HandleDuplicateRequestHandler func()
+}
+
+func (s *MockWriteSession) Begin() {
+	s.BeginHandler()
+}
+
+func (s *MockWriteSession) HandleData(data *safepackets.SafeData) {
+	s.HandleDataHandler(data)
+}
+
+func (s *MockWriteSession) HandleError(e *safepackets.SafeError) {
+	s.HandleErrorHandler(e)
+}
+
+func (s *MockWriteSession) Abort(e *safepackets.SafeError) {
+	s.AbortHandler(e)
+}
+
+func (s *MockWriteSession) Resend() {
+	s.ResendHandler()
+}
+
+func (s *MockWriteSession) HandleDuplicateRequest() {
+	s.HandleDuplicateRequestHandler()
+}
@@ -0,0 +1,29 @@
+package writesession
+
+import (
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+type OutgoingHandler interface {
+	SendAck(*safepackets.SafeAck)
+	SendError(*safepackets.SafeError)
+	SendOptionAck(*safepackets.SafeOptionAck)
+}
+
+type PluggableHandler struct {
+	SendAckHandler       func(*safepackets.SafeAck)
+	SendErrorHandler     func(*safepackets.SafeError)
+	SendOptionAckHandler func(*safepackets.SafeOptionAck)
+}
+
+func (h *PluggableHandler) SendAck(ack *safepackets.SafeAck) {
+	h.SendAckHandler(ack)
+}
+
+func (h *PluggableHandler) SendError(e *safepackets.SafeError) {
+	h.SendErrorHandler(e)
+}
+
+func (h *PluggableHandler) SendOptionAck(oack *safepackets.SafeOptionAck) {
+	h.SendOptionAckHandler(oack)
+}
@@ -0,0 +1,172 @@
+package writesession
+
+import (
+	"io"
+
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+type Config struct {
+	Writer    io.Writer
+	BlockSize uint16
+
+	// How block numbers wrap after block 65535
+	BlockSequence safepackets.BlockSequence
+
+	// When set, the session acknowledges the request with OptionAck instead of ack 0.
+	OptionAck *safepackets.SafeOptionAck
+
+	// Called once the final block has been written, before it is acknowledged, e.g. to give the file its name.
+	// If it fails, the client is sent an error instead. May be nil.
+	Commit func() error
+}
+
+type WriteSession interface {
+	Begin()
+	HandleData(data *safepackets.SafeData)
+	HandleError(e *safepackets.SafeError)
+	Abort(e *safepackets.SafeError)
+	Resend()
+	HandleDuplicateRequest()
+}
+
+type writeSession struct {
+	config  *Config
+	handler OutgoingHandler
+
+	currentBlockNumber uint16
+	currentAckPacket   *safepackets.SafeAck
+
+	// Block numbers wrap, so block 0 alone does not mean the transfer has not started.
+	receivedData bool
+
+	// Once finished, the session only re-acknowledges duplicates of the final block (i.e. it dallies).
+	finished bool
+	failed   bool
+	onFinish func()
+
+	// the error the client aborted the transfer with, if any
+	clientError *safepackets.SafeError
+}
+
+// onFinish is called once the session will not write any more data,
+// either because the final block was received or because writing failed.
+func NewWriteSession(config *Config, handler OutgoingHandler, onFinish func()) *writeSession {
+	return &writeSession{
+		config:   config,
+		handler:  handler,
+		onFinish: onFinish,
+	}
+}
+
+func (s *writeSession) Begin() {
+	s.currentAckPacket = safepackets.NewSafeAck(s.currentBlockNumber)
+	s.sendAck()
+}
+
+func (s *writeSession) HandleData(data *safepackets.SafeData) {
+	if s.failed {
+		return
+	}
+
+	if data.BlockNumber == s.currentBlockNumber {
+		// our ack was lost, or the client is retransmitting the final block while we dally
+		s.sendAck()
+		return
+	}
+
+	if s.finished || data.BlockNumber != s.config.BlockSequence.Next(s.currentBlockNumber) {
+		return
+	}
+
+	if s.config.Writer == nil {
+		panic("Config.Writer is nil")
+	}
+
+	if len(data.Data.Data) > int(s.config.BlockSize) {
+		// the client disagrees about the block size, so none of what it sends can be trusted
+		s.failed = true
+		s.finished = true
+		s.handler.SendError(safepackets.NewIllegalTftpOperationError("Block larger than the negotiated block size"))
+		s.onFinish()
+		return
+	}
+
+	_, err := s.config.Writer.Write(data.Data.Data)
+	final := len(data.Data.Data) < int(s.config.BlockSize)
+	if err == nil && final && s.config.Commit != nil {
+		err = s.config.Commit()
+	}
+	if err != nil {
+		s.failed = true
+		s.finished = true
+		s.handler.SendError(safepackets.NewErrorFromFileError(err, safepackets.NewWriteFailedError()))
+		s.onFinish()
+		return
+	}
+
+	s.receivedData = true
+	s.currentBlockNumber = data.BlockNumber
+	s.currentAckPacket = safepackets.NewSafeAck(s.currentBlockNumber)
+	s.sendAck()
+
+	if final {
+		s.finished = true
+		s.onFinish()
+	}
+}
+
+// HandleError records why the client aborted the transfer and stops acknowledging data.
+// Tearing down the session is left to the caller.
+func (s *writeSession) HandleError(e *safepackets.SafeError) {
+	s.clientError = e
+	s.failed = true
+	s.finished = true
+}
+
+// Abort ends the transfer on the server's initiative, e.g. when shutting down, and tells the client why.
+// A session that is only dallying has all of its data, so the client is not told anything.
+// Tearing down the session is left to the caller.
+func (s *writeSession) Abort(e *safepackets.SafeError) {
+	if s.finished {
+		return
+	}
+
+	s.failed = true
+	s.finished = true
+	s.handler.SendError(e)
+}
+
+func (s *writeSession) ClientError() *safepackets.SafeError {
+	return s.clientError
+}
+
+func (s *writeSession) Resend() {
+	if s.finished {
+		// the client is responsible for retransmitting the final block if our last ack was lost
+		return
+	}
+
+	s.sendAck()
+}
+
+// HandleDuplicateRequest answers a retransmission of the request that started the session.
+// Until the client sends data, the acknowledgement of its request may have been lost, so it is resent;
+// afterwards the request can only be a delayed duplicate and is ignored.
+// Before Begin, there is nothing to resend; Begin answers the request.
+func (s *writeSession) HandleDuplicateRequest() {
+	if s.currentAckPacket == nil || s.finished || s.receivedData {
+		return
+	}
+
+	s.sendAck()
+}
+
+func (s *writeSession) sendAck() {
+	if !s.receivedData && s.config.OptionAck != nil {
+		s.handler.SendOptionAck(s.config.OptionAck)
+		return
+	}
+
+	s.handler.SendAck(s.currentAckPacket)
+}
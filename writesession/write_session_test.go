@@ -0,0 +1,770 @@
+package writesession
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"syscall"
+	"testing"
+
+	"github.com/mark-rushakoff/go_tftpd/packets"
+	"github.com/mark-rushakoff/go_tftpd/safepackets"
+)
+
+func TestBeginSendsAckZero(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	config := &Config{
+		Writer:    &bytes.Buffer{},
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 0 {
+			t.Errorf("Expected block number 0, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Did not see ack packet in time")
+	}
+}
+
+func TestNextDataIsWrittenAndAcked(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 1 {
+			t.Errorf("Expected block number 1, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Did not see ack packet in time")
+	}
+
+	if buf.String() != "fo" {
+		t.Errorf("Expected 'fo' to be written, saw %v", buf.String())
+	}
+}
+
+func TestDuplicateDataIsReackedButNotRewritten(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 1 {
+			t.Errorf("Expected block number 1, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Did not see ack packet in time")
+	}
+
+	if buf.String() != "fo" {
+		t.Errorf("Expected 'fo' to be written once, saw %v", buf.String())
+	}
+}
+
+func TestOutOfOrderDataIsIgnored(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(2, []byte("ob")))
+	select {
+	case a := <-ackChan:
+		t.Fatalf("Expected no ack for out of order data, saw ack %v", a.BlockNumber)
+	default:
+		// ok
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written, saw %v", buf.String())
+	}
+}
+
+func TestResendRepeatsAck(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	config := &Config{
+		Writer:    &bytes.Buffer{},
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+	<-ackChan
+
+	session.Resend()
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 0 {
+			t.Errorf("Expected block number 0, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Did not see ack packet in time")
+	}
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	<-ackChan
+
+	session.Resend()
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 1 {
+			t.Errorf("Expected block number 1, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Did not see ack packet in time")
+	}
+}
+
+func TestDuplicateRequestResendsOnlyUntilFirstData(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	config := &Config{
+		Writer:    &bytes.Buffer{},
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+
+	session.HandleDuplicateRequest()
+	select {
+	case a := <-ackChan:
+		t.Fatalf("Duplicate request before Begin caused ack %v to be sent", a.BlockNumber)
+	default:
+		// ok
+	}
+
+	session.Begin()
+	<-ackChan
+
+	session.HandleDuplicateRequest()
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 0 {
+			t.Errorf("Expected block number 0, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Duplicate request did not resend ack 0")
+	}
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	<-ackChan
+
+	session.HandleDuplicateRequest()
+	select {
+	case a := <-ackChan:
+		t.Fatalf("Delayed duplicate request caused ack %v to be sent", a.BlockNumber)
+	default:
+		// ok
+	}
+}
+
+func TestShortBlockFinishesAndDallies(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	finished := make(chan bool, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 5,
+	}
+	session := NewWriteSession(config, handler, func() {
+		finished <- true
+	})
+	session.Begin()
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fooba")))
+	<-ackChan
+	select {
+	case <-finished:
+		t.Errorf("Expected session not to be finished before short block arrived")
+	default:
+		// ok
+	}
+
+	session.HandleData(safepackets.NewSafeData(2, []byte("r")))
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 2 {
+			t.Errorf("Expected block number 2, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Final block was not acked")
+	}
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Errorf("Expected session to be finished after short block arrived")
+	}
+
+	if buf.String() != "foobar" {
+		t.Errorf("Expected foobar to be written, saw %v", buf.String())
+	}
+
+	session.Resend()
+	select {
+	case <-ackChan:
+		t.Errorf("Dallying session should not resend on its own")
+	default:
+		// ok
+	}
+
+	session.HandleData(safepackets.NewSafeData(2, []byte("r")))
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 2 {
+			t.Errorf("Expected block number 2, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Dallying session did not re-ack retransmitted final block")
+	}
+
+	if buf.String() != "foobar" {
+		t.Errorf("Expected foobar to be written once, saw %v", buf.String())
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("input/output error")
+}
+
+type fullDiskWriter struct{}
+
+func (fullDiskWriter) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: "/srv/tftp/upload", Err: syscall.ENOSPC}
+}
+
+func TestWriteFailureCausesError(t *testing.T) {
+	errorChan := make(chan *safepackets.SafeError, 1)
+	finished := make(chan bool, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(*safepackets.SafeAck) {
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	config := &Config{
+		Writer:    failingWriter{},
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {
+		finished <- true
+	})
+	session.Begin()
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	select {
+	case e := <-errorChan:
+		if !e.Equals(safepackets.NewWriteFailedError()) {
+			t.Fatalf("Received incorrect error: %v", e.Message)
+		}
+	default:
+		t.Fatalf("Error not sent when expected")
+	}
+
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Fatalf("Session should have been marked as finished")
+	}
+}
+
+func TestFullDiskCausesDiskFullError(t *testing.T) {
+	errorChan := make(chan *safepackets.SafeError, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(*safepackets.SafeAck) {
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	config := &Config{
+		Writer:    fullDiskWriter{},
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	select {
+	case e := <-errorChan:
+		if !e.Equals(safepackets.NewDiskFullError()) {
+			t.Fatalf("Received incorrect error: %v", e.Message)
+		}
+	default:
+		t.Fatalf("Error not sent when expected")
+	}
+}
+
+func TestFinalBlockIsCommittedBeforeItIsAcknowledged(t *testing.T) {
+	events := make(chan string, 3)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			if a.BlockNumber == 2 {
+				events <- "ack"
+			}
+		},
+	}
+	config := &Config{
+		Writer:    &bytes.Buffer{},
+		BlockSize: 2,
+		Commit: func() error {
+			events <- "commit"
+			return nil
+		},
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	select {
+	case e := <-events:
+		t.Fatalf("Expected nothing before the final block, got %v", e)
+	default:
+		// ok
+	}
+
+	session.HandleData(safepackets.NewSafeData(2, []byte("o")))
+	for _, expected := range []string{"commit", "ack"} {
+		select {
+		case e := <-events:
+			if e != expected {
+				t.Fatalf("Expected %v, got %v", expected, e)
+			}
+		default:
+			t.Fatalf("Expected %v", expected)
+		}
+	}
+}
+
+func TestCommitFailureCausesErrorInsteadOfAck(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	errorChan := make(chan *safepackets.SafeError, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	config := &Config{
+		Writer:    &bytes.Buffer{},
+		BlockSize: 2,
+		Commit: func() error {
+			return &fs.PathError{Op: "create", Path: "upload", Err: fs.ErrExist}
+		},
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("f")))
+	select {
+	case e := <-errorChan:
+		if !e.Equals(safepackets.NewFileAlreadyExistsError()) {
+			t.Fatalf("Received incorrect error: %v", e.Message)
+		}
+	default:
+		t.Fatalf("Error not sent when expected")
+	}
+
+	select {
+	case a := <-ackChan:
+		t.Fatalf("Final block was acknowledged with ack %v although committing failed", a.BlockNumber)
+	default:
+		// ok
+	}
+}
+
+func TestClientErrorStopsWriting(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 2)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+	}
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {
+		t.Errorf("Session should leave finishing to its caller after a client error")
+	})
+	session.Begin()
+	<-ackChan
+
+	clientError := &safepackets.SafeError{Code: 0, Message: "cancelled"}
+	session.HandleError(clientError)
+	if session.ClientError() != clientError {
+		t.Errorf("Expected session to record the client's error, got %v", session.ClientError())
+	}
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	session.Resend()
+
+	select {
+	case a := <-ackChan:
+		t.Errorf("Expected no ack after client error, saw ack %v", a.BlockNumber)
+	default:
+		// ok
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written after client error, saw %v", buf.String())
+	}
+}
+
+func TestAbortSendsErrorAndStopsWriting(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 2)
+	errorChan := make(chan *safepackets.SafeError, 2)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {
+		t.Errorf("Session should leave finishing to its caller after aborting")
+	})
+	session.Begin()
+	<-ackChan
+
+	shuttingDown := safepackets.NewServerShuttingDownError()
+	session.Abort(shuttingDown)
+
+	select {
+	case e := <-errorChan:
+		if e != shuttingDown {
+			t.Errorf("Expected abort error to be sent, got %v", e)
+		}
+	default:
+		t.Fatalf("Expected an error to be sent on abort")
+	}
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("fo")))
+	session.Resend()
+
+	select {
+	case a := <-ackChan:
+		t.Errorf("Expected no ack after abort, saw ack %v", a.BlockNumber)
+	default:
+		// ok
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written after abort, saw %v", buf.String())
+	}
+}
+
+func TestAbortWhileDallyingSendsNothing(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 2)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			t.Errorf("Expected no error once all data was received, saw %v", e.Message)
+		},
+	}
+	config := &Config{
+		Writer:    &bytes.Buffer{},
+		BlockSize: 2,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("f")))
+	<-ackChan
+
+	session.Abort(safepackets.NewServerShuttingDownError())
+}
+
+func TestOptionAckIsSentInsteadOfAckZero(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	oackChan := make(chan *safepackets.SafeOptionAck, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+		SendOptionAckHandler: func(oack *safepackets.SafeOptionAck) {
+			oackChan <- oack
+		},
+	}
+	oack := safepackets.NewSafeOptionAck(map[string]string{"blksize": "3"})
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 3,
+		OptionAck: oack,
+	}
+	session := NewWriteSession(config, handler, func() {})
+	session.Begin()
+
+	select {
+	case o := <-oackChan:
+		if o != oack {
+			t.Errorf("Session sent wrong option ack: %v", o)
+		}
+	default:
+		t.Fatalf("Did not see option ack packet in time")
+	}
+
+	session.Resend()
+	select {
+	case <-oackChan:
+		// ok
+	case <-ackChan:
+		t.Fatalf("Resend sent ack 0 instead of option ack")
+	default:
+		t.Fatalf("Resend did not repeat option ack")
+	}
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("foo")))
+	select {
+	case a := <-ackChan:
+		if a.BlockNumber != 1 {
+			t.Errorf("Expected block number 1, got %v", a.BlockNumber)
+		}
+	default:
+		t.Fatalf("Did not see ack packet in time")
+	}
+
+	if buf.String() != "foo" {
+		t.Errorf("Expected foo to be written, saw %v", buf.String())
+	}
+}
+
+func TestOversizedBlockCausesErrorInsteadOfAck(t *testing.T) {
+	ackChan := make(chan *safepackets.SafeAck, 1)
+	errorChan := make(chan *safepackets.SafeError, 1)
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			ackChan <- a
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			errorChan <- e
+		},
+	}
+	buf := &bytes.Buffer{}
+	config := &Config{
+		Writer:    buf,
+		BlockSize: 3,
+	}
+	finished := make(chan bool, 1)
+	session := NewWriteSession(config, handler, func() {
+		finished <- true
+	})
+	session.Begin()
+	<-ackChan
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("food")))
+	select {
+	case e := <-errorChan:
+		if e.Code != packets.IllegalTftpOperation {
+			t.Errorf("Expected Illegal TFTP operation error, got %v", e.Code)
+		}
+	case a := <-ackChan:
+		t.Fatalf("Oversized block was acknowledged as block %v", a.BlockNumber)
+	default:
+		t.Fatalf("Did not see error packet in time")
+	}
+
+	select {
+	case <-finished:
+		// ok
+	default:
+		t.Errorf("Session did not finish after oversized block")
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be written, saw %v", buf.String())
+	}
+
+	session.HandleData(safepackets.NewSafeData(1, []byte("foo")))
+	select {
+	case a := <-ackChan:
+		t.Errorf("Failed session acknowledged block %v", a.BlockNumber)
+	default:
+		// ok
+	}
+}
+
+func TestLargeTransfersRollOverBlockNumbers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large transfer in short mode")
+	}
+
+	// several times the 65535 blocks of 512 bytes that fit before the first rollover
+	const size = 200*1024*1024 + 100
+
+	for _, rolloverTarget := range []uint16{0, 1} {
+		simulateLargeWrite(t, size, rolloverTarget)
+	}
+}
+
+// simulateLargeWrite plays the client side of a lossless connection, sending each block once the previous one is acked.
+func simulateLargeWrite(t *testing.T, size int64, rolloverTarget uint16) {
+	var acks []*safepackets.SafeAck
+	handler := &PluggableHandler{
+		SendAckHandler: func(a *safepackets.SafeAck) {
+			acks = append(acks, a)
+		},
+		SendErrorHandler: func(e *safepackets.SafeError) {
+			t.Fatalf("Unexpected error with rollover to %v: %v", rolloverTarget, e.Message)
+		},
+	}
+	writer := &patternCheckingWriter{t: t}
+	config := &Config{
+		Writer:        writer,
+		BlockSize:     512,
+		BlockSequence: safepackets.BlockSequence{RolloverTarget: rolloverTarget},
+	}
+	finished := false
+	session := NewWriteSession(config, handler, func() {
+		finished = true
+	})
+
+	source := &patternReader{}
+	blockNumber := uint16(0)
+	var sent int64
+	rollovers := 0
+	session.Begin()
+
+	for !finished {
+		if len(acks) != 1 || acks[0].BlockNumber != blockNumber {
+			t.Fatalf("Expected a single ack of block %v after %v bytes, got %v", blockNumber, sent, acks)
+		}
+		acks = nil
+
+		if blockNumber == 65535 {
+			blockNumber = rolloverTarget
+			rollovers++
+		} else {
+			blockNumber++
+		}
+
+		blockSize := int64(512)
+		if size-sent < blockSize {
+			blockSize = size - sent
+		}
+		data := make([]byte, blockSize)
+		source.Read(data)
+		sent += blockSize
+
+		session.HandleData(safepackets.NewSafeData(blockNumber, data))
+	}
+
+	if len(acks) != 1 || acks[0].BlockNumber != blockNumber {
+		t.Errorf("Expected final block %v to be acked, got %v", blockNumber, acks)
+	}
+	if writer.written != size {
+		t.Errorf("Expected %v bytes to be written, got %v", size, writer.written)
+	}
+	if rollovers < 2 {
+		t.Errorf("Expected block numbers to roll over several times, saw %v", rollovers)
+	}
+}
+
+// patternReader endlessly produces the same predictable bytes, so transfers can be checked without holding them in memory.
+type patternReader struct {
+	offset int64
+}
+
+func (r *patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte((r.offset + int64(i)) % 251)
+	}
+	r.offset += int64(len(p))
+	return len(p), nil
+}
+
+type patternCheckingWriter struct {
+	t       *testing.T
+	written int64
+}
+
+func (w *patternCheckingWriter) Write(p []byte) (int, error) {
+	for i, b := range p {
+		if b != byte((w.written+int64(i))%251) {
+			w.t.Fatalf("Unexpected byte written at offset %v", w.written+int64(i))
+		}
+	}
+	w.written += int64(len(p))
+	return len(p), nil
+}
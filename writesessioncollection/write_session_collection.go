@@ -0,0 +1,78 @@
+package writesessioncollection
+
+import (
+	"net"
+	"sync"
+
+	"github.com/mark-rushakoff/go_tftpd/clientaddr"
+	"github.com/mark-rushakoff/go_tftpd/timeoutcontroller"
+)
+
+// Sessions are keyed on the client's normalized address, e.g. so that IPv6 zones and
+// IPv4-mapped addresses from dual-stack sockets find the same session however they are spelled.
+type sessionKey clientaddr.Key
+
+type WriteSessionCollection struct {
+	sessions map[sessionKey]timeoutcontroller.WriteTimeoutController
+	lock     sync.RWMutex
+}
+
+func NewWriteSessionCollection() *WriteSessionCollection {
+	return &WriteSessionCollection{
+		sessions: make(map[sessionKey]timeoutcontroller.WriteTimeoutController),
+	}
+}
+
+func (s *WriteSessionCollection) Add(session timeoutcontroller.WriteTimeoutController, addr net.Addr) {
+	key := key(addr)
+	s.add(session, key)
+}
+
+func (s *WriteSessionCollection) Fetch(addr net.Addr) (session timeoutcontroller.WriteTimeoutController, ok bool) {
+	return s.fetch(key(addr))
+}
+
+func (s *WriteSessionCollection) Remove(addr net.Addr) {
+	s.remove(key(addr))
+}
+
+func (s *WriteSessionCollection) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.sessions)
+}
+
+// All returns every session in the collection at the time of the call.
+func (s *WriteSessionCollection) All() []timeoutcontroller.WriteTimeoutController {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	sessions := make([]timeoutcontroller.WriteTimeoutController, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+func (s *WriteSessionCollection) add(session timeoutcontroller.WriteTimeoutController, key sessionKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[key] = session
+}
+
+func (s *WriteSessionCollection) fetch(key sessionKey) (session timeoutcontroller.WriteTimeoutController, ok bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	session, ok = s.sessions[key]
+	return
+}
+
+func (s *WriteSessionCollection) remove(key sessionKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, key)
+}
+
+func key(addr net.Addr) sessionKey {
+	return sessionKey(clientaddr.KeyOf(addr))
+}
@@ -0,0 +1,85 @@
+package writesessioncollection
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mark-rushakoff/go_tftpd/testhelpers"
+	"github.com/mark-rushakoff/go_tftpd/timeoutcontroller"
+)
+
+func TestAddSessionMakesFetchable(t *testing.T) {
+	session := &timeoutcontroller.MockWriteTimeoutController{}
+	addr := testhelpers.MakeMockAddr("fake_network", "a")
+
+	manager := NewWriteSessionCollection()
+	manager.Add(session, addr)
+
+	s, ok := manager.Fetch(addr)
+	if !ok {
+		t.Fatalf("Should have been able to fetch session")
+	}
+	if s != session {
+		t.Fatalf("Incorrect session returned")
+	}
+}
+
+func TestRemoveMakesFetchFail(t *testing.T) {
+	session := &timeoutcontroller.MockWriteTimeoutController{}
+	addr := testhelpers.MakeMockAddr("fake_network", "a")
+
+	manager := NewWriteSessionCollection()
+	manager.Add(session, addr)
+	manager.Remove(addr)
+
+	_, ok := manager.Fetch(addr)
+	if ok {
+		t.Fatalf("Should not have been able to fetch removed session")
+	}
+}
+
+func TestAllReturnsEverySession(t *testing.T) {
+	sessionA := &timeoutcontroller.MockWriteTimeoutController{}
+	sessionB := &timeoutcontroller.MockWriteTimeoutController{}
+
+	manager := NewWriteSessionCollection()
+	manager.Add(sessionA, testhelpers.MakeMockAddr("fake_network", "a"))
+	manager.Add(sessionB, testhelpers.MakeMockAddr("fake_network", "b"))
+
+	if manager.Len() != 2 {
+		t.Fatalf("Expected 2 sessions, got %v", manager.Len())
+	}
+
+	all := manager.All()
+	if len(all) != 2 {
+		t.Fatalf("Expected 2 sessions, got %v", len(all))
+	}
+	if !(all[0] == sessionA && all[1] == sessionB) && !(all[0] == sessionB && all[1] == sessionA) {
+		t.Fatalf("Incorrect sessions returned")
+	}
+
+	manager.Remove(testhelpers.MakeMockAddr("fake_network", "a"))
+	if manager.Len() != 1 {
+		t.Fatalf("Expected 1 session after removal, got %v", manager.Len())
+	}
+}
+
+func TestFetchFindsSessionHoweverAddressIsSpelled(t *testing.T) {
+	session := &timeoutcontroller.MockWriteTimeoutController{}
+
+	manager := NewWriteSessionCollection()
+	// as reported by a dual-stack socket
+	manager.Add(session, &net.UDPAddr{IP: net.ParseIP("::ffff:10.0.0.1"), Port: 69})
+
+	if s, ok := manager.Fetch(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 69}); !ok || s != session {
+		t.Fatalf("Should have been able to fetch session by its IPv4 address")
+	}
+	if _, ok := manager.Fetch(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 70}); ok {
+		t.Fatalf("Should not have been able to fetch session from another port")
+	}
+
+	manager.Remove(testhelpers.MakeMockAddr("udp", "10.0.0.1:69"))
+	if manager.Len() != 0 {
+		t.Fatalf("Expected the session to be removed, %v remain", manager.Len())
+	}
+}